@@ -0,0 +1,49 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/rovechkin1/message-sign/service/audit"
+	"github.com/rovechkin1/message-sign/service/config"
+	"github.com/rovechkin1/message-sign/service/store"
+)
+
+func usage() {
+	fmt.Printf("Usage: audit verify\n")
+	fmt.Printf("\t verify walks audit log of signed batches and reports breaks of hash chain\n")
+}
+
+func main() {
+	if len(os.Args) < 2 || os.Args[1] != "verify" {
+		usage()
+		if len(os.Args) > 1 && (os.Args[1] == "-h" || os.Args[1] == "--help") {
+			return
+		}
+		os.Exit(2)
+	}
+
+	ctx := context.Background()
+	mongoClient, _, err := store.ConnectMongoClient(ctx)
+	if err != nil {
+		log.Fatalf("Cannot connect to mongo: %v, error: %v", config.GetMongoUrl(), err)
+	}
+	defer mongoClient.Close(ctx)
+
+	report, err := audit.Verify(ctx, store.NewMongoStore(mongoClient))
+	if err != nil {
+		log.Fatalf("ERROR: failed to verify audit log, error: %v", err)
+	}
+	out, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		log.Fatalf("ERROR: failed to encode report, error: %v", err)
+	}
+	fmt.Println(string(out))
+	if len(report.Breaks) > 0 {
+		mongoClient.Close(ctx)
+		os.Exit(1)
+	}
+}
@@ -1,23 +1,36 @@
 package main
 
 import (
-	"crypto/ecdsa"
+	"encoding/hex"
 	"fmt"
+	"github.com/ethereum/go-ethereum/accounts/keystore"
 	"github.com/ethereum/go-ethereum/common/hexutil"
 	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/google/uuid"
+	"github.com/rovechkin1/message-sign/service/config"
+	"github.com/rovechkin1/message-sign/service/signer"
 	"log"
 	"os"
+	"path"
 	"strconv"
+	"time"
 )
 
 func main() {
 	numRecords := 100
+	format := "csv"
+	alg := signer.AlgEcdsaSecp256k1
 	var err error
 	if len(os.Args) > 1 {
 		if os.Args[1] == "-h" ||
 			os.Args[1] == "--help" {
-			fmt.Printf("Usage: key-generator [num_record]\n")
+			fmt.Printf("Usage: key-generator [num_record] [csv|keystore] [algorithm]\n")
 			fmt.Printf("\t num_record default is 100\n")
+			fmt.Printf("\t csv writes plain keys to keys.csv, this is default\n")
+			fmt.Printf("\t keystore writes encrypted V3 keystore files to keystore directory,\n")
+			fmt.Printf("\t passphrase is read from BS_KEYSTORE_PASSPHRASE_FILE or BS_KEYSTORE_PASSPHRASE\n")
+			fmt.Printf("\t algorithm is ecdsa-secp256k1 (default), ed25519 or schnorr-secp256k1,\n")
+			fmt.Printf("\t keystore supports ecdsa-secp256k1 only\n")
 			return
 		} else {
 			numRecords, err = strconv.Atoi(os.Args[1])
@@ -26,12 +39,36 @@ func main() {
 			}
 		}
 	}
+	if len(os.Args) > 2 {
+		format = os.Args[2]
+	}
+	if len(os.Args) > 3 {
+		alg, err = signer.ParseAlgorithm(os.Args[3])
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	if format == "keystore" && alg != signer.AlgEcdsaSecp256k1 {
+		log.Fatalf("keystore doesn't support %v keys", alg)
+	}
 
-	keys, err := generateKeys(numRecords)
+	keys, err := generateKeys(numRecords, alg)
 	if err != nil {
 		log.Fatal("can't generate keys")
 	}
 
+	switch format {
+	case "csv":
+		writeCsv(keys)
+	case "keystore":
+		writeKeystore(keys)
+	default:
+		log.Fatalf("unknown output format: %v", format)
+	}
+}
+
+// writeCsv writes plain keys to keys.csv
+func writeCsv(keys map[string]SigningKey) {
 	f, err := os.Create("keys.csv")
 
 	if err != nil {
@@ -41,7 +78,7 @@ func main() {
 	defer f.Close()
 	count := 0
 	for _, v := range keys {
-		_, err2 := f.WriteString(fmt.Sprintf("%s,%s\n", v.KeyId, v.pk))
+		_, err2 := f.WriteString(fmt.Sprintf("%s,%s,%s\n", v.KeyId, v.pk, v.alg))
 
 		if err2 != nil {
 			log.Fatal(err2)
@@ -52,32 +89,81 @@ func main() {
 	fmt.Printf("done, inserted %v records\n", count)
 }
 
-// SigningKey contains key id, public key and private key
+// writeKeystore writes keys as encrypted V3 keystore json files
+func writeKeystore(keys map[string]SigningKey) {
+	passphrase, err := config.GetKeystorePassphrase()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if passphrase == "" {
+		log.Fatal("keystore passphrase is not set")
+	}
+	scryptN, scryptP := keystore.StandardScryptN, keystore.StandardScryptP
+	if config.GetKeystoreLightScrypt() {
+		scryptN, scryptP = keystore.LightScryptN, keystore.LightScryptP
+	}
+
+	dir := "keystore"
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		log.Fatal(err)
+	}
+	count := 0
+	for _, v := range keys {
+		privateKey, err := crypto.HexToECDSA(v.pk[2:])
+		if err != nil {
+			log.Fatal(err)
+		}
+		id, err := uuid.NewRandom()
+		if err != nil {
+			log.Fatal(err)
+		}
+		key := &keystore.Key{
+			Id:         id,
+			Address:    crypto.PubkeyToAddress(privateKey.PublicKey),
+			PrivateKey: privateKey,
+		}
+		keyJson, err := keystore.EncryptKey(key, passphrase, scryptN, scryptP)
+		if err != nil {
+			log.Fatal(err)
+		}
+		name := fmt.Sprintf("UTC--%s--%s", time.Now().UTC().Format("2006-01-02T15-04-05.000000000Z"),
+			hex.EncodeToString(key.Address[:]))
+		if err := os.WriteFile(path.Join(dir, name), keyJson, 0600); err != nil {
+			log.Fatal(err)
+		}
+		count += 1
+	}
+
+	fmt.Printf("done, inserted %v records\n", count)
+}
+
+// SigningKey contains key id, public key, private key and algorithm
 type SigningKey struct {
 	KeyId string
 	pk    string
+	alg   signer.Algorithm
 }
 
-func generateKeys(nKeys int) (map[string]SigningKey, error) {
+func generateKeys(nKeys int, alg signer.Algorithm) (map[string]SigningKey, error) {
+	s, err := signer.SignerFor(alg)
+	if err != nil {
+		return nil, err
+	}
 	keys := make(map[string]SigningKey)
 	for iKey := 0; iKey < nKeys; iKey += 1 {
-		privateKey, err := crypto.GenerateKey()
+		privateKey, err := s.GenerateKey()
 		if err != nil {
 			return nil, err
 		}
-		privateKeyHex := hexutil.Encode(crypto.FromECDSA(privateKey))
-
-		publicKey := privateKey.Public()
-		publicKeyECDSA, ok := publicKey.(*ecdsa.PublicKey)
-		if !ok {
+		publicKey, err := s.PublicKey(privateKey)
+		if err != nil {
 			return nil, err
 		}
 
-		publicKeyBytes := crypto.FromECDSAPub(publicKeyECDSA)
-
 		key := SigningKey{
-			KeyId: hexutil.Encode(publicKeyBytes),
-			pk:    privateKeyHex,
+			KeyId: hexutil.Encode(publicKey),
+			pk:    hexutil.Encode(privateKey),
+			alg:   alg,
 		}
 
 		keys[key.KeyId] = key
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/rovechkin1/message-sign/service/batch"
+	"github.com/rovechkin1/message-sign/service/config"
+	"github.com/rovechkin1/message-sign/service/store"
+)
+
+func usage() {
+	fmt.Printf("Usage: nonce-check check|repair\n")
+	fmt.Printf("\t check scans signed records of each key and reports nonce gaps and duplicates\n")
+	fmt.Printf("\t repair returns records after the first gap or duplicate of a key to signing\n")
+	fmt.Printf("\t        and rolls key nonce back, so they are signed again with contiguous nonces\n")
+}
+
+func main() {
+	if len(os.Args) < 2 || (os.Args[1] != "check" && os.Args[1] != "repair") {
+		usage()
+		if len(os.Args) > 1 && (os.Args[1] == "-h" || os.Args[1] == "--help") {
+			return
+		}
+		os.Exit(2)
+	}
+	repair := os.Args[1] == "repair"
+
+	ctx := context.Background()
+	mongoClient, _, err := store.ConnectMongoClient(ctx)
+	if err != nil {
+		log.Fatalf("Cannot connect to mongo: %v, error: %v", config.GetMongoUrl(), err)
+	}
+	defer mongoClient.Close(ctx)
+
+	report, err := batch.CheckNonces(ctx, store.NewMongoStore(mongoClient), repair)
+	if err != nil {
+		log.Fatalf("ERROR: failed to check nonces, error: %v", err)
+	}
+	out, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		log.Fatalf("ERROR: failed to encode report, error: %v", err)
+	}
+	fmt.Println(string(out))
+	for _, key := range report.Keys {
+		if !key.Repaired {
+			mongoClient.Close(ctx)
+			os.Exit(1)
+		}
+	}
+}
@@ -91,12 +91,10 @@ func insertRecordsXact(ctx context.Context, client *mongo.Client, numRecords int
 	}
 	defer xact.Close(ctx)
 
-	insertRecords := func(sessionContext mongo.SessionContext) (interface{}, error) {
-		err := insertRecordsAux(sessionContext, client, numRecords)
-		return nil, err
+	insertRecords := func(xactCtx context.Context) error {
+		return insertRecordsAux(xactCtx, client, numRecords)
 	}
-	_, err = xact.WithTransaction(ctx, insertRecords)
-	return err
+	return xact.WithTransaction(ctx, insertRecords)
 }
 
 // This is a user defined method that accepts
@@ -128,11 +126,16 @@ func insertRecordsAux(ctx context.Context, client *mongo.Client, numRecords int)
 		recs := generateRecords(batchSize)
 		var bsons []interface{}
 		for _, r := range recs {
+			shardKey, err := store.ShardKey(r.Id)
+			if err != nil {
+				return err
+			}
 			obj := bson.D{
 				{"id", r.Id},
 				{"msg", r.Msg},
 				{"sign", r.Signature},
 				{"key", r.KeyId},
+				{"shard_key", shardKey},
 			}
 			bsons = append(bsons, obj)
 		}
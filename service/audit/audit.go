@@ -0,0 +1,136 @@
+package audit
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/rovechkin1/message-sign/service/store"
+)
+
+// MaxAppendAttempts is the number of times entry is linked
+// to a new head when concurrent appends conflict
+const MaxAppendAttempts = 10
+
+// AppendWithRetry appends entry outside of a transaction, concurrent
+// appends conflict on sequence number and the entry is linked to the new
+// head again. Within a transaction use Append and retry the transaction,
+// since a conflict aborts it and no write of its callback can succeed
+func AppendWithRetry(ctx context.Context, msgStore store.MessageStore, entry store.AuditEntry) error {
+	var err error
+	for attempt := 0; attempt < MaxAppendAttempts; attempt++ {
+		err = Append(ctx, msgStore, entry)
+		if !errors.Is(err, store.ErrAuditConflict) {
+			return err
+		}
+	}
+	return err
+}
+
+// Append links entry to the current head of audit log and writes it,
+// returns error wrapping store.ErrAuditConflict if another entry
+// was appended to the same head
+func Append(ctx context.Context, msgStore store.MessageStore, entry store.AuditEntry) error {
+	head, err := msgStore.ReadAuditHead(ctx)
+	if err != nil && err != store.ErrNotFound {
+		return err
+	}
+	entry.Seq = 1
+	entry.PrevHash = ""
+	if head != nil {
+		entry.Seq = head.Seq + 1
+		entry.PrevHash = head.Hash
+	}
+	// mongo keeps time with millisecond precision
+	entry.Time = time.Now().UTC().Truncate(time.Millisecond)
+	entry.Hash, err = Hash(entry)
+	if err != nil {
+		return err
+	}
+	return msgStore.WriteAuditEntry(ctx, &entry)
+}
+
+// Hash computes hash of entry over all its fields except Hash
+func Hash(entry store.AuditEntry) (string, error) {
+	data, err := json.Marshal(struct {
+		Seq       int64    `json:"seq"`
+		Time      int64    `json:"time"`
+		BatchId   string   `json:"batch_id"`
+		Shard     int      `json:"shard"`
+		KeyId     string   `json:"key"`
+		NonceFrom int64    `json:"nonce_from"`
+		NonceTo   int64    `json:"nonce_to"`
+		RecordIds []string `json:"record_ids"`
+		PrevHash  string   `json:"prev_hash"`
+	}{
+		Seq:       entry.Seq,
+		Time:      entry.Time.UnixMilli(),
+		BatchId:   entry.BatchId,
+		Shard:     entry.Shard,
+		KeyId:     entry.KeyId,
+		NonceFrom: entry.NonceFrom,
+		NonceTo:   entry.NonceTo,
+		RecordIds: entry.RecordIds,
+		PrevHash:  entry.PrevHash,
+	})
+	if err != nil {
+		return "", err
+	}
+	return hexutil.Encode(crypto.Keccak256(data)), nil
+}
+
+// Break is an audit log entry which doesn't match the chain
+type Break struct {
+	Seq    int64  `json:"seq"`
+	Reason string `json:"reason"`
+}
+
+// Report is a result of audit log verification
+type Report struct {
+	Checked  int     `json:"checked"`
+	HeadSeq  int64   `json:"head_seq"`
+	HeadHash string  `json:"head_hash"`
+	Breaks   []Break `json:"breaks"`
+}
+
+// Verify walks audit log and checks sequence numbers,
+// entry hashes and links to previous entries
+func Verify(ctx context.Context, msgStore store.MessageStore) (*Report, error) {
+	report := &Report{Breaks: []Break{}}
+	var prev *store.AuditEntry
+	err := msgStore.ScanAuditLog(ctx, func(entry store.AuditEntry) error {
+		report.Checked += 1
+		expectedSeq, expectedPrev := int64(1), ""
+		if prev != nil {
+			expectedSeq, expectedPrev = prev.Seq+1, prev.Hash
+		}
+		if entry.Seq != expectedSeq {
+			report.Breaks = append(report.Breaks, Break{entry.Seq,
+				fmt.Sprintf("expected seq %v", expectedSeq)})
+		}
+		if entry.PrevHash != expectedPrev {
+			report.Breaks = append(report.Breaks, Break{entry.Seq,
+				fmt.Sprintf("prev hash %v doesn't match hash of previous entry %v", entry.PrevHash, expectedPrev)})
+		}
+		hash, err := Hash(entry)
+		if err != nil {
+			return err
+		}
+		if hash != entry.Hash {
+			report.Breaks = append(report.Breaks, Break{entry.Seq,
+				fmt.Sprintf("hash %v doesn't match content hash %v", entry.Hash, hash)})
+		}
+		report.HeadSeq = entry.Seq
+		report.HeadHash = entry.Hash
+		prev = &entry
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return report, nil
+}
@@ -0,0 +1,130 @@
+package audit
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/rovechkin1/message-sign/service/store"
+)
+
+// tamperedStore serves audit log changed by tamper
+type tamperedStore struct {
+	store.MessageStore
+	tamper func(entries []store.AuditEntry) []store.AuditEntry
+}
+
+func (c *tamperedStore) ScanAuditLog(ctx context.Context, fn func(entry store.AuditEntry) error) error {
+	var entries []store.AuditEntry
+	err := c.MessageStore.ScanAuditLog(ctx, func(entry store.AuditEntry) error {
+		entries = append(entries, entry)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, entry := range c.tamper(entries) {
+		if err := fn(entry); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// auditLog returns store with audit log of n batches
+func auditLog(t *testing.T, n int) store.MessageStore {
+	msgStore := store.NewMemoryStore()
+	for i := 0; i < n; i++ {
+		err := Append(context.Background(), msgStore, store.AuditEntry{
+			KeyId:     "key",
+			NonceFrom: int64(i),
+			NonceTo:   int64(i),
+			RecordIds: []string{fmt.Sprint(i)},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return msgStore
+}
+
+func verify(t *testing.T, msgStore store.MessageStore) *Report {
+	report, err := Verify(context.Background(), msgStore)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return report
+}
+
+func TestVerifyIntactLog(t *testing.T) {
+	report := verify(t, auditLog(t, 3))
+	if report.Checked != 3 || report.HeadSeq != 3 || len(report.Breaks) != 0 {
+		t.Errorf("got report %+v, want 3 entries without breaks", report)
+	}
+}
+
+func TestVerifyChangedEntry(t *testing.T) {
+	msgStore := &tamperedStore{MessageStore: auditLog(t, 3), tamper: func(entries []store.AuditEntry) []store.AuditEntry {
+		entries[1].RecordIds = []string{"other"}
+		return entries
+	}}
+	report := verify(t, msgStore)
+	if len(report.Breaks) != 1 || report.Breaks[0].Seq != 2 {
+		t.Errorf("got breaks %+v, want hash mismatch of entry 2", report.Breaks)
+	}
+}
+
+func TestVerifyRehashedEntry(t *testing.T) {
+	// entry hash matches its content, next entry links to the original
+	msgStore := &tamperedStore{MessageStore: auditLog(t, 3), tamper: func(entries []store.AuditEntry) []store.AuditEntry {
+		entries[1].RecordIds = []string{"other"}
+		entries[1].Hash, _ = Hash(entries[1])
+		return entries
+	}}
+	report := verify(t, msgStore)
+	if len(report.Breaks) != 1 || report.Breaks[0].Seq != 3 {
+		t.Errorf("got breaks %+v, want prev hash mismatch of entry 3", report.Breaks)
+	}
+}
+
+func TestVerifyRemovedEntry(t *testing.T) {
+	msgStore := &tamperedStore{MessageStore: auditLog(t, 3), tamper: func(entries []store.AuditEntry) []store.AuditEntry {
+		return append(entries[:1], entries[2:]...)
+	}}
+	report := verify(t, msgStore)
+	// both seq and prev hash of entry 3 don't match entry 1
+	if len(report.Breaks) != 2 || report.Breaks[0].Seq != 3 || report.Breaks[1].Seq != 3 {
+		t.Errorf("got breaks %+v, want seq and prev hash mismatch of entry 3", report.Breaks)
+	}
+}
+
+func TestAppendWithRetryConcurrent(t *testing.T) {
+	const writers, appends = 4, 10
+	msgStore := store.NewMemoryStore()
+	errs := make(chan error, writers)
+	for w := 0; w < writers; w++ {
+		go func(w int) {
+			for i := 0; i < appends; i++ {
+				err := AppendWithRetry(context.Background(), msgStore, store.AuditEntry{
+					KeyId:     fmt.Sprint(w),
+					NonceFrom: int64(i),
+					NonceTo:   int64(i),
+				})
+				if err != nil {
+					errs <- err
+					return
+				}
+			}
+			errs <- nil
+		}(w)
+	}
+	for w := 0; w < writers; w++ {
+		if err := <-errs; err != nil {
+			t.Fatal(err)
+		}
+	}
+	report := verify(t, msgStore)
+	if report.Checked != writers*appends || len(report.Breaks) != 0 {
+		t.Errorf("got checked %v, breaks %v, want %v, none", report.Checked, report.Breaks, writers*appends)
+	}
+}
@@ -2,16 +2,31 @@ package batch
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/rovechkin1/message-sign/service/merkle"
+	"github.com/rovechkin1/message-sign/service/signer"
 	"github.com/rovechkin1/message-sign/service/store"
+	"log"
+	"math"
+	"sort"
+	"time"
 )
 
+// ErrInvalidRecord is returned when submitted record can't be signed
+var ErrInvalidRecord = errors.New("invalid record")
+
 type SignerStats struct {
 	SignedRecords   int `json:"signed_records"`
 	UnsignedRecords int `json:"unsigned_records"`
+	// current batch size of this pod, omitted if signer is not running
+	BatchSize int `json:"batch_size,omitempty"`
 }
 
 // SignRecords signs records in bulk
-func GetStats(ctx context.Context, store store.MessageStore) (*SignerStats, error) {
+func GetStats(ctx context.Context, store store.MessageStore, batchSigner *BatchSigner) (*SignerStats, error) {
 	var err error
 	stats := &SignerStats{}
 	stats.UnsignedRecords, err = store.GetRecordCount(ctx, false)
@@ -24,5 +39,429 @@ func GetStats(ctx context.Context, store store.MessageStore) (*SignerStats, erro
 		return nil, err
 	}
 
+	if batchSigner != nil {
+		stats.BatchSize = batchSigner.BatchSize()
+	}
+
 	return stats, nil
 }
+
+// RecordRequest is a message or a transaction template submitted for signing
+type RecordRequest struct {
+	Id   string           `json:"id"`
+	Msg  string           `json:"msg"`
+	Type store.RecordType `json:"type,omitempty"`
+	// Scheme is a sign scheme of message: raw, eip191 or eip712,
+	// default scheme of deployment is used if empty
+	Scheme string `json:"scheme,omitempty"`
+	// Algorithm is a signature algorithm of message, ecdsa-secp256k1 if empty
+	Algorithm string `json:"algorithm,omitempty"`
+	// Tx is a transaction template of tx record
+	Tx *signer.TxTemplate `json:"tx,omitempty"`
+}
+
+// SubmitRecords validates and inserts records for signing
+func SubmitRecords(ctx context.Context, msgStore store.MessageStore, requests []RecordRequest) error {
+	var records []store.Record
+	for _, r := range requests {
+		if err := store.ValidateRecordId(r.Id); err != nil {
+			return err
+		}
+		alg, err := signer.ParseAlgorithm(r.Algorithm)
+		if err != nil {
+			return fmt.Errorf("%w: %v", ErrInvalidRecord, err)
+		}
+		record := store.Record{
+			Id:        r.Id,
+			Msg:       r.Msg,
+			Algorithm: r.Algorithm,
+		}
+		switch r.Type {
+		case "", store.RecordMsg:
+			if r.Scheme != "" {
+				scheme, err := signer.ParseScheme(r.Scheme)
+				if err != nil {
+					return fmt.Errorf("%w: %v", ErrInvalidRecord, err)
+				}
+				if alg != signer.AlgEcdsaSecp256k1 && scheme != signer.SchemeRaw {
+					return fmt.Errorf("%w: scheme %v is not supported by %v", ErrInvalidRecord, scheme, alg)
+				}
+			}
+			record.Scheme = r.Scheme
+		case store.RecordTx:
+			if alg != signer.AlgEcdsaSecp256k1 {
+				return fmt.Errorf("%w: transactions require %v", ErrInvalidRecord, signer.AlgEcdsaSecp256k1)
+			}
+			// template is stored as msg and parsed again by signer
+			if r.Tx == nil {
+				return fmt.Errorf("%w: %v", ErrInvalidRecord, "tx template is required")
+			}
+			if err := r.Tx.Validate(); err != nil {
+				return fmt.Errorf("%w: %v", ErrInvalidRecord, err)
+			}
+			msg, err := json.Marshal(r.Tx)
+			if err != nil {
+				return err
+			}
+			record.Msg = string(msg)
+			record.Type = store.RecordTx
+		default:
+			return fmt.Errorf("%w: unknown record type: %v", ErrInvalidRecord, r.Type)
+		}
+		records = append(records, record)
+	}
+	return msgStore.InsertRecords(ctx, records)
+}
+
+// RecordResponse is a record with its signing status
+type RecordResponse struct {
+	Id        string             `json:"id"`
+	Status    store.RecordStatus `json:"status"`
+	Msg       string             `json:"msg,omitempty"`
+	Signature string             `json:"sign,omitempty"`
+	Salt      string             `json:"salt,omitempty"`
+	BatchId   string             `json:"batch_id,omitempty"`
+	Proof     []string           `json:"proof,omitempty"`
+	KeyId     string             `json:"key,omitempty"`
+	Type      store.RecordType   `json:"type,omitempty"`
+	Scheme    string             `json:"scheme,omitempty"`
+	Algorithm string             `json:"algorithm,omitempty"`
+	RawTx     string             `json:"raw_tx,omitempty"`
+	TxHash    string             `json:"tx_hash,omitempty"`
+	// account nonce of signed transaction
+	TxNonce   *int64 `json:"tx_nonce,omitempty"`
+	Attempts  int    `json:"attempts,omitempty"`
+	LastError string `json:"last_error,omitempty"`
+}
+
+// GetRecord returns record and its signing status
+func GetRecord(ctx context.Context, msgStore store.MessageStore, id string) (*RecordResponse, error) {
+	record, status, err := msgStore.GetRecord(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if record == nil {
+		return &RecordResponse{
+			Id:     id,
+			Status: status,
+		}, nil
+	}
+	resp := toRecordResponse(*record, status)
+	return &resp, nil
+}
+
+func toRecordResponse(record store.Record, status store.RecordStatus) RecordResponse {
+	resp := RecordResponse{
+		Id:        record.Id,
+		Status:    status,
+		Msg:       record.Msg,
+		Signature: record.Signature,
+		Salt:      record.Salt,
+		BatchId:   record.BatchId,
+		Proof:     record.Proof,
+		KeyId:     record.KeyId,
+		Type:      record.Type,
+		Scheme:    record.Scheme,
+		Algorithm: record.Algorithm,
+		RawTx:     record.RawTx,
+		TxHash:    record.TxHash,
+		Attempts:  record.Attempts,
+		LastError: record.LastError,
+	}
+	if record.Type == store.RecordTx && record.RawTx != "" {
+		resp.TxNonce = &record.TxNonce
+	}
+	return resp
+}
+
+// ListDeadLetters returns up to limit records which failed to sign too many times
+func ListDeadLetters(ctx context.Context, msgStore store.MessageStore, limit int) ([]RecordResponse, error) {
+	records, err := msgStore.ListDeadLetters(ctx, limit)
+	if err != nil {
+		return nil, err
+	}
+	resp := []RecordResponse{}
+	for _, r := range records {
+		resp = append(resp, toRecordResponse(r, store.RecordDeadLetter))
+	}
+	return resp, nil
+}
+
+// RequeueDeadLetter returns dead letter to unsigned records,
+// it is signed again with a fresh number of attempts
+func RequeueDeadLetter(ctx context.Context, msgStore store.MessageStore, id string) error {
+	return msgStore.RequeueDeadLetter(ctx, id)
+}
+
+// VerifyRequest is a signature or a signed transaction to verify
+type VerifyRequest struct {
+	KeyId     string `json:"key"`
+	Salt      string `json:"salt"`
+	Msg       string `json:"msg"`
+	Signature string `json:"sign"`
+	// Scheme is a sign scheme of signature, raw if empty
+	Scheme string `json:"scheme,omitempty"`
+	// Algorithm is a signature algorithm, ecdsa-secp256k1 if empty
+	Algorithm string `json:"algorithm,omitempty"`
+	// RawTx is verified instead of signature if set
+	RawTx string `json:"raw_tx,omitempty"`
+	// BatchId is a merkle root signed by sign, inclusion proof of
+	// record id, salt and msg is verified if set
+	Id      string   `json:"id,omitempty"`
+	BatchId string   `json:"batch_id,omitempty"`
+	Proof   []string `json:"proof,omitempty"`
+}
+
+// VerifyReport is a result of verification of all signed records
+type VerifyReport struct {
+	Checked    int      `json:"checked"`
+	Invalid    int      `json:"invalid"`
+	InvalidIds []string `json:"invalid_ids"`
+}
+
+// VerifySignature verifies a single signature
+func VerifySignature(req VerifyRequest) (bool, error) {
+	if req.RawTx != "" {
+		return signer.VerifyTx(req.KeyId, req.RawTx)
+	}
+	if req.BatchId != "" {
+		return verifyMerkle(req.Algorithm, req.Scheme, req.KeyId, req.Id, req.Salt, req.Msg,
+			req.BatchId, req.Proof, req.Signature)
+	}
+	return verifyMsg(req.Algorithm, req.Scheme, req.KeyId, req.Salt, req.Msg, req.Signature)
+}
+
+// VerifySignedRecords re-verifies signatures of all signed records
+func VerifySignedRecords(ctx context.Context, msgStore store.MessageStore) (*VerifyReport, error) {
+	report := &VerifyReport{InvalidIds: []string{}}
+	err := msgStore.ScanSignedRecords(ctx, func(record store.Record) error {
+		report.Checked += 1
+		ok, err := verifyRecord(record)
+		if err != nil || !ok {
+			log.Printf("WARN: invalid signature for record id: %v, error: %v", record.Id, err)
+			report.Invalid += 1
+			report.InvalidIds = append(report.InvalidIds, record.Id)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return report, nil
+}
+
+// verifyRecord verifies signature or signed transaction of a record
+func verifyRecord(record store.Record) (bool, error) {
+	if record.Type == store.RecordTx {
+		return signer.VerifyTx(record.KeyId, record.RawTx)
+	}
+	if record.BatchId != "" {
+		return verifyMerkle(record.Algorithm, record.Scheme, record.KeyId, record.Id, record.Salt, record.Msg,
+			record.BatchId, record.Proof, record.Signature)
+	}
+	return verifyMsg(record.Algorithm, record.Scheme, record.KeyId, record.Salt, record.Msg, record.Signature)
+}
+
+// verifyMsg verifies message signature, empty scheme is raw and empty algorithm is ECDSA
+// since records signed before they were introduced have neither
+func verifyMsg(algorithm string, scheme string, keyId string, salt string, msg string, sig string) (bool, error) {
+	if scheme == "" {
+		scheme = string(signer.SchemeRaw)
+	}
+	alg, err := signer.ParseAlgorithm(algorithm)
+	if err != nil {
+		return false, err
+	}
+	return signer.VerifyScheme(alg, signer.Scheme(scheme), keyId, salt, msg, sig)
+}
+
+// verifyMerkle verifies that record is included into merkle batch
+// and that batch root is signed by the key
+func verifyMerkle(algorithm string, scheme string, keyId string, id string, salt string, msg string,
+	batchId string, encodedProof []string, sig string) (bool, error) {
+	root, err := hexutil.Decode(batchId)
+	if err != nil {
+		return false, fmt.Errorf("invalid batch id: %v", err)
+	}
+	proof, err := merkle.DecodeProof(encodedProof)
+	if err != nil {
+		return false, err
+	}
+	if !merkle.Verify(root, merkle.RecordLeaf(id, salt, msg), proof) {
+		return false, nil
+	}
+	return verifyMsg(algorithm, scheme, keyId, "", batchId, sig)
+}
+
+// GetMerkleBatch returns signed merkle batch root
+func GetMerkleBatch(ctx context.Context, msgStore store.MessageStore, id string) (*MerkleBatchResponse, error) {
+	batch, err := msgStore.ReadMerkleBatch(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	return &MerkleBatchResponse{
+		Id:        batch.Id,
+		KeyId:     batch.KeyId,
+		Algorithm: batch.Algorithm,
+		Signature: batch.Signature,
+		Shard:     batch.Shard,
+		Size:      batch.Size,
+		CreatedAt: batch.CreatedAt,
+	}, nil
+}
+
+// MerkleBatchResponse is a signed merkle batch root
+type MerkleBatchResponse struct {
+	Id        string    `json:"id"`
+	KeyId     string    `json:"key"`
+	Algorithm string    `json:"algorithm"`
+	Signature string    `json:"sign"`
+	Shard     int       `json:"shard"`
+	Size      int       `json:"size"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// KeyUsage is a number of records signed by a key
+type KeyUsage struct {
+	KeyId    string  `json:"key"`
+	Signed   int64   `json:"signed"`
+	SharePct float64 `json:"share_pct"`
+}
+
+// KeyUsageReport shows how evenly keys are used
+type KeyUsageReport struct {
+	Keys   []KeyUsage `json:"keys"`
+	Total  int64      `json:"total"`
+	Min    int64      `json:"min"`
+	Max    int64      `json:"max"`
+	Mean   float64    `json:"mean"`
+	StdDev float64    `json:"stddev"`
+}
+
+// GetKeyUsage returns number of records signed by each key,
+// key nonce is incremented for every signed record, so it is used as a counter
+func GetKeyUsage(ctx context.Context, msgStore store.MessageStore, keyStore signer.KeyStore) (*KeyUsageReport, error) {
+	keyIds, err := keyStore.GetKeyIds()
+	if err != nil {
+		return nil, err
+	}
+	metadata, err := msgStore.ListSigningKeyMetadata(ctx)
+	if err != nil {
+		return nil, err
+	}
+	signed := make(map[string]int64)
+	for _, md := range metadata {
+		signed[md.Id] = md.Nonce
+	}
+
+	report := &KeyUsageReport{Keys: []KeyUsage{}}
+	for _, keyId := range keyIds {
+		n := signed[keyId]
+		report.Keys = append(report.Keys, KeyUsage{KeyId: keyId, Signed: n})
+		report.Total += n
+		if len(report.Keys) == 1 || n < report.Min {
+			report.Min = n
+		}
+		if n > report.Max {
+			report.Max = n
+		}
+	}
+	if len(report.Keys) == 0 {
+		return report, nil
+	}
+	sort.Slice(report.Keys, func(i, j int) bool {
+		return report.Keys[i].KeyId < report.Keys[j].KeyId
+	})
+
+	report.Mean = float64(report.Total) / float64(len(report.Keys))
+	var variance float64
+	for i, k := range report.Keys {
+		if report.Total > 0 {
+			report.Keys[i].SharePct = 100 * float64(k.Signed) / float64(report.Total)
+		}
+		d := float64(k.Signed) - report.Mean
+		variance += d * d
+	}
+	report.StdDev = math.Sqrt(variance / float64(len(report.Keys)))
+	return report, nil
+}
+
+// KeyInfo is a signing key with its status and nonce
+type KeyInfo struct {
+	KeyId     string `json:"key"`
+	Algorithm string `json:"algorithm"`
+	// active keys are used for signing, retired keys are drained with frozen nonce
+	Status string `json:"status"`
+	Nonce  int64  `json:"nonce"`
+	// shard and signer of live key claim, unset if key is not claimed
+	Shard  *int   `json:"shard,omitempty"`
+	Signer string `json:"signer,omitempty"`
+}
+
+// KeySet is a version of key set of this pod and its keys
+type KeySet struct {
+	// version is incremented on every reload which changes keys,
+	// it is 1 if key reload is disabled
+	Version int64     `json:"version"`
+	Keys    []KeyInfo `json:"keys"`
+}
+
+// GetKeys returns active and retired keys of key store sorted by id
+func GetKeys(ctx context.Context, msgStore store.MessageStore, keyStore signer.KeyStore) (*KeySet, error) {
+	keySet := &KeySet{Version: 1, Keys: []KeyInfo{}}
+	status := make(map[string]string)
+	keyIds, err := keyStore.GetKeyIds()
+	if err != nil {
+		return nil, err
+	}
+	for _, keyId := range keyIds {
+		status[keyId] = "active"
+	}
+	if watcher, ok := keyStore.(signer.KeyWatcher); ok {
+		keySet.Version = watcher.Version()
+		for _, keyId := range watcher.RetiredKeyIds() {
+			status[keyId] = "retired"
+		}
+	}
+	metadata, err := msgStore.ListSigningKeyMetadata(ctx)
+	if err != nil {
+		return nil, err
+	}
+	nonces := make(map[string]int64)
+	for _, md := range metadata {
+		nonces[md.Id] = md.Nonce
+	}
+	owners, err := msgStore.ListKeyOwners(ctx)
+	if err != nil {
+		return nil, err
+	}
+	claims := make(map[string]store.KeyOwner)
+	now := time.Now()
+	for _, o := range owners {
+		if o.ExpiresAt.After(now) {
+			claims[o.KeyId] = o
+		}
+	}
+	for keyId, st := range status {
+		alg, err := keyStore.GetKeyAlgorithm(keyId)
+		if err != nil {
+			return nil, err
+		}
+		info := KeyInfo{
+			KeyId:     keyId,
+			Algorithm: string(alg),
+			Status:    st,
+			Nonce:     nonces[keyId],
+		}
+		if o, ok := claims[keyId]; ok {
+			shard := o.Shard
+			info.Shard = &shard
+			info.Signer = o.Signer
+		}
+		keySet.Keys = append(keySet.Keys, info)
+	}
+	sort.Slice(keySet.Keys, func(i, j int) bool {
+		return keySet.Keys[i].KeyId < keySet.Keys[j].KeyId
+	})
+	return keySet, nil
+}
@@ -2,130 +2,302 @@ package batch
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/google/uuid"
+	"github.com/rovechkin1/message-sign/service/audit"
 	"github.com/rovechkin1/message-sign/service/config"
+	"github.com/rovechkin1/message-sign/service/merkle"
+	"github.com/rovechkin1/message-sign/service/metrics"
 	"github.com/rovechkin1/message-sign/service/signer"
 	"github.com/rovechkin1/message-sign/service/store"
-	"go.mongodb.org/mongo-driver/mongo"
 	"log"
 	"strconv"
-	"strings"
 	"time"
 )
 
 // BatchSigner signs messages in batches
 type BatchSigner struct {
-	store        store.MessageStore
-	keyStore     signer.KeyStore
-	mongoClient  *mongo.Client
-	signerId     int
-	totalSigners int
-	batchSize    int
-	keyIdx       int
-	keys         []string
+	store    store.MessageStore
+	keyStore signer.KeyStore
+	assigner ShardAssigner
+	// sizer adapts number of records read per batch
+	sizer *batchSizer
+	// workers is a number of goroutines signing records of a batch
+	workers int
+	// keyIdx is a key rotation index per shard and algorithm,
+	// it is persisted in store and resumed after restart
+	keyIdx map[keyIndex]int
+	// keys are key ids per algorithm, each algorithm is rotated separately
+	keys       map[signer.Algorithm][]string
+	algorithms []signer.Algorithm
+	// watcher is set if key store reloads keys, key set is
+	// refreshed between batches when its version changes
+	watcher    signer.KeyWatcher
+	keyEvents  <-chan signer.KeyEvent
+	keyVersion int64
+	// conflicts are owned keys claimed by another live shard,
+	// they are not used until the claim expires
+	conflicts map[string]bool
+	// claimedAt, claimedShards and claimedVersion describe last key claim,
+	// claims are renewed when shards or key set change or every third of ttl
+	claimedAt      time.Time
+	claimedShards  []int
+	claimedVersion int64
+	// done is closed when periodic signer stops
+	done chan struct{}
+	// drained is true if in-flight batch finished before drain deadline
+	drained bool
 }
 
-func NewBatchSigner(store store.MessageStore, keyStore signer.KeyStore,
-	mongoClient *mongo.Client) (*BatchSigner, error) {
-	batchSize := config.GetBatchSize()
-	// total signers (size of stateful set)
-	totalSigners := config.GetTotalSigners()
+// keyIndex identifies key rotation of shard and algorithm
+type keyIndex struct {
+	shard     int
+	algorithm signer.Algorithm
+}
 
-	// this signer id in format signer-X
-	signerIdString := config.GetMyPodName()
-	idParts := strings.Split(signerIdString, "-")
-	if len(idParts) < 2 {
-		return nil, fmt.Errorf("ERROR: Invalid signer id format: %s, expected signer-0", signerIdString)
-	}
+func NewBatchSigner(store store.MessageStore, keyStore signer.KeyStore,
+	assigner ShardAssigner) (*BatchSigner, error) {
+	log.Printf("INFO: shardCount: %v", assigner.ShardCount())
 
-	signerId, err := strconv.ParseInt(idParts[len(idParts)-1], 10, 64)
+	keys, algorithms, err := groupKeys(keyStore, assigner.ShardCount())
 	if err != nil {
-		return nil, fmt.Errorf("ERROR: Invalid signer id format: %s, expected signer-0", signerIdString)
+		return nil, err
 	}
+	log.Printf("INFO: signing algorithms: %v, workers: %v", algorithms, signWorkers())
 
-	if int(signerId) >= totalSigners {
-		return nil, fmt.Errorf("ERROR: signerId: %v is grater than totalSigners: %v", signerId, totalSigners)
+	c := &BatchSigner{
+		store:      store,
+		keyStore:   keyStore,
+		assigner:   assigner,
+		sizer:      newBatchSizer(),
+		workers:    signWorkers(),
+		keyIdx:     make(map[keyIndex]int),
+		conflicts:  make(map[string]bool),
+		keys:       keys,
+		algorithms: algorithms,
+		done:       make(chan struct{}),
+	}
+	// key stores which reload keys publish key set changes
+	if watcher, ok := keyStore.(signer.KeyWatcher); ok {
+		c.watcher = watcher
+		c.keyEvents = watcher.Subscribe()
+		c.keyVersion = watcher.Version()
 	}
-	log.Printf("INFO: signerId: %v, batch size: batch_size: %v, totalSigners: %v",
-		signerId, batchSize, totalSigners)
 
-	// get available signing keys
-	keys, err := keyStore.GetKeyIds()
-	if err != nil {
+	// resume key rotation from persisted index
+	for _, shard := range assigner.Shards() {
+		for _, alg := range algorithms {
+			if err := c.loadKeyIndex(context.Background(), keyIndex{shard, alg}); err != nil {
+				return nil, err
+			}
+		}
+	}
+	// refuse to start if another live shard signs with our keys
+	if err := c.claimKeys(context.Background(), assigner.Shards()); err != nil {
 		return nil, err
 	}
-
-	// number of keys must be more than number of signers
-	// otherwise we can't do signing in parallel
-	// not enough keys for each signer
-	if int(signerId) >= len(keys) {
-		return nil, fmt.Errorf("ERROR: not enough keys for each signer: %v, signer %v is inactive",
-			len(keys), signerId)
+	// reconcile nonce ranges left by a crashed signer
+	if err := c.recoverNonceRanges(context.Background(), assigner.Shards()); err != nil {
+		return nil, err
 	}
-
-	return &BatchSigner{
-		store:        store,
-		keyStore:     keyStore,
-		mongoClient:  mongoClient,
-		signerId:     int(signerId),
-		totalSigners: totalSigners,
-		batchSize:    batchSize,
-		keys:         keys,
-	}, nil
+	return c, nil
 }
 
-// StartPeriodicBatchSigner periodically polls available records and signs them
+// StartPeriodicBatchSigner periodically polls available records and signs them.
+// When ctx is done no new batches are started and the in-flight batch
+// is given shutdown_drain_timeout_sec to commit before it is aborted
 func (c *BatchSigner) StartPeriodicBatchSigner(ctx context.Context) {
+	signCtx, cancelSign := context.WithCancel(context.Background())
+	go func() {
+		defer cancelSign()
+		select {
+		case <-ctx.Done():
+		case <-c.done:
+			return
+		}
+		drainTimeout := time.Duration(config.GetShutdownDrainTimeoutSec()) * time.Second
+		select {
+		case <-time.After(drainTimeout):
+			log.Printf("WARN: drain deadline exceeded, abort in-flight batch")
+		case <-c.done:
+		}
+	}()
+
+	trigger := c.newTrigger(ctx)
 	go func() {
+		defer close(c.done)
 		for {
-			select {
-			case <-ctx.Done():
-				log.Printf("INFO: BatchSigner is done, batchId: %v", c.signerId)
-				return
-			default:
+			c.syncKeys()
+			shards := c.assigner.Shards()
+			c.forgetKeyIndexes(shards)
+			c.renewKeyClaims(signCtx, shards)
+			idle := true
+			for _, shard := range shards {
+				for _, alg := range c.algorithms {
+					if ctx.Err() != nil {
+						break
+					}
+					keyId, err := c.nextKey(signCtx, keyIndex{shard, alg})
+					var result *batchResult
+					if err == nil {
+						result, err = c.signBatch(signCtx, shard, keyId)
+					}
+					if err != nil {
+						log.Printf("ERROR: failed to sign batchId: %v, algorithm: %v, error: %v", shard, alg, err)
+					}
+					// full batch means there is a backlog in the shard
+					if result != nil && result.signed+result.failed >= result.limit {
+						idle = false
+					}
+				}
 			}
-			keyIdx := (c.keyIdx*c.totalSigners + c.signerId) % len(c.keys)
-			err := c.SignBatch(ctx, c.keys[keyIdx])
-			if err != nil {
-				log.Printf("ERROR: failed to sign batchId: %v, error: %v", c.signerId, err)
+			if !trigger.wait(ctx, idle) {
+				c.drained = signCtx.Err() == nil
+				log.Printf("INFO: BatchSigner is done, shards: %v, drained: %v", shards, c.drained)
+				return
 			}
-			c.keyIdx += 1
-			time.Sleep(1 * time.Second)
 		}
 	}()
 }
 
+// Wait blocks until periodic signer stops, returns error
+// if in-flight batch was aborted by drain deadline
+func (c *BatchSigner) Wait() error {
+	<-c.done
+	if !c.drained {
+		return fmt.Errorf("in-flight batch was aborted by drain deadline")
+	}
+	return nil
+}
+
+// nextKey selects next signing key of shard and algorithm in round-robin order
+// over keys owned by the shard, keys claimed by another shard are skipped
+func (c *BatchSigner) nextKey(ctx context.Context, idx keyIndex) (string, error) {
+	if _, ok := c.keyIdx[idx]; !ok {
+		if err := c.loadKeyIndex(ctx, idx); err != nil {
+			return "", err
+		}
+	}
+	var keys []string
+	for _, keyId := range c.ownedKeys(idx) {
+		if !c.conflicts[keyId] {
+			keys = append(keys, keyId)
+		}
+	}
+	if len(keys) == 0 {
+		return "", fmt.Errorf("no usable %v keys owned by shard: %v", idx.algorithm, idx.shard)
+	}
+	keyIdx := c.keyIdx[idx] % len(keys)
+	c.keyIdx[idx] += 1
+	return keys[keyIdx], nil
+}
+
+// loadKeyIndex reads persisted key rotation index of shard and algorithm
+func (c *BatchSigner) loadKeyIndex(ctx context.Context, idx keyIndex) error {
+	keyIdx, err := c.store.ReadKeyIndex(ctx, idx.shard, string(idx.algorithm))
+	if err != nil {
+		return err
+	}
+	log.Printf("INFO: resume key rotation, batchId: %v, algorithm: %v, keyIdx: %v",
+		idx.shard, idx.algorithm, keyIdx)
+	c.keyIdx[idx] = keyIdx
+	return nil
+}
+
+// forgetKeyIndexes drops cached key index of shards which are
+// no longer assigned, another signer may advance it meanwhile
+func (c *BatchSigner) forgetKeyIndexes(shards []int) {
+	assigned := make(map[int]bool)
+	for _, shard := range shards {
+		assigned[shard] = true
+	}
+	for idx := range c.keyIdx {
+		if !assigned[idx.shard] {
+			delete(c.keyIdx, idx)
+		}
+	}
+}
+
 // SignBatch implements signer for messages
-func (c *BatchSigner) SignBatch(ctx context.Context, keyId string) error {
-	log.Printf("INFO: SignBatch, batchId: %v, keyId: %v", c.signerId, keyId)
-	err := c.signRecords(keyId)
+func (c *BatchSigner) SignBatch(ctx context.Context, shard int, keyId string) error {
+	_, err := c.signBatch(ctx, shard, keyId)
+	return err
+}
+
+// signBatch signs a batch of shard, returns nil result if batch failed
+func (c *BatchSigner) signBatch(ctx context.Context, shard int, keyId string) (*batchResult, error) {
+	log.Printf("INFO: SignBatch, batchId: %v, keyId: %v", shard, keyId)
+	shardCtx, cancel, err := c.assigner.ShardContext(ctx, shard)
+	if err != nil {
+		return nil, err
+	}
+	defer cancel()
+	start := time.Now()
+	limit := c.sizer.get()
+	result, err := c.signRecords(shardCtx, shard, keyId, limit)
+	c.sizer.update(limit, result, time.Since(start))
 	if err != nil {
 		log.Printf("ERROR: failed to sign records for batchId: %v,  keyId: %v, error: %v",
-			c.signerId, keyId, err)
-	} else {
-		log.Printf("INFO: signed  records for batchId: %v, keyId: %v",
-			c.signerId, keyId)
+			shard, keyId, err)
+		return nil, nil
 	}
-	return nil
+	log.Printf("INFO: signed  records for batchId: %v, keyId: %v",
+		shard, keyId)
+	c.reportBatch(shard, result, time.Since(start))
+	return result, nil
+}
+
+// batchResult describes a committed batch
+type batchResult struct {
+	keyId string
+	// limit is max number of records read for the batch
+	limit  int
+	signed int
+	failed int
+	nonce  int64
+	// attempts is number of times transaction callback was run,
+	// more than one attempt means the transaction was retried on conflict
+	attempts int
+}
+
+// BatchSize returns current number of records read per batch
+func (c *BatchSigner) BatchSize() int {
+	return c.sizer.get()
+}
+
+// reportBatch updates metrics once batch is committed
+func (c *BatchSigner) reportBatch(shard int, result *batchResult, latency time.Duration) {
+	if result.signed == 0 && result.failed == 0 {
+		return
+	}
+	shardLabel := strconv.Itoa(shard)
+	metrics.BatchLatency.WithLabelValues(shardLabel).Observe(latency.Seconds())
+	metrics.RecordsSigned.WithLabelValues(result.keyId, shardLabel).Add(float64(result.signed))
+	metrics.SignFailures.WithLabelValues(result.keyId).Add(float64(result.failed))
+	metrics.KeyNonce.WithLabelValues(result.keyId).Set(float64(result.nonce))
 }
-func (c *BatchSigner) signRecords(keyId string) error {
+
+func (c *BatchSigner) signRecords(ctx context.Context, shard int, keyId string, limit int) (*batchResult, error) {
+	shardCount := c.assigner.ShardCount()
 	log.Printf("INFO: sign batch: batchId %v, batchCount: %v",
-		c.signerId, c.totalSigners)
-	ctx := context.Background()
+		shard, shardCount)
 	if config.GetEnableMongoXact() {
-		return c.signRecordsXact(ctx, c.signerId, c.totalSigners, keyId)
+		return c.signRecordsXact(ctx, shard, shardCount, keyId, limit)
 	} else {
 		log.Printf("INFO: disable mongo xact")
-		return c.signRecordsAux(ctx, c.signerId, c.totalSigners, keyId)
+		return c.signRecordsAux(ctx, shard, shardCount, keyId, limit)
 	}
 }
 
-func (c *BatchSigner) signRecordsXact(ctx context.Context, batchId int, batchCount int, keyId string) error {
+func (c *BatchSigner) signRecordsXact(ctx context.Context, batchId int, batchCount int,
+	keyId string, limit int) (*batchResult, error) {
 	log.Printf("INFO: enabled mongo xact")
 	// start transaction
-	xact, err := store.NewMongoXact(c.mongoClient)
+	xact, err := c.store.NewXact(ctx)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	defer xact.Close(ctx)
 	// Run reading and writing of records
@@ -135,70 +307,342 @@ func (c *BatchSigner) signRecordsXact(ctx context.Context, batchId int, batchCou
 	// 2. keys nonce is properly incremented
 	// 3. BulkWrite happens atomically
 	// if failed , then fail the whole batch it will be retried later
-	writeBatch := func(sessionContext mongo.SessionContext) (interface{}, error) {
-		err := c.signRecordsAux(sessionContext, batchId, batchCount, keyId)
+	var result *batchResult
+	attempts := 0
+	writeBatch := func(xactCtx context.Context) error {
+		// callback may be retried, keep result of the last attempt
+		var err error
+		attempts += 1
+		result, err = c.signRecordsAux(xactCtx, batchId, batchCount, keyId, limit)
+		return err
+	}
+	// audit log conflict aborts transaction, so the whole transaction
+	// is run again to link the batch to the new head of audit log
+	for xactAttempt := 1; ; xactAttempt++ {
+		err = xact.WithTransaction(ctx, writeBatch)
+		if !errors.Is(err, store.ErrAuditConflict) || xactAttempt >= audit.MaxAppendAttempts {
+			break
+		}
+		log.Printf("WARN: audit log conflict, retry transaction, batchId: %v, keyId: %v", batchId, keyId)
+	}
+	if err != nil {
 		return nil, err
 	}
-	_, err = xact.WithTransaction(ctx, writeBatch)
-	return err
+	result.attempts = attempts
+	return result, nil
 }
 
-func (c *BatchSigner) signRecordsAux(ctx context.Context, batchId int, batchCount int, keyId string) error {
-	// query records
-	records, err := c.store.ReadBatch(ctx, batchId, batchCount)
+func (c *BatchSigner) signRecordsAux(ctx context.Context, batchId int, batchCount int,
+	keyId string, limit int) (*batchResult, error) {
+	result := &batchResult{keyId: keyId, limit: limit, attempts: 1}
+	// get key
+	key, err := c.keyStore.GetKeyById(keyId)
 	if err != nil {
-		return err
-	}
-	if len(records) == 0 {
-		log.Printf("INFO: no records to sign. BatchId : %v\n", batchId)
-		return nil
+		return nil, err
 	}
+	// decrypted key is zeroed once batch is signed
+	defer key.Release()
 
-	// get key
-	key, err := c.keyStore.GetKeyById(keyId)
+	// query records of key algorithm
+	records, err := c.store.ReadBatch(ctx, batchId, batchCount, string(key.Algorithm), limit)
 	if err != nil {
-		return err
+		return nil, err
+	}
+	if len(records) == 0 {
+		log.Printf("INFO: no records to sign. BatchId : %v\n", batchId)
+		return result, nil
 	}
 
 	// read key metadata which contains nonce
 	var keyMd *store.SigningKeyMetadata
 	keyMd, err = c.store.ReadSigningKeyMetadata(ctx, keyId)
-	if err != nil && err != mongo.ErrNoDocuments {
-		return err
+	if err != nil && err != store.ErrNotFound {
+		return nil, err
 	}
 	if keyMd == nil {
 		keyMd = store.NewSigningKeyMetadata(keyId)
 	}
+	if keyMd.Reserved() {
+		return nil, fmt.Errorf("%w: %v, nonce range [%v, %v) is not committed",
+			store.ErrNonceConflict, keyId, keyMd.ReservedFrom, keyMd.ReservedTo)
+	}
 
-	log.Printf("INFO: start with nonce: %v, keyId: %v, batchId: %v", keyMd.Nonce, keyId, batchId)
+	log.Printf("INFO: start with nonce: %v, tx nonce: %v, keyId: %v, batchId: %v",
+		keyMd.Nonce, keyMd.TxNonce, keyId, batchId)
+	startNonce := keyMd.Nonce
+	startTxNonce := keyMd.TxNonce
+
+	// in merkle mode messages with default scheme are signed once as a batch root
+	merkleMode := config.GetMerkleBatches()
+
+	// nonces are assigned in id order before records are signed in parallel,
+	// transactions get account nonces from a separate sequence of key
+	jobs := make([]signJob, len(records))
+	txNonce := keyMd.TxNonce
+	for i, r := range records {
+		jobs[i] = signJob{
+			record:  r,
+			nonce:   keyMd.Nonce + int64(i),
+			txNonce: txNonce,
+			merkle:  merkleMode && r.Type != store.RecordTx && r.Scheme == "",
+		}
+		if r.Type == store.RecordTx {
+			txNonce += 1
+		}
+	}
+	signParallel(key, jobs, c.workers)
 
 	var signedRecords []store.Record
-	for _, r := range records {
-		// sign here
-		r.Salt = fmt.Sprintf("%d", keyMd.Nonce)
-		// add random salt if needed
-		sign, err := key.Sign(r.Salt + r.Msg)
-		if err != nil {
-			// ignore error continue signing
-			log.Printf("WARN: failed to sign message with key: %v, error: %v", key.KeyId, err)
+	var merkleIdx []int
+	for i := range jobs {
+		job := &jobs[i]
+		// failed record doesn't consume a nonce, records after it
+		// are signed again with the next nonce to keep nonces contiguous
+		if job.err == nil && (job.nonce != keyMd.Nonce || job.txNonce != keyMd.TxNonce) {
+			job.nonce = keyMd.Nonce
+			job.txNonce = keyMd.TxNonce
+			job.sign(key, records[i])
+		}
+		r := job.record
+		if job.err != nil {
+			// continue signing, record is retried until it runs out of attempts
+			log.Printf("WARN: failed to sign record: %v with key: %v, error: %v", r.Id, key.KeyId, job.err)
+			result.failed += 1
+			err = c.signFailed(ctx, r, job.err)
+			if err != nil {
+				return nil, err
+			}
 			continue
 		}
-		r.Signature = sign
+		if job.merkle {
+			merkleIdx = append(merkleIdx, len(signedRecords))
+		}
 		r.KeyId = key.KeyId
+		r.Algorithm = string(key.Algorithm)
+		r.Nonce = keyMd.Nonce
 		keyMd.Nonce += 1
+		if r.Type == store.RecordTx {
+			r.TxNonce = keyMd.TxNonce
+			keyMd.TxNonce += 1
+		}
 
 		signedRecords = append(signedRecords, r)
 	}
 
-	err = c.store.WriteBatch(ctx, signedRecords)
+	var merkleBatch *store.MerkleBatch
+	if len(merkleIdx) > 0 {
+		merkleBatch, err = signMerkleBatch(key, batchId, signedRecords, merkleIdx)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// make sure the shard is still assigned to this signer,
+	// otherwise another signer may sign the same records
+	err = c.assigner.Fence(ctx, batchId)
 	if err != nil {
-		log.Printf("ERROR WriteBatch failed, signerId: %v, error: %v", c.signerId, err)
-		return err
+		log.Printf("ERROR shard is no longer assigned, batchId: %v, error: %v", batchId, err)
+		return nil, err
+	}
+
+	// all records of batch may fail, failed attempts are still saved
+	if len(signedRecords) > 0 {
+		// reserve nonces of signed records, reservation fails
+		// if another writer advanced key nonce since it was read
+		err = c.store.ReserveNonceRange(ctx, keyId, startNonce, keyMd.Nonce-startNonce,
+			startTxNonce, keyMd.TxNonce-startTxNonce)
+		if err != nil {
+			log.Printf("ERROR ReserveNonceRange failed, batchId: %v, error: %v", batchId, err)
+			return nil, err
+		}
+		err = c.writeSigned(ctx, batchId, merkleBatch, signedRecords)
+		if err != nil {
+			// without transaction part of the batch may be written,
+			// nonces of records which were not written are released
+			if !config.GetEnableMongoXact() {
+				if err := c.recoverNonceRange(ctx, keyId); err != nil {
+					log.Printf("ERROR failed to recover nonce range of key: %v, error: %v", keyId, err)
+				}
+			}
+			return nil, err
+		}
+		// commit reserved nonce range once records are written
+		log.Printf("INFO: end with nonce: %v, tx nonce: %v, keyId: %v, batchId: %v",
+			keyMd.Nonce, keyMd.TxNonce, keyId, batchId)
+		err = c.store.CommitNonceRange(ctx, keyId, startNonce, keyMd.Nonce, keyMd.Nonce, keyMd.TxNonce)
+		if err != nil {
+			return nil, err
+		}
 	}
 	log.Printf("INFO: signed %v records, batchId %v, keyId: %v", len(signedRecords), batchId, keyId)
 
-	// write new key metadata, e.g. nonce
-	log.Printf("INFO: end with nonce: %v, keyId: %v, batchId: %v", keyMd.Nonce, keyId, batchId)
-	err = c.store.WriteSigningKeyMetadata(ctx, keyMd)
-	return err
+	// chain the batch into audit log in the same transaction
+	if config.GetAuditLog() && len(signedRecords) > 0 {
+		err = c.auditBatch(ctx, batchId, keyId, startNonce, keyMd.Nonce-1, merkleBatch, signedRecords)
+		if err != nil && config.GetEnableMongoXact() {
+			log.Printf("ERROR audit log append failed, batchId: %v, error: %v", batchId, err)
+			return nil, err
+		}
+		if err != nil {
+			// without transaction the batch is already committed
+			// and can't be rolled back, it is missing in audit log
+			log.Printf("ERROR audit log append failed, batch is committed, batchId: %v, keyId: %v, nonces: [%v, %v], error: %v",
+				batchId, keyId, startNonce, keyMd.Nonce-1, err)
+			metrics.AuditFailures.Inc()
+		}
+	}
+
+	// persist key rotation index along with nonce
+	idx := keyIndex{batchId, key.Algorithm}
+	err = c.store.WriteKeyIndex(ctx, batchId, string(idx.algorithm), c.keyIdx[idx])
+	if err != nil {
+		return nil, err
+	}
+	result.signed = len(signedRecords)
+	result.nonce = keyMd.Nonce
+	return result, nil
+}
+
+// writeSigned writes merkle batch and signed records
+func (c *BatchSigner) writeSigned(ctx context.Context, batchId int,
+	merkleBatch *store.MerkleBatch, signedRecords []store.Record) error {
+	if merkleBatch != nil {
+		err := c.store.WriteMerkleBatch(ctx, merkleBatch)
+		if err != nil {
+			log.Printf("ERROR WriteMerkleBatch failed, batchId: %v, error: %v", batchId, err)
+			return err
+		}
+	}
+	err := c.store.WriteBatch(ctx, signedRecords)
+	if err != nil {
+		log.Printf("ERROR WriteBatch failed, batchId: %v, error: %v", batchId, err)
+		return err
+	}
+	return nil
+}
+
+// signFailed saves failed sign attempt of record and moves
+// the record to dead letters once it runs out of attempts
+func (c *BatchSigner) signFailed(ctx context.Context, r store.Record, signErr error) error {
+	attempts, err := c.store.WriteSignFailure(ctx, r.Id, signErr.Error())
+	if err != nil {
+		log.Printf("ERROR failed to save sign attempt of record: %v, error: %v", r.Id, err)
+		return err
+	}
+	if attempts < config.GetMaxSignAttempts() {
+		return nil
+	}
+	r.Attempts = attempts
+	r.LastError = signErr.Error()
+	err = c.store.WriteDeadLetter(ctx, r)
+	if err != nil {
+		log.Printf("ERROR failed to move record: %v to dead letters, error: %v", r.Id, err)
+		return err
+	}
+	metrics.DeadLetters.Inc()
+	log.Printf("WARN: record: %v moved to dead letters after %v attempts, error: %v", r.Id, attempts, signErr)
+	return nil
+}
+
+// auditBatch appends signed batch to audit log, merkle batches
+// are identified by their root, other batches get a random id
+func (c *BatchSigner) auditBatch(ctx context.Context, shard int, keyId string,
+	nonceFrom int64, nonceTo int64, merkleBatch *store.MerkleBatch, records []store.Record) error {
+	entry := store.AuditEntry{
+		BatchId:   uuid.NewString(),
+		Shard:     shard,
+		KeyId:     keyId,
+		NonceFrom: nonceFrom,
+		NonceTo:   nonceTo,
+	}
+	if merkleBatch != nil {
+		entry.BatchId = merkleBatch.Id
+	}
+	for _, r := range records {
+		entry.RecordIds = append(entry.RecordIds, r.Id)
+	}
+	if config.GetEnableMongoXact() {
+		return audit.Append(ctx, c.store, entry)
+	}
+	return audit.AppendWithRetry(ctx, c.store, entry)
+}
+
+// signMsg signs salt+msg of record with scheme of record
+// or default scheme, the scheme is stored with signature.
+// Default scheme of non ethereum keys is raw
+func signMsg(key *signer.SigningKey, r *store.Record) error {
+	scheme, err := signer.ParseScheme(r.Scheme)
+	if err != nil {
+		return err
+	}
+	if r.Scheme == "" && key.Algorithm != signer.AlgEcdsaSecp256k1 {
+		scheme = signer.SchemeRaw
+	}
+	r.Signature, err = key.SignScheme(scheme, r.Salt, r.Msg)
+	if err != nil {
+		return err
+	}
+	r.Scheme = string(scheme)
+	return nil
+}
+
+// signMerkleBatch builds merkle tree over records at merkleIdx and signs its root
+// with default scheme, each record gets root signature and its inclusion proof
+func signMerkleBatch(key *signer.SigningKey, shard int, records []store.Record, merkleIdx []int) (*store.MerkleBatch, error) {
+	var leaves [][]byte
+	for _, i := range merkleIdx {
+		r := records[i]
+		leaves = append(leaves, merkle.RecordLeaf(r.Id, r.Salt, r.Msg))
+	}
+	tree, err := merkle.NewTree(leaves)
+	if err != nil {
+		return nil, err
+	}
+	scheme, err := signer.ParseScheme("")
+	if err != nil {
+		return nil, err
+	}
+	if key.Algorithm != signer.AlgEcdsaSecp256k1 {
+		scheme = signer.SchemeRaw
+	}
+	root := hexutil.Encode(tree.Root())
+	sign, err := key.SignScheme(scheme, "", root)
+	if err != nil {
+		return nil, err
+	}
+	for leaf, i := range merkleIdx {
+		records[i].Signature = sign
+		records[i].Scheme = string(scheme)
+		records[i].BatchId = root
+		records[i].Proof = merkle.EncodeProof(tree.Proof(leaf))
+	}
+	log.Printf("INFO: signed merkle batch root: %v, records: %v, keyId: %v", root, len(merkleIdx), key.KeyId)
+	return &store.MerkleBatch{
+		Id:        root,
+		KeyId:     key.KeyId,
+		Algorithm: string(key.Algorithm),
+		Signature: sign,
+		Shard:     shard,
+		Size:      len(merkleIdx),
+		CreatedAt: time.Now(),
+	}, nil
+}
+
+// signTx signs transaction template of record with account nonce,
+// raw transaction is ready to be broadcast
+func signTx(key *signer.SigningKey, r *store.Record, nonce int64) error {
+	tpl, err := signer.ParseTxTemplate(r.Msg)
+	if err != nil {
+		return err
+	}
+	tx, err := key.SignTx(tpl, uint64(nonce))
+	if err != nil {
+		return err
+	}
+	r.RawTx, err = signer.EncodeTx(tx)
+	if err != nil {
+		return err
+	}
+	r.TxHash = tx.Hash().Hex()
+	return nil
 }
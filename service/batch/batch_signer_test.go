@@ -0,0 +1,218 @@
+package batch
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/rovechkin1/message-sign/service/signer"
+	"github.com/rovechkin1/message-sign/service/store"
+)
+
+// number of generated signing keys
+const testKeys = 4
+
+// testKeyStore writes ECDSA keys into keys.csv and loads them with
+// file key store, which keeps parsed keys. Returns hex private keys as well
+func testKeyStore(tb testing.TB) (signer.KeyStore, []string) {
+	s, err := signer.SignerFor(signer.AlgEcdsaSecp256k1)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	var lines, privateKeys []string
+	for i := 0; i < testKeys; i++ {
+		privateKey, err := s.GenerateKey()
+		if err != nil {
+			tb.Fatal(err)
+		}
+		publicKey, err := s.PublicKey(privateKey)
+		if err != nil {
+			tb.Fatal(err)
+		}
+		lines = append(lines, fmt.Sprintf("%s,%s,%s", hexutil.Encode(publicKey),
+			hexutil.Encode(privateKey), signer.AlgEcdsaSecp256k1))
+		privateKeys = append(privateKeys, hex.EncodeToString(privateKey))
+	}
+	keysDir := tb.TempDir()
+	err = os.WriteFile(path.Join(keysDir, "keys.csv"), []byte(strings.Join(lines, "\n")), 0600)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tb.Setenv("BS_KEYS_DIR", keysDir)
+	tb.Setenv("BS_KEY_STORE", "file")
+	tb.Setenv("BS_KEY_RELOAD_SEC", "0")
+	tb.Setenv("BS_TOTAL_SIGNERS", "1")
+	tb.Setenv("BS_MY_POD_NAME", "signer-0")
+	keyStore, err := signer.NewKeyStore()
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return keyStore, privateKeys
+}
+
+// newTestSigner returns signer of a single shard over msgStore and its first key
+func newTestSigner(t *testing.T, msgStore store.MessageStore) (*BatchSigner, string) {
+	keyStore, _ := testKeyStore(t)
+	assigner, err := NewStaticShardAssigner()
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := NewBatchSigner(msgStore, keyStore, assigner)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyIds, err := keyStore.GetKeyIds()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c, keyIds[0]
+}
+
+// insertRecords inserts records with hex ids in argument order
+func insertRecords(t *testing.T, msgStore store.MessageStore, records ...store.Record) {
+	for i := range records {
+		records[i].Id = fmt.Sprintf("%032x", i)
+	}
+	if err := msgStore.InsertRecords(context.Background(), records); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSignRecordsAux(t *testing.T) {
+	ctx := context.Background()
+	msgStore := store.NewMemoryStore()
+	c, keyId := newTestSigner(t, msgStore)
+	insertRecords(t, msgStore, store.Record{Msg: "a"}, store.Record{Msg: "b"}, store.Record{Msg: "c"})
+
+	result, err := c.signRecordsAux(ctx, 0, 1, keyId, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.signed != 3 || result.nonce != 3 {
+		t.Errorf("got signed %v, nonce %v, want 3, 3", result.signed, result.nonce)
+	}
+	nonces := make(map[int64]bool)
+	err = msgStore.ScanSignedRecords(ctx, func(r store.Record) error {
+		nonces[r.Nonce] = true
+		if r.KeyId != keyId || r.Salt != strconv.FormatInt(r.Nonce, 10) {
+			t.Errorf("record %v: got key %v, salt %v, nonce %v", r.Id, r.KeyId, r.Salt, r.Nonce)
+		}
+		if ok, err := verifyRecord(r); !ok {
+			t.Errorf("record %v: signature is not valid, error: %v", r.Id, err)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(nonces) != 3 || !nonces[0] || !nonces[1] || !nonces[2] {
+		t.Errorf("got nonces %v, want 0, 1, 2", nonces)
+	}
+	unsigned, err := msgStore.GetRecordCount(ctx, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if unsigned != 0 {
+		t.Errorf("got %v unsigned records, want 0", unsigned)
+	}
+}
+
+func TestSignRecordsXactRollback(t *testing.T) {
+	t.Setenv("BS_ENABLE_MONGO_XACT", "true")
+	// memory store fails batch after signed records are written
+	t.Setenv("BS_TEST_SIGN_FAILURE_RATE_PCT", "100")
+	ctx := context.Background()
+	msgStore := store.NewMemoryStore()
+	c, keyId := newTestSigner(t, msgStore)
+	insertRecords(t, msgStore, store.Record{Msg: "a"}, store.Record{Msg: "b"})
+
+	if _, err := c.signRecords(ctx, 0, keyId, 100); err == nil {
+		t.Fatal("batch didn't fail")
+	}
+	signed, err := msgStore.GetRecordCount(ctx, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	unsigned, err := msgStore.GetRecordCount(ctx, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if signed != 0 || unsigned != 2 {
+		t.Errorf("got %v signed, %v unsigned records, want 0, 2", signed, unsigned)
+	}
+	if _, err := msgStore.ReadSigningKeyMetadata(ctx, keyId); err != store.ErrNotFound {
+		t.Errorf("got key metadata error %v, want %v", err, store.ErrNotFound)
+	}
+}
+
+// conflictingStore fails audit appends with a conflict, like mongo the
+// conflict aborts transaction and later writes of the transaction fail
+type conflictingStore struct {
+	store.MessageStore
+	conflicts int
+	aborted   bool
+}
+
+func (c *conflictingStore) NewXact(ctx context.Context) (store.Xact, error) {
+	xact, err := c.MessageStore.NewXact(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &conflictingXact{Xact: xact, store: c}, nil
+}
+
+func (c *conflictingStore) WriteAuditEntry(ctx context.Context, entry *store.AuditEntry) error {
+	if c.aborted {
+		return fmt.Errorf("transaction is aborted")
+	}
+	if c.conflicts > 0 {
+		c.conflicts -= 1
+		c.aborted = true
+		return fmt.Errorf("%w: seq %v", store.ErrAuditConflict, entry.Seq)
+	}
+	return c.MessageStore.WriteAuditEntry(ctx, entry)
+}
+
+type conflictingXact struct {
+	store.Xact
+	store *conflictingStore
+}
+
+func (c *conflictingXact) WithTransaction(ctx context.Context, callback func(ctx context.Context) error) error {
+	c.store.aborted = false
+	return c.Xact.WithTransaction(ctx, callback)
+}
+
+func TestSignRecordsXactRetriesAuditConflict(t *testing.T) {
+	t.Setenv("BS_ENABLE_MONGO_XACT", "true")
+	t.Setenv("BS_AUDIT_LOG", "true")
+	ctx := context.Background()
+	msgStore := &conflictingStore{MessageStore: store.NewMemoryStore(), conflicts: 1}
+	c, keyId := newTestSigner(t, msgStore)
+	insertRecords(t, msgStore, store.Record{Msg: "a"}, store.Record{Msg: "b"})
+
+	result, err := c.signRecords(ctx, 0, keyId, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.signed != 2 || result.attempts != 2 {
+		t.Errorf("got signed %v, attempts %v, want 2, 2", result.signed, result.attempts)
+	}
+	var entries []store.AuditEntry
+	err = msgStore.ScanAuditLog(ctx, func(entry store.AuditEntry) error {
+		entries = append(entries, entry)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Seq != 1 || entries[0].NonceFrom != 0 || entries[0].NonceTo != 1 {
+		t.Errorf("got audit log %+v, want a single entry of nonces 0, 1", entries)
+	}
+}
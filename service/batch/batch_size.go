@@ -0,0 +1,93 @@
+package batch
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"github.com/rovechkin1/message-sign/service/config"
+	"github.com/rovechkin1/message-sign/service/metrics"
+)
+
+// batchSizer adjusts batch size at runtime. The size grows additively
+// while full batches commit well within target latency and is halved
+// when a batch fails, its transaction is retried on conflicts or
+// the commit takes longer than target latency
+type batchSizer struct {
+	mu     sync.Mutex
+	size   int
+	min    int
+	max    int
+	target time.Duration
+}
+
+// newBatchSizer starts with batch_size limited by batch_size_min and
+// batch_size_max, min and max default to batch_size which keeps size fixed
+func newBatchSizer() *batchSizer {
+	size := config.GetBatchSize()
+	min := config.GetBatchSizeMin()
+	if min <= 0 {
+		min = size
+	}
+	max := config.GetBatchSizeMax()
+	if max <= 0 {
+		max = size
+	}
+	if max < min {
+		max = min
+	}
+	if size < min {
+		size = min
+	}
+	if size > max {
+		size = max
+	}
+	s := &batchSizer{
+		size:   size,
+		min:    min,
+		max:    max,
+		target: time.Duration(config.GetBatchTargetLatencyMs()) * time.Millisecond,
+	}
+	metrics.BatchSize.Set(float64(size))
+	log.Printf("INFO: batch size: %v, min: %v, max: %v, target latency: %v", size, min, max, s.target)
+	return s
+}
+
+func (s *batchSizer) get() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.size
+}
+
+// update adjusts batch size by outcome of a batch read with limit,
+// result is nil if batch failed
+func (s *batchSizer) update(limit int, result *batchResult, latency time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.min == s.max {
+		return
+	}
+	size := s.size
+	switch {
+	case result == nil, result.attempts > 1, latency > s.target:
+		size = size / 2
+	case result.signed+result.failed >= limit && latency < s.target/2:
+		// batch was limited by its size, grow by 10%
+		step := size / 10
+		if step < 1 {
+			step = 1
+		}
+		size += step
+	}
+	if size < s.min {
+		size = s.min
+	}
+	if size > s.max {
+		size = s.max
+	}
+	if size != s.size {
+		log.Printf("INFO: batch size changed: %v -> %v, latency: %v", s.size, size, latency)
+		s.size = size
+		metrics.BatchSize.Set(float64(size))
+	}
+}
@@ -0,0 +1,76 @@
+package batch
+
+import (
+	"testing"
+	"time"
+)
+
+const testTargetLatency = 100 * time.Millisecond
+
+func newTestBatchSizer(size int, min int, max int) *batchSizer {
+	return &batchSizer{size: size, min: min, max: max, target: testTargetLatency}
+}
+
+func TestBatchSizerShrinks(t *testing.T) {
+	fast := 10 * time.Millisecond
+	full := &batchResult{signed: 100, attempts: 1}
+	for _, tt := range []struct {
+		reason  string
+		result  *batchResult
+		latency time.Duration
+	}{
+		{"failed batch", nil, fast},
+		{"retried transaction", &batchResult{signed: 100, attempts: 2}, fast},
+		{"slow commit", full, 2 * testTargetLatency},
+	} {
+		s := newTestBatchSizer(100, 10, 1000)
+		s.update(100, tt.result, tt.latency)
+		if s.get() != 50 {
+			t.Errorf("%v: got size %v, want 50", tt.reason, s.get())
+		}
+	}
+}
+
+func TestBatchSizerGrows(t *testing.T) {
+	s := newTestBatchSizer(100, 10, 1000)
+	// failed records count towards full batch
+	s.update(100, &batchResult{signed: 90, failed: 10, attempts: 1}, 10*time.Millisecond)
+	if s.get() != 110 {
+		t.Errorf("got size %v, want 110", s.get())
+	}
+	s = newTestBatchSizer(5, 1, 1000)
+	s.update(5, &batchResult{signed: 5, attempts: 1}, 10*time.Millisecond)
+	if s.get() != 6 {
+		t.Errorf("got size %v, want 6", s.get())
+	}
+}
+
+func TestBatchSizerKeepsSize(t *testing.T) {
+	s := newTestBatchSizer(100, 10, 1000)
+	s.update(100, &batchResult{signed: 40, attempts: 1}, 10*time.Millisecond)
+	if s.get() != 100 {
+		t.Errorf("partial batch: got size %v, want 100", s.get())
+	}
+	s.update(100, &batchResult{signed: 100, attempts: 1}, 3*testTargetLatency/4)
+	if s.get() != 100 {
+		t.Errorf("batch close to target latency: got size %v, want 100", s.get())
+	}
+}
+
+func TestBatchSizerLimits(t *testing.T) {
+	s := newTestBatchSizer(15, 10, 1050)
+	s.update(15, nil, 0)
+	if s.get() != 10 {
+		t.Errorf("got size %v, want min 10", s.get())
+	}
+	s = newTestBatchSizer(1000, 10, 1050)
+	s.update(1000, &batchResult{signed: 1000, attempts: 1}, 0)
+	if s.get() != 1050 {
+		t.Errorf("got size %v, want max 1050", s.get())
+	}
+	s = newTestBatchSizer(100, 100, 100)
+	s.update(100, nil, 0)
+	if s.get() != 100 {
+		t.Errorf("got size %v, want fixed 100", s.get())
+	}
+}
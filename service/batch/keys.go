@@ -0,0 +1,163 @@
+package batch
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"reflect"
+	"sort"
+	"time"
+
+	"github.com/rovechkin1/message-sign/service/config"
+	"github.com/rovechkin1/message-sign/service/signer"
+	"github.com/rovechkin1/message-sign/service/store"
+)
+
+// groupKeys groups active keys of key store by algorithm
+func groupKeys(keyStore signer.KeyStore, shardCount int) (map[signer.Algorithm][]string, []signer.Algorithm, error) {
+	keyIds, err := keyStore.GetKeyIds()
+	if err != nil {
+		return nil, nil, err
+	}
+	keys := make(map[signer.Algorithm][]string)
+	for _, keyId := range keyIds {
+		alg, err := keyStore.GetKeyAlgorithm(keyId)
+		if err != nil {
+			return nil, nil, err
+		}
+		keys[alg] = append(keys[alg], keyId)
+	}
+	// key ownership is derived from key order, it must
+	// not depend on the order of key store
+	for _, algKeys := range keys {
+		sort.Strings(algKeys)
+	}
+	if len(keys) == 0 {
+		return nil, nil, fmt.Errorf("ERROR: no signing keys")
+	}
+
+	var algorithms []signer.Algorithm
+	for alg, algKeys := range keys {
+		// number of keys must be more than number of shards
+		// otherwise we can't do signing in parallel
+		// not enough keys for each shard
+		if shardCount > len(algKeys) {
+			return nil, nil, fmt.Errorf("ERROR: not enough %v keys: %v for each shard: %v",
+				alg, len(algKeys), shardCount)
+		}
+		algorithms = append(algorithms, alg)
+	}
+	sort.Slice(algorithms, func(i, j int) bool {
+		return algorithms[i] < algorithms[j]
+	})
+	return keys, algorithms, nil
+}
+
+// syncKeys picks up added and retired keys between batches. Retired keys
+// are never chosen again, so their nonce stays frozen. Key set which
+// doesn't have enough keys for each shard is not applied
+func (c *BatchSigner) syncKeys() {
+	if c.watcher == nil {
+		return
+	}
+drain:
+	for {
+		select {
+		case event := <-c.keyEvents:
+			log.Printf("INFO: key %v: %v, version: %v", event.Type, event.KeyId, event.Version)
+		default:
+			break drain
+		}
+	}
+	version := c.watcher.Version()
+	if version == c.keyVersion {
+		return
+	}
+	keys, algorithms, err := groupKeys(c.keyStore, c.assigner.ShardCount())
+	if err != nil {
+		log.Printf("ERROR: key set version: %v is not applied, keep version: %v, error: %v",
+			version, c.keyVersion, err)
+		return
+	}
+	c.keys = keys
+	c.algorithms = algorithms
+	c.keyVersion = version
+	// batches run between syncs, so no batch signs with retired keys anymore
+	c.watcher.Drained(c.keyEvents, version)
+	log.Printf("INFO: applied key set version: %v, algorithms: %v", version, algorithms)
+}
+
+// ownedKeys returns keys of algorithm owned by shard, key i
+// in sorted order of the algorithm is owned by shard i % shardCount
+func (c *BatchSigner) ownedKeys(idx keyIndex) []string {
+	shardCount := c.assigner.ShardCount()
+	var owned []string
+	for i, keyId := range c.keys[idx.algorithm] {
+		if i%shardCount == idx.shard {
+			owned = append(owned, keyId)
+		}
+	}
+	return owned
+}
+
+// claimKeys claims keys owned by shards in store. Keys claimed by another
+// live shard are excluded from rotation, error wrapping store.ErrKeyConflict
+// is returned if there are any
+func (c *BatchSigner) claimKeys(ctx context.Context, shards []int) error {
+	now := time.Now()
+	ttl := time.Duration(config.GetKeyClaimTtlSec()) * time.Second
+	conflicts := make(map[string]bool)
+	var conflictErr error
+	for _, shard := range shards {
+		for _, alg := range c.algorithms {
+			for _, keyId := range c.ownedKeys(keyIndex{shard, alg}) {
+				err := c.store.ClaimKey(ctx, store.KeyOwner{
+					KeyId:     keyId,
+					Algorithm: string(alg),
+					Shard:     shard,
+					Signer:    config.GetMyPodName(),
+					ExpiresAt: now.Add(ttl),
+				}, now)
+				if errors.Is(err, store.ErrKeyConflict) {
+					log.Printf("ERROR: key is not used by shard: %v, error: %v", shard, err)
+					conflicts[keyId] = true
+					if conflictErr == nil {
+						conflictErr = err
+					}
+					continue
+				}
+				if err != nil {
+					return err
+				}
+			}
+		}
+	}
+	c.conflicts = conflicts
+	c.claimedAt = now
+	c.claimedShards = shards
+	c.claimedVersion = c.keyVersion
+	return conflictErr
+}
+
+// renewKeyClaims claims keys again if assigned shards or key set changed
+// or a third of claim ttl passed since the last claim
+func (c *BatchSigner) renewKeyClaims(ctx context.Context, shards []int) {
+	ttl := time.Duration(config.GetKeyClaimTtlSec()) * time.Second
+	if time.Since(c.claimedAt) < ttl/3 && c.claimedVersion == c.keyVersion &&
+		reflect.DeepEqual(c.claimedShards, shards) {
+		return
+	}
+	moved := !reflect.DeepEqual(c.claimedShards, shards)
+	err := c.claimKeys(ctx, shards)
+	if err != nil && !errors.Is(err, store.ErrKeyConflict) {
+		log.Printf("ERROR: failed to claim keys of shards: %v, error: %v", shards, err)
+		return
+	}
+	// keys of acquired shards may have nonce ranges left by previous owner
+	if moved {
+		if err := c.recoverNonceRanges(ctx, shards); err != nil {
+			log.Printf("ERROR: failed to recover nonce ranges of shards: %v, error: %v", shards, err)
+		}
+	}
+}
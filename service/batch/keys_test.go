@@ -0,0 +1,50 @@
+package batch
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/rovechkin1/message-sign/service/signer"
+)
+
+// algorithmKeyStore knows algorithms of keys only, private keys are never read
+type algorithmKeyStore map[string]signer.Algorithm
+
+func (c algorithmKeyStore) GetKeyById(keyId string) (*signer.SigningKey, error) {
+	return nil, fmt.Errorf("private key of %v is read", keyId)
+}
+
+func (c algorithmKeyStore) GetKeyIds() ([]string, error) {
+	var keyIds []string
+	for keyId := range c {
+		keyIds = append(keyIds, keyId)
+	}
+	return keyIds, nil
+}
+
+func (c algorithmKeyStore) GetKeyAlgorithm(keyId string) (signer.Algorithm, error) {
+	return c[keyId], nil
+}
+
+func TestGroupKeys(t *testing.T) {
+	keyStore := algorithmKeyStore{
+		"d": signer.AlgEcdsaSecp256k1,
+		"b": signer.AlgEd25519,
+		"c": signer.AlgEcdsaSecp256k1,
+		"a": signer.AlgEd25519,
+	}
+	keys, algorithms, err := groupKeys(keyStore, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(algorithms) != "[ecdsa-secp256k1 ed25519]" {
+		t.Errorf("got algorithms %v", algorithms)
+	}
+	if fmt.Sprint(keys[signer.AlgEcdsaSecp256k1]) != "[c d]" || fmt.Sprint(keys[signer.AlgEd25519]) != "[a b]" {
+		t.Errorf("got keys %v", keys)
+	}
+	// every algorithm needs a key per shard
+	if _, _, err := groupKeys(keyStore, 3); err == nil {
+		t.Errorf("keys are grouped for more shards than keys")
+	}
+}
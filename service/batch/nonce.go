@@ -0,0 +1,76 @@
+package batch
+
+import (
+	"context"
+	"log"
+
+	"github.com/rovechkin1/message-sign/service/config"
+	"github.com/rovechkin1/message-sign/service/store"
+)
+
+// recoverNonceRanges reconciles pending nonce reservations of keys owned by
+// shards. Without transactions a signer may crash after reserving nonces
+// but before the reservation is committed
+func (c *BatchSigner) recoverNonceRanges(ctx context.Context, shards []int) error {
+	if config.GetEnableMongoXact() {
+		// reservation is committed in the same transaction as the batch
+		return nil
+	}
+	for _, shard := range shards {
+		for _, alg := range c.algorithms {
+			for _, keyId := range c.ownedKeys(keyIndex{shard, alg}) {
+				if c.conflicts[keyId] {
+					continue
+				}
+				if err := c.recoverNonceRange(ctx, keyId); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// recoverNonceRange reconciles pending nonce reservation of key against
+// signed records. Key nonce is set after the last written nonce of the range
+// and unsigned copies of written records are removed, so they are not signed twice
+func (c *BatchSigner) recoverNonceRange(ctx context.Context, keyId string) error {
+	keyMd, err := c.store.ReadSigningKeyMetadata(ctx, keyId)
+	if err == store.ErrNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if !keyMd.Reserved() {
+		return nil
+	}
+	records, err := c.store.ReadSignedRange(ctx, keyId, keyMd.ReservedFrom, keyMd.ReservedTo)
+	if err != nil {
+		return err
+	}
+	nonce := keyMd.ReservedFrom
+	txNonce := keyMd.ReservedTxFrom
+	var ids []string
+	for _, r := range records {
+		ids = append(ids, r.Id)
+		if r.Nonce >= nonce {
+			nonce = r.Nonce + 1
+		}
+		if r.Type == store.RecordTx && r.TxNonce >= txNonce {
+			txNonce = r.TxNonce + 1
+		}
+	}
+	if len(ids) > 0 {
+		if err := c.store.DeleteUnsigned(ctx, ids); err != nil {
+			return err
+		}
+	}
+	if int(nonce-keyMd.ReservedFrom) != len(records) {
+		log.Printf("WARN: nonce range of key: %v has gaps, written: %v of [%v, %v)",
+			keyId, len(records), keyMd.ReservedFrom, nonce)
+	}
+	log.Printf("INFO: recovered nonce range [%v, %v) of key: %v, written: %v, nonce: %v, tx nonce: %v",
+		keyMd.ReservedFrom, keyMd.ReservedTo, keyId, len(records), nonce, txNonce)
+	return c.store.CommitNonceRange(ctx, keyId, keyMd.ReservedFrom, keyMd.ReservedTo, nonce, txNonce)
+}
@@ -0,0 +1,359 @@
+package batch
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+
+	"github.com/rovechkin1/message-sign/service/store"
+)
+
+// NonceGap is a range [from, to) of key nonces without signed records
+type NonceGap struct {
+	From int64 `json:"from"`
+	To   int64 `json:"to"`
+}
+
+// NonceDuplicate is a nonce of key used by several signed records
+type NonceDuplicate struct {
+	Nonce     int64    `json:"nonce"`
+	RecordIds []string `json:"record_ids"`
+}
+
+// KeyNonceReport is a result of nonce check of a key
+type KeyNonceReport struct {
+	KeyId string `json:"key"`
+	// nonce of key in signingkeys, it is the next nonce to use
+	Nonce int64 `json:"nonce"`
+	// next account nonce of transactions of key
+	TxNonce    int64            `json:"tx_nonce"`
+	Records    int              `json:"records"`
+	Gaps       []NonceGap       `json:"gaps,omitempty"`
+	Duplicates []NonceDuplicate `json:"duplicates,omitempty"`
+	// records with nonce at or after key nonce, the key would use it again
+	Ahead []string `json:"ahead,omitempty"`
+	// records which salt is not their nonce
+	Invalid []string `json:"invalid,omitempty"`
+	// records which are signed again by repair,
+	// repair rolls key nonce back to repair_from
+	AffectedIds []string `json:"affected_ids,omitempty"`
+	RepairFrom  *int64   `json:"repair_from,omitempty"`
+	// tx nonce is rolled back to repair_tx_from if affected records
+	// include transactions
+	RepairTxFrom *int64 `json:"repair_tx_from,omitempty"`
+	Repaired     bool   `json:"repaired,omitempty"`
+	// reason why repair of the key is skipped or failed
+	Error string `json:"error,omitempty"`
+}
+
+// NonceReport is a result of nonce continuity check of signed records
+type NonceReport struct {
+	Checked     int  `json:"checked"`
+	KeysChecked int  `json:"keys_checked"`
+	Repair      bool `json:"repair"`
+	// keys with gaps, duplicates or invalid records
+	Keys []KeyNonceReport `json:"keys"`
+}
+
+// signedNonce is a nonce of signed record
+type signedNonce struct {
+	id    string
+	nonce int64
+	// tx is true for transaction records, txNonce is their account nonce
+	tx      bool
+	txNonce int64
+	// sent transaction can't be signed again with another nonce
+	sent bool
+}
+
+// CheckNonces scans signed records grouped by key and checks that salts of
+// each key form a contiguous sequence from 0 to key nonce. Key nonces are read
+// before the scan, so records of batches committed during the scan are ahead
+// of key nonce. In repair mode keys are locked before the scan, records
+// starting from the first gap or duplicate are moved back to unsigned records
+// and key nonce is rolled back, so the records are signed again with
+// contiguous nonces
+func CheckNonces(ctx context.Context, msgStore store.MessageStore, repair bool) (*NonceReport, error) {
+	report := &NonceReport{Repair: repair, Keys: []KeyNonceReport{}}
+	metadata, err := msgStore.ListSigningKeyMetadata(ctx)
+	if err != nil {
+		return nil, err
+	}
+	keyNonces := make(map[string]int64)
+	keyTxNonces := make(map[string]int64)
+	for _, md := range metadata {
+		keyNonces[md.Id] = md.Nonce
+		keyTxNonces[md.Id] = md.TxNonce
+	}
+	var locked map[string]store.SigningKeyMetadata
+	var lockErrs map[string]string
+	if repair {
+		locked, lockErrs = lockKeys(ctx, msgStore, metadata)
+		// keys which are not repaired are unlocked with their nonces
+		defer func() {
+			for _, md := range locked {
+				if err := unlockKey(ctx, msgStore, md, md.Nonce, md.TxNonce); err != nil {
+					log.Printf("ERROR: failed to unlock key: %v, error: %v", md.Id, err)
+				}
+			}
+		}()
+	}
+
+	nonces := make(map[string][]signedNonce)
+	invalid := make(map[string][]signedNonce)
+	err = msgStore.ScanSignedRecords(ctx, func(r store.Record) error {
+		report.Checked += 1
+		n := signedNonce{
+			id:      r.Id,
+			nonce:   r.Nonce,
+			tx:      r.Type == store.RecordTx,
+			txNonce: r.TxNonce,
+			sent:    r.Type == store.RecordTx && r.TxStatus != store.TxNotSent,
+		}
+		if salt, err := strconv.ParseInt(r.Salt, 10, 64); err != nil || salt != r.Nonce {
+			invalid[r.KeyId] = append(invalid[r.KeyId], n)
+			return nil
+		}
+		nonces[r.KeyId] = append(nonces[r.KeyId], n)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	keyIds := make(map[string]bool)
+	for keyId := range keyNonces {
+		keyIds[keyId] = true
+	}
+	for keyId := range nonces {
+		keyIds[keyId] = true
+	}
+	for keyId := range invalid {
+		keyIds[keyId] = true
+	}
+	var sorted []string
+	for keyId := range keyIds {
+		sorted = append(sorted, keyId)
+	}
+	sort.Strings(sorted)
+
+	for _, keyId := range sorted {
+		report.KeysChecked += 1
+		keyReport, unsafe := checkKeyNonces(keyId, keyNonces[keyId], keyTxNonces[keyId],
+			nonces[keyId], invalid[keyId])
+		if keyReport == nil {
+			continue
+		}
+		if repair {
+			md, ok := locked[keyId]
+			switch {
+			case !ok && lockErrs[keyId] != "":
+				keyReport.Error = lockErrs[keyId]
+			case !ok:
+				keyReport.Error = "key has no metadata"
+			case unsafe != "":
+				keyReport.Error = unsafe
+			default:
+				// repair unlocks the key
+				delete(locked, keyId)
+				if err := repairKeyNonces(ctx, msgStore, md, keyReport); err != nil {
+					log.Printf("ERROR: failed to repair nonces of key: %v, error: %v", keyId, err)
+					keyReport.Error = err.Error()
+				} else {
+					keyReport.Repaired = true
+				}
+			}
+		}
+		report.Keys = append(report.Keys, *keyReport)
+	}
+	return report, nil
+}
+
+// lockKeys locks keys by reserving their next nonce, batches of a locked key
+// fail on nonce conflict until the key is unlocked. Returns metadata of
+// locked keys and reasons why other keys are not locked
+func lockKeys(ctx context.Context, msgStore store.MessageStore,
+	metadata []store.SigningKeyMetadata) (map[string]store.SigningKeyMetadata, map[string]string) {
+	locked := make(map[string]store.SigningKeyMetadata)
+	lockErrs := make(map[string]string)
+	for _, md := range metadata {
+		if md.Reserved() {
+			lockErrs[md.Id] = fmt.Sprintf("nonce range [%v, %v) is not committed", md.ReservedFrom, md.ReservedTo)
+			continue
+		}
+		err := msgStore.ReserveNonceRange(ctx, md.Id, md.Nonce, 1, md.TxNonce, 0)
+		if err != nil {
+			log.Printf("ERROR: failed to lock key: %v, error: %v", md.Id, err)
+			lockErrs[md.Id] = err.Error()
+			continue
+		}
+		locked[md.Id] = md
+	}
+	return locked, lockErrs
+}
+
+// unlockKey commits lock reservation of key with nonce and txNonce
+func unlockKey(ctx context.Context, msgStore store.MessageStore, md store.SigningKeyMetadata,
+	nonce int64, txNonce int64) error {
+	return msgStore.CommitNonceRange(ctx, md.Id, md.Nonce, md.Nonce+1, nonce, txNonce)
+}
+
+// checkLocked checks that key is still locked by repair, the lock may be
+// committed by a signer which recovers nonce ranges of its keys
+func checkLocked(ctx context.Context, msgStore store.MessageStore, md store.SigningKeyMetadata) error {
+	cur, err := msgStore.ReadSigningKeyMetadata(ctx, md.Id)
+	if err != nil {
+		return err
+	}
+	if cur.ReservedFrom != md.Nonce || cur.ReservedTo != md.Nonce+1 {
+		return fmt.Errorf("%w: %v, key is no longer locked", store.ErrNonceConflict, md.Id)
+	}
+	return nil
+}
+
+// checkKeyNonces checks nonces of signed records of key, returns nil if
+// nonces are contiguous, unsafe is the reason why the key can't be repaired
+func checkKeyNonces(keyId string, keyNonce int64, keyTxNonce int64, nonces []signedNonce,
+	invalid []signedNonce) (report *KeyNonceReport, unsafe string) {
+	sort.Slice(nonces, func(i, j int) bool {
+		if nonces[i].nonce != nonces[j].nonce {
+			return nonces[i].nonce < nonces[j].nonce
+		}
+		return nonces[i].id < nonces[j].id
+	})
+	report = &KeyNonceReport{KeyId: keyId, Nonce: keyNonce, TxNonce: keyTxNonce,
+		Records: len(nonces) + len(invalid)}
+	// records after repairFrom are signed again
+	repairFrom := keyNonce
+	// record signed twice is signed again once from its first copy
+	copies := make(map[string]int)
+	for _, n := range nonces {
+		copies[n.id] += 1
+	}
+	for _, n := range invalid {
+		copies[n.id] += 1
+	}
+	next := int64(0)
+	for i := 0; i < len(nonces); {
+		n := nonces[i]
+		j := i
+		var ids []string
+		for ; j < len(nonces) && nonces[j].nonce == n.nonce; j++ {
+			ids = append(ids, nonces[j].id)
+			if copies[nonces[j].id] > 1 && n.nonce < repairFrom {
+				repairFrom = n.nonce
+			}
+		}
+		i = j
+		if n.nonce >= keyNonce {
+			report.Ahead = append(report.Ahead, ids...)
+			continue
+		}
+		if n.nonce > next {
+			report.Gaps = append(report.Gaps, NonceGap{next, n.nonce})
+			if next < repairFrom {
+				repairFrom = next
+			}
+		}
+		if len(ids) > 1 {
+			report.Duplicates = append(report.Duplicates, NonceDuplicate{n.nonce, ids})
+			if n.nonce < repairFrom {
+				repairFrom = n.nonce
+			}
+		}
+		next = n.nonce + 1
+	}
+	if next < keyNonce {
+		report.Gaps = append(report.Gaps, NonceGap{next, keyNonce})
+		if next < repairFrom {
+			repairFrom = next
+		}
+	}
+	for _, n := range invalid {
+		report.Invalid = append(report.Invalid, n.id)
+	}
+	if len(report.Gaps) == 0 && len(report.Duplicates) == 0 &&
+		len(report.Ahead) == 0 && len(report.Invalid) == 0 {
+		return nil, ""
+	}
+
+	affected := make(map[string]bool)
+	sent := false
+	for _, n := range nonces {
+		if n.nonce >= repairFrom {
+			affected[n.id] = true
+			sent = sent || n.sent
+		}
+	}
+	for _, n := range invalid {
+		affected[n.id] = true
+		sent = sent || n.sent
+	}
+	for id := range affected {
+		report.AffectedIds = append(report.AffectedIds, id)
+	}
+	sort.Strings(report.AffectedIds)
+	report.RepairFrom = &repairFrom
+	if sent {
+		return report, "affected records include broadcast transactions"
+	}
+
+	// transactions which are signed again get tx nonces from the first
+	// affected one, transactions which are kept must be before it
+	repairTxFrom := keyTxNonce
+	for _, group := range [][]signedNonce{nonces, invalid} {
+		for _, n := range group {
+			if n.tx && affected[n.id] && n.txNonce < repairTxFrom {
+				repairTxFrom = n.txNonce
+			}
+		}
+	}
+	for _, n := range nonces {
+		if n.tx && !affected[n.id] && n.txNonce >= repairTxFrom {
+			return report, "affected transactions are followed by kept transactions"
+		}
+	}
+	if repairTxFrom != keyTxNonce {
+		report.RepairTxFrom = &repairTxFrom
+	}
+	return report, ""
+}
+
+// repairKeyNonces moves affected records of locked key back to unsigned
+// records, rolls key nonce back and unlocks the key
+func repairKeyNonces(ctx context.Context, msgStore store.MessageStore, md store.SigningKeyMetadata,
+	report *KeyNonceReport) error {
+	if err := checkLocked(ctx, msgStore, md); err != nil {
+		return err
+	}
+	nonce := *report.RepairFrom
+	txNonce := md.TxNonce
+	if report.RepairTxFrom != nil {
+		txNonce = *report.RepairTxFrom
+	}
+	var unsignErr error
+	for _, id := range report.AffectedIds {
+		unsignErr = msgStore.UnsignRecord(ctx, id)
+		if unsignErr == store.ErrNotFound {
+			unsignErr = nil
+			continue
+		}
+		if unsignErr != nil {
+			// keep key nonce, records which were moved are signed with new nonces
+			nonce = md.Nonce
+			txNonce = md.TxNonce
+			break
+		}
+	}
+	if err := checkLocked(ctx, msgStore, md); err != nil {
+		return err
+	}
+	log.Printf("INFO: repair nonces of key: %v, records: %v, nonce: %v -> %v, tx nonce: %v -> %v",
+		report.KeyId, len(report.AffectedIds), md.Nonce, nonce, md.TxNonce, txNonce)
+	if err := unlockKey(ctx, msgStore, md, nonce, txNonce); err != nil {
+		return err
+	}
+	return unsignErr
+}
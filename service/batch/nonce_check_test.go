@@ -0,0 +1,156 @@
+package batch
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"testing"
+
+	"github.com/rovechkin1/message-sign/service/store"
+)
+
+func TestCheckKeyNoncesContiguous(t *testing.T) {
+	nonces := []signedNonce{{id: "c", nonce: 2}, {id: "a", nonce: 0}, {id: "b", nonce: 1}}
+	if report, _ := checkKeyNonces("key", 3, 0, nonces, nil); report != nil {
+		t.Errorf("got report %+v, want nil", *report)
+	}
+}
+
+func TestCheckKeyNoncesGaps(t *testing.T) {
+	nonces := []signedNonce{{id: "a", nonce: 0}, {id: "c", nonce: 2}, {id: "d", nonce: 3}}
+	report, unsafe := checkKeyNonces("key", 6, 0, nonces, nil)
+	if report == nil || unsafe != "" {
+		t.Fatalf("got report %+v, unsafe %q", report, unsafe)
+	}
+	// records after the first gap are signed again
+	if fmt.Sprint(report.Gaps) != "[{1 2} {4 6}]" || *report.RepairFrom != 1 ||
+		fmt.Sprint(report.AffectedIds) != "[c d]" {
+		t.Errorf("got gaps %v, repair from %v, affected %v", report.Gaps, *report.RepairFrom, report.AffectedIds)
+	}
+}
+
+func TestCheckKeyNoncesDuplicate(t *testing.T) {
+	nonces := []signedNonce{{id: "a", nonce: 0}, {id: "b", nonce: 1}, {id: "c", nonce: 1}, {id: "d", nonce: 2}}
+	report, _ := checkKeyNonces("key", 3, 0, nonces, nil)
+	if report == nil {
+		t.Fatal("got nil report")
+	}
+	if fmt.Sprint(report.Duplicates) != "[{1 [b c]}]" || *report.RepairFrom != 1 ||
+		fmt.Sprint(report.AffectedIds) != "[b c d]" {
+		t.Errorf("got duplicates %v, repair from %v, affected %v",
+			report.Duplicates, *report.RepairFrom, report.AffectedIds)
+	}
+}
+
+func TestCheckKeyNoncesAheadAndInvalid(t *testing.T) {
+	nonces := []signedNonce{{id: "a", nonce: 0}, {id: "b", nonce: 1}, {id: "c", nonce: 3}}
+	invalid := []signedNonce{{id: "x", nonce: 1}}
+	report, _ := checkKeyNonces("key", 2, 0, nonces, invalid)
+	if report == nil {
+		t.Fatal("got nil report")
+	}
+	// key nonce is kept, records ahead of it and invalid ones are signed again
+	if fmt.Sprint(report.Ahead) != "[c]" || fmt.Sprint(report.Invalid) != "[x]" ||
+		*report.RepairFrom != 2 || fmt.Sprint(report.AffectedIds) != "[c x]" {
+		t.Errorf("got ahead %v, invalid %v, repair from %v, affected %v",
+			report.Ahead, report.Invalid, *report.RepairFrom, report.AffectedIds)
+	}
+}
+
+func TestCheckKeyNoncesTransactions(t *testing.T) {
+	nonces := []signedNonce{
+		{id: "a", nonce: 0, tx: true, txNonce: 0},
+		{id: "b", nonce: 1},
+		{id: "d", nonce: 3, tx: true, txNonce: 1},
+	}
+	report, unsafe := checkKeyNonces("key", 4, 2, nonces, nil)
+	if report == nil || unsafe != "" {
+		t.Fatalf("got report %+v, unsafe %q", report, unsafe)
+	}
+	if report.RepairTxFrom == nil || *report.RepairTxFrom != 1 {
+		t.Errorf("got repair tx from %v, want 1", report.RepairTxFrom)
+	}
+
+	// broadcast transaction can't be signed again
+	nonces[2].sent = true
+	if _, unsafe := checkKeyNonces("key", 4, 2, nonces, nil); unsafe == "" {
+		t.Errorf("repair of broadcast transaction is not unsafe")
+	}
+
+	// kept transaction has tx nonce after the affected one
+	nonces = []signedNonce{
+		{id: "a", nonce: 0, tx: true, txNonce: 1},
+		{id: "c", nonce: 2, tx: true, txNonce: 0},
+	}
+	if _, unsafe := checkKeyNonces("key", 3, 2, nonces, nil); unsafe == "" {
+		t.Errorf("repair before kept transaction is not unsafe")
+	}
+}
+
+// writeSigned writes signed records of key with nonces
+func writeSigned(t *testing.T, msgStore store.MessageStore, md store.SigningKeyMetadata, nonces ...int64) {
+	ctx := context.Background()
+	if err := msgStore.WriteSigningKeyMetadata(ctx, &md); err != nil {
+		t.Fatal(err)
+	}
+	var records []store.Record
+	for i, nonce := range nonces {
+		records = append(records, store.Record{Id: fmt.Sprintf("%032x", i), KeyId: md.Id,
+			Salt: strconv.FormatInt(nonce, 10), Nonce: nonce})
+	}
+	if err := msgStore.WriteBatch(ctx, records); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCheckNoncesRepair(t *testing.T) {
+	ctx := context.Background()
+	msgStore := store.NewMemoryStore()
+	writeSigned(t, msgStore, store.SigningKeyMetadata{Id: "key", Nonce: 5}, 0, 1, 3, 4)
+
+	report, err := CheckNonces(ctx, msgStore, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Keys) != 1 || !report.Keys[0].Repaired {
+		t.Fatalf("got report %+v, want repaired key", report.Keys)
+	}
+	md, err := msgStore.ReadSigningKeyMetadata(ctx, "key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// key is unlocked with nonce rolled back to the gap
+	if md.Nonce != 2 || md.Reserved() {
+		t.Errorf("got nonce %v, reserved %v, want 2, false", md.Nonce, md.Reserved())
+	}
+	unsigned, err := msgStore.GetRecordCount(ctx, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if unsigned != 2 {
+		t.Errorf("got %v unsigned records, want 2", unsigned)
+	}
+}
+
+func TestCheckNoncesSkipsReservedKey(t *testing.T) {
+	ctx := context.Background()
+	msgStore := store.NewMemoryStore()
+	md := store.SigningKeyMetadata{Id: "key", Nonce: 5, ReservedFrom: 5, ReservedTo: 6}
+	writeSigned(t, msgStore, md, 0, 1, 3, 4)
+
+	report, err := CheckNonces(ctx, msgStore, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Keys) != 1 || report.Keys[0].Repaired || report.Keys[0].Error == "" {
+		t.Fatalf("got report %+v, want skipped key", report.Keys)
+	}
+	// reservation of the signer is kept
+	cur, err := msgStore.ReadSigningKeyMetadata(ctx, "key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *cur != md {
+		t.Errorf("got %+v, want %+v", *cur, md)
+	}
+}
@@ -0,0 +1,92 @@
+package batch
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/rovechkin1/message-sign/service/store"
+)
+
+func TestRecoverNonceRange(t *testing.T) {
+	ctx := context.Background()
+	msgStore := store.NewMemoryStore()
+	insertRecords(t, msgStore, store.Record{Msg: "a"}, store.Record{Msg: "b"}, store.Record{Msg: "c"})
+	// signer reserved nonces [5, 8) and tx nonces [2, 4) and
+	// crashed after writing two records, one of them a transaction
+	err := msgStore.WriteSigningKeyMetadata(ctx, &store.SigningKeyMetadata{Id: "key", Nonce: 5, TxNonce: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := msgStore.ReserveNonceRange(ctx, "key", 5, 3, 2, 2); err != nil {
+		t.Fatal(err)
+	}
+	written := []store.Record{
+		{Id: "00000000000000000000000000000000", KeyId: "key", Nonce: 5},
+		{Id: "00000000000000000000000000000001", KeyId: "key", Nonce: 6, Type: store.RecordTx, TxNonce: 2},
+	}
+	// failed write keeps unsigned copies of written records
+	t.Setenv("BS_TEST_SIGN_FAILURE_RATE_PCT", "100")
+	if err := msgStore.WriteBatch(ctx, written); err == nil {
+		t.Fatal("batch write didn't fail")
+	}
+
+	c := &BatchSigner{store: msgStore}
+	if err := c.recoverNonceRange(ctx, "key"); err != nil {
+		t.Fatal(err)
+	}
+	md, err := msgStore.ReadSigningKeyMetadata(ctx, "key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (store.SigningKeyMetadata{Id: "key", Nonce: 7, TxNonce: 3}); *md != want {
+		t.Errorf("got %+v, want %+v", *md, want)
+	}
+	unsigned, err := msgStore.GetRecordCount(ctx, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if unsigned != 1 {
+		t.Errorf("got %v unsigned records, want 1", unsigned)
+	}
+}
+
+func TestSignRecordsAuxRecoversFailedWrite(t *testing.T) {
+	t.Setenv("BS_TEST_SIGN_FAILURE_RATE_PCT", "100")
+	ctx := context.Background()
+	msgStore := store.NewMemoryStore()
+	c, keyId := newTestSigner(t, msgStore)
+	insertRecords(t, msgStore, store.Record{Msg: "a"}, store.Record{Msg: "b"})
+
+	if _, err := c.signRecordsAux(ctx, 0, 1, keyId, 100); err == nil {
+		t.Fatal("batch didn't fail")
+	}
+	// without transaction written records are kept and their nonces committed
+	md, err := msgStore.ReadSigningKeyMetadata(ctx, keyId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if md.Nonce != 2 || md.Reserved() {
+		t.Errorf("got nonce %v, reserved %v, want 2, false", md.Nonce, md.Reserved())
+	}
+	unsigned, err := msgStore.GetRecordCount(ctx, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if unsigned != 0 {
+		t.Errorf("got %v unsigned records, want 0", unsigned)
+	}
+}
+
+func TestSignRecordsAuxPendingReservation(t *testing.T) {
+	ctx := context.Background()
+	msgStore := store.NewMemoryStore()
+	c, keyId := newTestSigner(t, msgStore)
+	insertRecords(t, msgStore, store.Record{Msg: "a"})
+	if err := msgStore.ReserveNonceRange(ctx, keyId, 0, 4, 0, 0); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.signRecordsAux(ctx, 0, 1, keyId, 100); !errors.Is(err, store.ErrNonceConflict) {
+		t.Errorf("got error %v, want %v", err, store.ErrNonceConflict)
+	}
+}
@@ -0,0 +1,73 @@
+package batch
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/rovechkin1/message-sign/service/config"
+	"github.com/rovechkin1/message-sign/service/metrics"
+	"github.com/rovechkin1/message-sign/service/store"
+)
+
+// sweepLimit is max number of records checked by a single sweep
+const sweepLimit = 1000
+
+// StartQuarantineSweeper periodically moves unsigned records
+// with invalid ids to quarantine until ctx is done
+func StartQuarantineSweeper(ctx context.Context, msgStore store.MessageStore) {
+	interval := time.Duration(config.GetQuarantineSweepSec()) * time.Second
+	if interval <= 0 {
+		log.Printf("INFO: quarantine sweep is disabled")
+		return
+	}
+	go func() {
+		for {
+			n, err := msgStore.SweepRecords(ctx, sweepLimit)
+			if err != nil {
+				log.Printf("ERROR: quarantine sweep failed, error: %v", err)
+			} else if n > 0 {
+				metrics.RecordsQuarantined.Add(float64(n))
+				log.Printf("WARN: quarantined %v records with invalid ids", n)
+			}
+			if ctx.Err() != nil {
+				return
+			}
+			// sweep again right away if there are more records to check
+			if err == nil && n >= sweepLimit {
+				continue
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(interval):
+			}
+		}
+	}()
+}
+
+// QuarantineResponse is a record quarantined because of invalid id
+type QuarantineResponse struct {
+	Id            string    `json:"id"`
+	Msg           string    `json:"msg"`
+	Reason        string    `json:"reason"`
+	QuarantinedAt time.Time `json:"quarantined_at"`
+}
+
+// ListQuarantine returns up to limit quarantined records
+func ListQuarantine(ctx context.Context, msgStore store.MessageStore, limit int) ([]QuarantineResponse, error) {
+	records, err := msgStore.ListQuarantine(ctx, limit)
+	if err != nil {
+		return nil, err
+	}
+	resp := []QuarantineResponse{}
+	for _, r := range records {
+		resp = append(resp, QuarantineResponse{
+			Id:            r.Id,
+			Msg:           r.Msg,
+			Reason:        r.Reason,
+			QuarantinedAt: r.QuarantinedAt,
+		})
+	}
+	return resp, nil
+}
@@ -0,0 +1,33 @@
+package batch
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/rovechkin1/message-sign/service/store"
+)
+
+// fullSweepStore always quarantines a full sweep and cancels ctx on the first one
+type fullSweepStore struct {
+	store.MessageStore
+	cancel context.CancelFunc
+	sweeps int32
+}
+
+func (c *fullSweepStore) SweepRecords(ctx context.Context, limit int) (int, error) {
+	atomic.AddInt32(&c.sweeps, 1)
+	c.cancel()
+	return limit, nil
+}
+
+func TestQuarantineSweeperStopsAfterFullSweep(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	msgStore := &fullSweepStore{MessageStore: store.NewMemoryStore(), cancel: cancel}
+	StartQuarantineSweeper(ctx, msgStore)
+	time.Sleep(50 * time.Millisecond)
+	if sweeps := atomic.LoadInt32(&msgStore.sweeps); sweeps != 1 {
+		t.Errorf("got %v sweeps after ctx is done, want 1", sweeps)
+	}
+}
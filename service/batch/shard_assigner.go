@@ -0,0 +1,78 @@
+package batch
+
+import (
+	"context"
+	"fmt"
+	"github.com/rovechkin1/message-sign/service/config"
+	"log"
+	"strconv"
+	"strings"
+)
+
+// ShardAssigner selects shards which this signer signs
+type ShardAssigner interface {
+	// ShardCount returns total number of shards
+	ShardCount() int
+
+	// Shards returns shards currently assigned to this signer
+	Shards() []int
+
+	// ShardContext returns context for signing a batch of shard,
+	// the context is canceled when the shard is no longer assigned
+	ShardContext(ctx context.Context, shard int) (context.Context, context.CancelFunc, error)
+
+	// Fence checks that the shard is still assigned to this signer,
+	// it is called within signing transaction before the batch is written
+	Fence(ctx context.Context, shard int) error
+}
+
+// staticShardAssigner assigns a single shard based
+// on ordinal of stateful set pod name
+type staticShardAssigner struct {
+	signerId     int
+	totalSigners int
+}
+
+func NewStaticShardAssigner() (ShardAssigner, error) {
+	// total signers (size of stateful set)
+	totalSigners := config.GetTotalSigners()
+
+	// this signer id in format signer-X
+	signerIdString := config.GetMyPodName()
+	idParts := strings.Split(signerIdString, "-")
+	if len(idParts) < 2 {
+		return nil, fmt.Errorf("ERROR: Invalid signer id format: %s, expected signer-0", signerIdString)
+	}
+
+	signerId, err := strconv.ParseInt(idParts[len(idParts)-1], 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("ERROR: Invalid signer id format: %s, expected signer-0", signerIdString)
+	}
+
+	if int(signerId) >= totalSigners {
+		return nil, fmt.Errorf("ERROR: signerId: %v is grater than totalSigners: %v", signerId, totalSigners)
+	}
+	log.Printf("INFO: signerId: %v, totalSigners: %v", signerId, totalSigners)
+
+	return &staticShardAssigner{
+		signerId:     int(signerId),
+		totalSigners: totalSigners,
+	}, nil
+}
+
+func (c *staticShardAssigner) ShardCount() int {
+	return c.totalSigners
+}
+
+func (c *staticShardAssigner) Shards() []int {
+	return []int{c.signerId}
+}
+
+func (c *staticShardAssigner) ShardContext(ctx context.Context, shard int) (context.Context, context.CancelFunc, error) {
+	shardCtx, cancel := context.WithCancel(ctx)
+	return shardCtx, cancel, nil
+}
+
+func (c *staticShardAssigner) Fence(ctx context.Context, shard int) error {
+	return nil
+}
@@ -0,0 +1,155 @@
+package batch
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"runtime"
+	"strconv"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/rovechkin1/message-sign/service/signer"
+	"github.com/rovechkin1/message-sign/service/store"
+)
+
+func benchmarkRecords(n int) []store.Record {
+	records := make([]store.Record, n)
+	for i := range records {
+		records[i] = store.Record{Id: randomHex(16), Msg: randomHex(64)}
+	}
+	return records
+}
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// BenchmarkSignUncachedSerial parses private key for every message
+// and signs messages one by one
+func BenchmarkSignUncachedSerial(b *testing.B) {
+	_, privateKeys := testKeyStore(b)
+	records := benchmarkRecords(b.N)
+	b.ResetTimer()
+	for i, r := range records {
+		key, err := crypto.HexToECDSA(privateKeys[i%len(privateKeys)])
+		if err != nil {
+			b.Fatal(err)
+		}
+		salt := strconv.Itoa(i)
+		if _, err := crypto.Sign(crypto.Keccak256([]byte(salt+r.Msg)), key); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkSignCachedSerial signs messages one by one with parsed key
+func BenchmarkSignCachedSerial(b *testing.B) {
+	keyStore, _ := testKeyStore(b)
+	keyIds, err := keyStore.GetKeyIds()
+	if err != nil {
+		b.Fatal(err)
+	}
+	key, err := keyStore.GetKeyById(keyIds[0])
+	if err != nil {
+		b.Fatal(err)
+	}
+	records := benchmarkRecords(b.N)
+	b.ResetTimer()
+	for i, r := range records {
+		if _, err := key.SignScheme(signer.SchemeRaw, strconv.Itoa(i), r.Msg); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkSignCachedPooled signs messages with parsed key
+// on worker pool of all CPUs
+func BenchmarkSignCachedPooled(b *testing.B) {
+	keyStore, _ := testKeyStore(b)
+	keyIds, err := keyStore.GetKeyIds()
+	if err != nil {
+		b.Fatal(err)
+	}
+	key, err := keyStore.GetKeyById(keyIds[0])
+	if err != nil {
+		b.Fatal(err)
+	}
+	jobs := make([]signJob, b.N)
+	for i, r := range benchmarkRecords(b.N) {
+		jobs[i] = signJob{record: r, nonce: int64(i)}
+	}
+	b.ResetTimer()
+	signParallel(key, jobs, runtime.NumCPU())
+	b.StopTimer()
+	for _, job := range jobs {
+		if job.err != nil {
+			b.Fatal(job.err)
+		}
+	}
+}
+
+// BenchmarkSignBatch signs records of memory store with batch signer
+// and worker pools of 1 goroutine and of all CPUs
+func BenchmarkSignBatch(b *testing.B) {
+	pools := []int{1}
+	if runtime.NumCPU() > 1 {
+		pools = append(pools, runtime.NumCPU())
+	}
+	for _, workers := range pools {
+		b.Run(fmt.Sprintf("workers-%d", workers), func(b *testing.B) {
+			benchmarkSignBatch(b, workers)
+		})
+	}
+}
+
+func benchmarkSignBatch(b *testing.B, workers int) {
+	ctx := context.Background()
+	// signer logs every batch, keep benchmark output readable
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+	keyStore, _ := testKeyStore(b)
+	b.Setenv("BS_SIGN_WORKERS", strconv.Itoa(workers))
+	b.Setenv("BS_BATCH_SIZE", "1000")
+	keyIds, err := keyStore.GetKeyIds()
+	if err != nil {
+		b.Fatal(err)
+	}
+	msgStore := store.NewMemoryStore()
+	if err := msgStore.InsertRecords(ctx, benchmarkRecords(b.N)); err != nil {
+		b.Fatal(err)
+	}
+	assigner, err := NewStaticShardAssigner()
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	batchSigner, err := NewBatchSigner(msgStore, keyStore, assigner)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	b.ResetTimer()
+	// SignBatch doesn't return batch errors, every batch which
+	// doesn't fail signs at least one record
+	unsigned := b.N
+	for i := 0; unsigned > 0 && i < b.N+len(keyIds); i++ {
+		if err := batchSigner.SignBatch(ctx, 0, keyIds[i%len(keyIds)]); err != nil {
+			b.Fatal(err)
+		}
+		unsigned, err = msgStore.GetRecordCount(ctx, false)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.StopTimer()
+	if unsigned > 0 {
+		b.Fatalf("%v records are not signed", unsigned)
+	}
+}
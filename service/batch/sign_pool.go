@@ -0,0 +1,77 @@
+package batch
+
+import (
+	"fmt"
+	"runtime"
+	"sync"
+	"sync/atomic"
+
+	"github.com/rovechkin1/message-sign/service/config"
+	"github.com/rovechkin1/message-sign/service/signer"
+	"github.com/rovechkin1/message-sign/service/store"
+)
+
+// signJob is a record of batch with nonce assigned before signing
+type signJob struct {
+	record store.Record
+	nonce  int64
+	// account nonce of transaction record
+	txNonce int64
+	// merkle record is signed as a part of batch root
+	merkle bool
+	err    error
+}
+
+// sign signs record of job with its nonce, signed record is kept in job
+func (j *signJob) sign(key *signer.SigningKey, r store.Record) {
+	r.Salt = fmt.Sprintf("%d", j.nonce)
+	switch {
+	case r.Type == store.RecordTx:
+		j.err = signTx(key, &r, j.txNonce)
+	case j.merkle:
+		j.err = nil
+	default:
+		j.err = signMsg(key, &r)
+	}
+	j.record = r
+}
+
+// signWorkers returns size of signing worker pool,
+// sign_workers <= 0 uses all CPUs
+func signWorkers() int {
+	workers := config.GetSignWorkers()
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+	}
+	return workers
+}
+
+// signParallel signs records of jobs on up to workers goroutines,
+// jobs are independent since nonces are assigned in advance
+func signParallel(key *signer.SigningKey, jobs []signJob, workers int) {
+	if workers > len(jobs) {
+		workers = len(jobs)
+	}
+	if workers <= 1 {
+		for i := range jobs {
+			jobs[i].sign(key, jobs[i].record)
+		}
+		return
+	}
+	var next int64 = -1
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				i := int(atomic.AddInt64(&next, 1))
+				if i >= len(jobs) {
+					return
+				}
+				jobs[i].sign(key, jobs[i].record)
+			}
+		}()
+	}
+	wg.Wait()
+}
@@ -0,0 +1,111 @@
+package batch
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/rovechkin1/message-sign/service/config"
+	"github.com/rovechkin1/message-sign/service/store"
+)
+
+// batchTrigger decides when the next signing round starts
+type batchTrigger interface {
+	// wait blocks until the next round should start,
+	// idle is true if previous round found no backlog.
+	// Returns false if ctx is done
+	wait(ctx context.Context, idle bool) bool
+}
+
+// newTrigger creates batch trigger selected by config
+func (c *BatchSigner) newTrigger(ctx context.Context) batchTrigger {
+	if config.GetSignerTrigger() != "changestream" {
+		return &pollTrigger{}
+	}
+	t := &changeStreamTrigger{
+		assigner:   c.assigner,
+		minBackoff: time.Duration(config.GetIdleBackoffMinMs()) * time.Millisecond,
+		maxBackoff: time.Duration(config.GetIdleBackoffMaxMs()) * time.Millisecond,
+	}
+	t.backoff = t.minBackoff
+	events, err := c.store.WatchInserts(ctx)
+	if err != nil {
+		log.Printf("WARN: change streams are not available, fall back to polling, error: %v", err)
+	} else {
+		t.events = events
+	}
+	return t
+}
+
+// pollTrigger starts signing round every second
+type pollTrigger struct {
+}
+
+func (c *pollTrigger) wait(ctx context.Context, idle bool) bool {
+	select {
+	case <-ctx.Done():
+		return false
+	case <-time.After(1 * time.Second):
+		return true
+	}
+}
+
+// changeStreamTrigger starts signing round when new records are
+// inserted into assigned shards and signs back-to-back while
+// there is a backlog. Without change stream it polls with exponential idle backoff
+type changeStreamTrigger struct {
+	assigner ShardAssigner
+	// events delivers shard keys of inserted records, nil if change stream is not available
+	events     <-chan int64
+	minBackoff time.Duration
+	maxBackoff time.Duration
+	backoff    time.Duration
+}
+
+func (c *changeStreamTrigger) wait(ctx context.Context, idle bool) bool {
+	if !idle {
+		c.backoff = c.minBackoff
+		return ctx.Err() == nil
+	}
+
+	// with change stream the timer is a safety net only
+	timeout := c.maxBackoff
+	if c.events == nil {
+		timeout = c.backoff
+		c.backoff *= 2
+		if c.backoff > c.maxBackoff {
+			c.backoff = c.maxBackoff
+		}
+	}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return false
+		case <-timer.C:
+			return true
+		case shardKey, ok := <-c.events:
+			if !ok {
+				log.Printf("WARN: change stream is closed, fall back to polling")
+				c.events = nil
+				return true
+			}
+			if c.isAssigned(shardKey) {
+				c.backoff = c.minBackoff
+				return true
+			}
+		}
+	}
+}
+
+// isAssigned checks if record with shardKey belongs to assigned shards
+func (c *changeStreamTrigger) isAssigned(shardKey int64) bool {
+	shard := store.ShardOf(shardKey, c.assigner.ShardCount())
+	for _, s := range c.assigner.Shards() {
+		if s == shard {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,24 @@
+package broadcast
+
+import (
+	"context"
+	"math/big"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/ethclient"
+)
+
+// Backend is a subset of ethereum JSON-RPC used by broadcaster,
+// it is implemented by ethclient.Client and by go-ethereum simulated backend
+type Backend interface {
+	SendTransaction(ctx context.Context, tx *types.Transaction) error
+	TransactionReceipt(ctx context.Context, txHash common.Hash) (*types.Receipt, error)
+	NonceAt(ctx context.Context, account common.Address, blockNumber *big.Int) (uint64, error)
+	PendingNonceAt(ctx context.Context, account common.Address) (uint64, error)
+}
+
+// NewRpcBackend connects to JSON-RPC endpoint of ethereum node
+func NewRpcBackend(ctx context.Context, url string) (Backend, error) {
+	return ethclient.DialContext(ctx, url)
+}
@@ -0,0 +1,324 @@
+package broadcast
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/rovechkin1/message-sign/service/config"
+	"github.com/rovechkin1/message-sign/service/metrics"
+	"github.com/rovechkin1/message-sign/service/signer"
+	"github.com/rovechkin1/message-sign/service/store"
+)
+
+// NonceGap is a range of account nonces which have no signed transaction,
+// transactions of key have their own nonce sequence, so a gap means
+// signed transactions were lost or moved back to unsigned records
+type NonceGap struct {
+	From int64 `json:"from"`
+	To   int64 `json:"to"`
+}
+
+// KeyStatus is a broadcast status of a signing key account
+type KeyStatus struct {
+	KeyId   string `json:"key"`
+	Address string `json:"address"`
+	// StoreNonce is the next tx nonce of the key in signingkeys
+	StoreNonce int64 `json:"store_nonce"`
+	// ChainNonce is the number of mined transactions of the account
+	ChainNonce int64 `json:"chain_nonce"`
+	// PendingNonce is the next nonce including node tx pool
+	PendingNonce int64 `json:"pending_nonce"`
+	// ChainAhead is true if account sent transactions not signed by this service
+	ChainAhead bool `json:"chain_ahead"`
+	// Pending is the number of transactions which are not mined or dropped yet
+	Pending int        `json:"pending"`
+	Gaps    []NonceGap `json:"gaps"`
+	// Blocked is true if broadcast waits for a nonce gap to be filled
+	Blocked   bool      `json:"blocked"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// Broadcaster sends signed transactions of every key
+// in strict nonce order and tracks their status
+type Broadcaster struct {
+	store     store.MessageStore
+	backend   Backend
+	interval  time.Duration
+	batchSize int
+	resend    time.Duration
+	// owner is a signer whose claimed keys are broadcast,
+	// all keys are broadcast if it is empty
+	owner string
+
+	mu sync.Mutex
+	// from is the lowest tx nonce per key which is not resolved yet,
+	// transactions below it are mined or dropped
+	from   map[string]int64
+	status map[string]KeyStatus
+	// sentAt is the last time pending transaction was sent per record id
+	sentAt map[string]time.Time
+	done   chan struct{}
+}
+
+// NewBroadcaster creates broadcaster of keys claimed by owner, so replicas
+// broadcast transactions of keys they sign with, empty owner means all keys
+func NewBroadcaster(msgStore store.MessageStore, backend Backend, owner string) *Broadcaster {
+	return &Broadcaster{
+		store:     msgStore,
+		backend:   backend,
+		interval:  time.Duration(config.GetBroadcastIntervalMs()) * time.Millisecond,
+		batchSize: config.GetBroadcastBatchSize(),
+		resend:    time.Duration(config.GetBroadcastResendSec()) * time.Second,
+		owner:     owner,
+		from:      make(map[string]int64),
+		status:    make(map[string]KeyStatus),
+		sentAt:    make(map[string]time.Time),
+		done:      make(chan struct{}),
+	}
+}
+
+// Start periodically broadcasts signed transactions until ctx is done
+func (c *Broadcaster) Start(ctx context.Context) {
+	go func() {
+		defer close(c.done)
+		for {
+			if err := c.Broadcast(ctx); err != nil && ctx.Err() == nil {
+				log.Printf("ERROR: failed to broadcast transactions, error: %v", err)
+			}
+			select {
+			case <-ctx.Done():
+				log.Printf("INFO: broadcaster is done")
+				return
+			case <-time.After(c.interval):
+			}
+		}
+	}()
+}
+
+// Done returns channel which is closed when broadcaster is stopped
+func (c *Broadcaster) Done() <-chan struct{} {
+	return c.done
+}
+
+// Status returns the last broadcast status of every key
+func (c *Broadcaster) Status() []KeyStatus {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	statuses := []KeyStatus{}
+	for _, s := range c.status {
+		statuses = append(statuses, s)
+	}
+	sort.Slice(statuses, func(i, j int) bool {
+		return statuses[i].KeyId < statuses[j].KeyId
+	})
+	return statuses
+}
+
+// Broadcast runs a single broadcast round for all keys
+func (c *Broadcaster) Broadcast(ctx context.Context) error {
+	keys, err := c.store.ListSigningKeyMetadata(ctx)
+	if err != nil {
+		return err
+	}
+	owned, err := c.ownedKeys(ctx)
+	if err != nil {
+		return err
+	}
+	for _, md := range keys {
+		if owned != nil && !owned[md.Id] {
+			c.mu.Lock()
+			delete(c.status, md.Id)
+			delete(c.from, md.Id)
+			c.mu.Unlock()
+			continue
+		}
+		// only ECDSA secp256k1 keys have an ethereum account and sign
+		// transactions, ids of other keys are not uncompressed public keys
+		address, err := signer.KeyAddress(md.Id)
+		if err != nil {
+			continue
+		}
+		status, err := c.broadcastKey(ctx, md, address)
+		if err != nil {
+			log.Printf("ERROR: failed to broadcast transactions of key: %v, error: %v", md.Id, err)
+			continue
+		}
+		c.mu.Lock()
+		c.status[md.Id] = *status
+		c.mu.Unlock()
+		metrics.NonceGaps.WithLabelValues(md.Id).Set(float64(len(status.Gaps)))
+	}
+	return nil
+}
+
+// ownedKeys returns keys with live claim of owner, or nil if all keys are broadcast
+func (c *Broadcaster) ownedKeys(ctx context.Context) (map[string]bool, error) {
+	if c.owner == "" {
+		return nil, nil
+	}
+	owners, err := c.store.ListKeyOwners(ctx)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	owned := make(map[string]bool)
+	for _, o := range owners {
+		if o.Signer == c.owner && o.ExpiresAt.After(now) {
+			owned[o.KeyId] = true
+		}
+	}
+	return owned, nil
+}
+
+// broadcastKey resolves status of sent transactions of key and
+// sends the following ones in nonce order, it stops at a nonce gap
+// which is not consumed on chain, since later transactions can't be mined
+func (c *Broadcaster) broadcastKey(ctx context.Context, md store.SigningKeyMetadata,
+	address common.Address) (*KeyStatus, error) {
+	chainNonce, err := c.backend.NonceAt(ctx, address, nil)
+	if err != nil {
+		return nil, err
+	}
+	pendingNonce, err := c.backend.PendingNonceAt(ctx, address)
+	if err != nil {
+		return nil, err
+	}
+	status := &KeyStatus{
+		KeyId:        md.Id,
+		Address:      address.Hex(),
+		StoreNonce:   md.TxNonce,
+		ChainNonce:   int64(chainNonce),
+		PendingNonce: int64(pendingNonce),
+		ChainAhead:   int64(chainNonce) > md.TxNonce,
+		Gaps:         []NonceGap{},
+		UpdatedAt:    time.Now(),
+	}
+	if status.ChainAhead {
+		log.Printf("WARN: account nonce is ahead of key tx nonce, key: %v, chainNonce: %v, storeNonce: %v",
+			md.Id, chainNonce, md.TxNonce)
+	}
+
+	c.mu.Lock()
+	from := c.from[md.Id]
+	c.mu.Unlock()
+	records, err := c.store.ReadTxRecords(ctx, md.Id, from, c.batchSize)
+	if err != nil {
+		return nil, err
+	}
+
+	expected := from
+	resolved := true
+	for _, r := range records {
+		if r.TxNonce > expected {
+			gap := NonceGap{From: expected, To: r.TxNonce - 1}
+			status.Gaps = append(status.Gaps, gap)
+			// nonces below chain nonce are consumed by other transactions
+			if gap.To >= status.ChainNonce && !status.Blocked {
+				log.Printf("WARN: nonce gap, key: %v, from: %v, to: %v", md.Id, gap.From, gap.To)
+				status.Blocked = true
+			}
+		}
+		expected = r.TxNonce + 1
+
+		txStatus, err := c.broadcastTx(ctx, r, status)
+		if err != nil {
+			return nil, err
+		}
+		if txStatus == store.TxMined || txStatus == store.TxDropped {
+			if resolved {
+				from = r.TxNonce + 1
+			}
+		} else {
+			resolved = false
+			status.Pending += 1
+		}
+	}
+	c.mu.Lock()
+	c.from[md.Id] = from
+	c.mu.Unlock()
+	return status, nil
+}
+
+// broadcastTx updates status of a single transaction, sends it if needed
+func (c *Broadcaster) broadcastTx(ctx context.Context, r store.Record, status *KeyStatus) (store.TxStatus, error) {
+	switch r.TxStatus {
+	case store.TxMined, store.TxDropped:
+		c.forgetSent(r.Id)
+		return r.TxStatus, nil
+	}
+
+	// nonce is consumed, transaction is either mined or replaced
+	if r.TxNonce < status.ChainNonce {
+		txStatus := store.TxMined
+		_, err := c.backend.TransactionReceipt(ctx, common.HexToHash(r.TxHash))
+		if errors.Is(err, ethereum.NotFound) {
+			txStatus = store.TxDropped
+			log.Printf("WARN: transaction is dropped, id: %v, key: %v, nonce: %v", r.Id, r.KeyId, r.TxNonce)
+		} else if err != nil {
+			return r.TxStatus, err
+		}
+		if err := c.store.WriteTxStatus(ctx, r.Id, txStatus); err != nil {
+			return r.TxStatus, err
+		}
+		c.forgetSent(r.Id)
+		metrics.TxBroadcast.WithLabelValues(string(txStatus)).Inc()
+		return txStatus, nil
+	}
+
+	if status.Blocked || (r.TxStatus == store.TxPending && !c.resendDue(r, status)) {
+		return r.TxStatus, nil
+	}
+
+	tx, err := signer.DecodeTx(r.RawTx)
+	if err != nil {
+		return r.TxStatus, err
+	}
+	err = c.backend.SendTransaction(ctx, tx)
+	if err != nil && !strings.Contains(err.Error(), "already known") {
+		// later nonces can't be sent until this one is accepted
+		log.Printf("ERROR: failed to send transaction, id: %v, key: %v, nonce: %v, error: %v",
+			r.Id, r.KeyId, r.TxNonce, err)
+		status.Blocked = true
+		return r.TxStatus, nil
+	}
+	c.mu.Lock()
+	c.sentAt[r.Id] = time.Now()
+	c.mu.Unlock()
+	if r.TxStatus == store.TxPending {
+		log.Printf("INFO: resent transaction, id: %v, key: %v, nonce: %v, hash: %v", r.Id, r.KeyId, r.TxNonce, r.TxHash)
+		return store.TxPending, nil
+	}
+	if err := c.store.WriteTxStatus(ctx, r.Id, store.TxPending); err != nil {
+		return r.TxStatus, err
+	}
+	metrics.TxBroadcast.WithLabelValues(string(store.TxPending)).Inc()
+	log.Printf("INFO: sent transaction, id: %v, key: %v, nonce: %v, hash: %v", r.Id, r.KeyId, r.TxNonce, r.TxHash)
+	return store.TxPending, nil
+}
+
+// resendDue returns true if pending transaction is sent again: the node
+// has no transaction with its nonce, e.g. it was evicted from tx pool or
+// the node restarted, or it is not mined within resend timeout
+func (c *Broadcaster) resendDue(r store.Record, status *KeyStatus) bool {
+	if status.PendingNonce <= r.TxNonce {
+		return true
+	}
+	c.mu.Lock()
+	sentAt, ok := c.sentAt[r.Id]
+	c.mu.Unlock()
+	// send time is lost on restart, node ignores transaction it already knows
+	return !ok || time.Since(sentAt) >= c.resend
+}
+
+func (c *Broadcaster) forgetSent(id string) {
+	c.mu.Lock()
+	delete(c.sentAt, id)
+	c.mu.Unlock()
+}
@@ -0,0 +1,265 @@
+package broadcast
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rand"
+	"fmt"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/accounts/abi/bind/backends"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/core"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/rovechkin1/message-sign/service/signer"
+	"github.com/rovechkin1/message-sign/service/store"
+)
+
+// simulated backend uses chain id 1337
+var simChainId = big.NewInt(1337)
+
+// testAccount is an ECDSA key funded in simulated backend
+type testAccount struct {
+	key     *ecdsa.PrivateKey
+	keyId   string
+	address common.Address
+}
+
+func newTestAccount(t *testing.T) testAccount {
+	key, err := crypto.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return testAccount{
+		key:     key,
+		keyId:   hexutil.Encode(crypto.FromECDSAPub(&key.PublicKey)),
+		address: crypto.PubkeyToAddress(key.PublicKey),
+	}
+}
+
+func newSimulatedBackend(accounts ...testAccount) *backends.SimulatedBackend {
+	alloc := core.GenesisAlloc{}
+	for _, a := range accounts {
+		alloc[a.address] = core.GenesisAccount{Balance: big.NewInt(1e18)}
+	}
+	return backends.NewSimulatedBackend(alloc, 8000000)
+}
+
+// signedTx returns signed transaction record of account with tx nonce
+func signedTx(t *testing.T, a testAccount, txNonce int64) store.Record {
+	to := common.HexToAddress("0x1")
+	tx, err := types.SignTx(types.NewTx(&types.LegacyTx{
+		Nonce:    uint64(txNonce),
+		To:       &to,
+		Value:    big.NewInt(1),
+		Gas:      21000,
+		GasPrice: big.NewInt(1e9),
+	}), types.NewEIP155Signer(simChainId), a.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rawTx, err := signer.EncodeTx(tx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return store.Record{
+		Id:      fmt.Sprintf("%032x", txNonce),
+		KeyId:   a.keyId,
+		Type:    store.RecordTx,
+		Salt:    fmt.Sprintf("%d", txNonce),
+		Nonce:   txNonce,
+		TxNonce: txNonce,
+		RawTx:   rawTx,
+		TxHash:  tx.Hash().Hex(),
+	}
+}
+
+func txStatuses(t *testing.T, msgStore store.MessageStore, keyId string) map[int64]store.TxStatus {
+	records, err := msgStore.ReadTxRecords(context.Background(), keyId, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	statuses := make(map[int64]store.TxStatus)
+	for _, r := range records {
+		statuses[r.TxNonce] = r.TxStatus
+	}
+	return statuses
+}
+
+func TestBroadcast(t *testing.T) {
+	tests := []struct {
+		name     string
+		txNonces []int64
+		keyNonce int64
+		// statuses after the first round and after the block is mined
+		sent    map[int64]store.TxStatus
+		mined   map[int64]store.TxStatus
+		gaps    []NonceGap
+		blocked bool
+	}{
+		{
+			name:     "contiguous",
+			txNonces: []int64{0, 1, 2},
+			keyNonce: 3,
+			sent:     map[int64]store.TxStatus{0: store.TxPending, 1: store.TxPending, 2: store.TxPending},
+			mined:    map[int64]store.TxStatus{0: store.TxMined, 1: store.TxMined, 2: store.TxMined},
+			gaps:     []NonceGap{},
+		},
+		{
+			name:     "gap",
+			txNonces: []int64{0, 2},
+			keyNonce: 3,
+			sent:     map[int64]store.TxStatus{0: store.TxPending, 2: store.TxNotSent},
+			mined:    map[int64]store.TxStatus{0: store.TxMined, 2: store.TxNotSent},
+			gaps:     []NonceGap{{From: 1, To: 1}},
+			blocked:  true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			account := newTestAccount(t)
+			sim := newSimulatedBackend(account)
+			defer sim.Close()
+
+			msgStore := store.NewMemoryStore()
+			var records []store.Record
+			for _, n := range tt.txNonces {
+				records = append(records, signedTx(t, account, n))
+			}
+			if err := msgStore.WriteBatch(ctx, records); err != nil {
+				t.Fatal(err)
+			}
+			md := &store.SigningKeyMetadata{Id: account.keyId, Nonce: tt.keyNonce, TxNonce: tt.keyNonce}
+			if err := msgStore.WriteSigningKeyMetadata(ctx, md); err != nil {
+				t.Fatal(err)
+			}
+
+			b := NewBroadcaster(msgStore, sim, "")
+			if err := b.Broadcast(ctx); err != nil {
+				t.Fatal(err)
+			}
+			if got := txStatuses(t, msgStore, account.keyId); fmt.Sprint(got) != fmt.Sprint(tt.sent) {
+				t.Errorf("statuses after send: got %v, want %v", got, tt.sent)
+			}
+
+			sim.Commit()
+			if err := b.Broadcast(ctx); err != nil {
+				t.Fatal(err)
+			}
+			if got := txStatuses(t, msgStore, account.keyId); fmt.Sprint(got) != fmt.Sprint(tt.mined) {
+				t.Errorf("statuses after commit: got %v, want %v", got, tt.mined)
+			}
+			statuses := b.Status()
+			if len(statuses) != 1 {
+				t.Fatalf("got %v key statuses, want 1", len(statuses))
+			}
+			status := statuses[0]
+			if fmt.Sprint(status.Gaps) != fmt.Sprint(tt.gaps) || status.Blocked != tt.blocked {
+				t.Errorf("got gaps %v, blocked %v, want gaps %v, blocked %v",
+					status.Gaps, status.Blocked, tt.gaps, tt.blocked)
+			}
+			if status.Address != account.address.Hex() || status.StoreNonce != tt.keyNonce {
+				t.Errorf("got address %v, store nonce %v, want %v, %v",
+					status.Address, status.StoreNonce, account.address.Hex(), tt.keyNonce)
+			}
+		})
+	}
+}
+
+func TestBroadcastSkipsNonEthereumKeys(t *testing.T) {
+	ctx := context.Background()
+	account := newTestAccount(t)
+	sim := newSimulatedBackend(account)
+	defer sim.Close()
+
+	edKey, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msgStore := store.NewMemoryStore()
+	for _, keyId := range []string{account.keyId, hexutil.Encode(edKey)} {
+		if err := msgStore.WriteSigningKeyMetadata(ctx, store.NewSigningKeyMetadata(keyId)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	b := NewBroadcaster(msgStore, sim, "")
+	if err := b.Broadcast(ctx); err != nil {
+		t.Fatal(err)
+	}
+	statuses := b.Status()
+	if len(statuses) != 1 || statuses[0].KeyId != account.keyId {
+		t.Errorf("got statuses %+v, want only key %v", statuses, account.keyId)
+	}
+}
+
+func TestBroadcastResendsPending(t *testing.T) {
+	ctx := context.Background()
+	account := newTestAccount(t)
+	sim := newSimulatedBackend(account)
+	defer sim.Close()
+
+	msgStore := store.NewMemoryStore()
+	if err := msgStore.WriteBatch(ctx, []store.Record{signedTx(t, account, 0)}); err != nil {
+		t.Fatal(err)
+	}
+	md := &store.SigningKeyMetadata{Id: account.keyId, Nonce: 1, TxNonce: 1}
+	if err := msgStore.WriteSigningKeyMetadata(ctx, md); err != nil {
+		t.Fatal(err)
+	}
+
+	b := NewBroadcaster(msgStore, sim, "")
+	if err := b.Broadcast(ctx); err != nil {
+		t.Fatal(err)
+	}
+	// node loses pending transaction
+	sim.Rollback()
+	if err := b.Broadcast(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if pending, err := sim.PendingNonceAt(ctx, account.address); err != nil || pending != 1 {
+		t.Fatalf("got pending nonce %v, error %v, want 1", pending, err)
+	}
+	sim.Commit()
+	if err := b.Broadcast(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if got := txStatuses(t, msgStore, account.keyId); got[0] != store.TxMined {
+		t.Errorf("got status %v, want %v", got[0], store.TxMined)
+	}
+}
+
+func TestBroadcastOwnedKeys(t *testing.T) {
+	ctx := context.Background()
+	owned, other := newTestAccount(t), newTestAccount(t)
+	sim := newSimulatedBackend(owned, other)
+	defer sim.Close()
+
+	msgStore := store.NewMemoryStore()
+	now := time.Now()
+	for shard, a := range []testAccount{owned, other} {
+		if err := msgStore.WriteSigningKeyMetadata(ctx, store.NewSigningKeyMetadata(a.keyId)); err != nil {
+			t.Fatal(err)
+		}
+		err := msgStore.ClaimKey(ctx, store.KeyOwner{KeyId: a.keyId, Shard: shard,
+			Signer: fmt.Sprintf("signer-%v", shard), ExpiresAt: now.Add(time.Minute)}, now)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	b := NewBroadcaster(msgStore, sim, "signer-0")
+	if err := b.Broadcast(ctx); err != nil {
+		t.Fatal(err)
+	}
+	statuses := b.Status()
+	if len(statuses) != 1 || statuses[0].KeyId != owned.keyId {
+		t.Errorf("got statuses %+v, want only key %v", statuses, owned.keyId)
+	}
+}
@@ -5,16 +5,22 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/rovechkin1/message-sign/service/config"
 	"log"
 	"net/http"
 	"os/signal"
+	"strconv"
 	"syscall"
 	"time"
 
 	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/rovechkin1/message-sign/service/batch"
+	"github.com/rovechkin1/message-sign/service/broadcast"
+	"github.com/rovechkin1/message-sign/service/lease"
+	"github.com/rovechkin1/message-sign/service/metrics"
 	"github.com/rovechkin1/message-sign/service/store"
 
 	"github.com/rovechkin1/message-sign/service/signer"
@@ -25,16 +31,65 @@ func main() {
 	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
 	defer stop()
 
+	if err := store.CheckShardHash(config.GetShardHash()); err != nil {
+		log.Fatalf("Invalid shard hash, error: %v", err)
+	}
+
 	// initialize objects
-	mongoClient, ctxMongo, err := store.NewMongoClient(ctx)
+	var msgStore store.MessageStore
+	var leaseStore store.LeaseStore
+	var mongoClient *store.MongoClient
+	if config.GetMessageStore() == "memory" {
+		log.Printf("INFO: using in-memory message store")
+		msgStore = store.NewMemoryStore()
+		leaseStore = store.NewMemoryLeaseStore()
+	} else {
+		var err error
+		mongoClient, _, err = store.NewMongoClient(ctx)
+		if err != nil {
+			log.Fatalf("Cannot create record-generator client: %v, error: %v", config.GetMongoUrl(), err)
+		}
+		msgStore = store.NewMongoStore(mongoClient)
+		leaseStore = store.NewMongoLeaseStore(mongoClient)
+	}
+	keyStore, err := signer.NewKeyStore()
 	if err != nil {
-		log.Fatalf("Cannot create record-generator client: %v, error: %v", config.GetMongoUrl(), err)
+		log.Fatalf("Canot init key store, error: %v", err)
 	}
-	defer mongoClient.Close(ctxMongo)
-	store := store.NewMongoStore(mongoClient)
-	keyStore, err := signer.NewFileKeyStore()
+
+	// handlers use server ctx, which outlives ctx, so requests
+	// served while the signer drains can still reach the store
+	srvCtx, stopSrv := context.WithCancel(context.Background())
+	defer stopSrv()
+
+	metrics.RegisterUnsignedBacklog(func() float64 {
+		n, err := msgStore.GetRecordCount(srvCtx, false)
+		if err != nil {
+			log.Printf("ERROR: failed to get unsigned backlog: %v", err)
+			return 0
+		}
+		return float64(n)
+	})
+
+	// create periodic signers, they are started once API is served
+	// shard assignment outlives ctx, so shards stay assigned
+	// while the in-flight batch is drained on shutdown
+	assignerCtx, stopAssigner := context.WithCancel(context.Background())
+	defer stopAssigner()
+	var batchSigner *batch.BatchSigner
+	assigner, assignerDone, err := newShardAssigner(assignerCtx, leaseStore)
 	if err != nil {
-		log.Fatalf("Canot init key store")
+		log.Printf("ERROR: cannot create shard assigner, error: %v", err)
+	} else {
+		batchSigner, err = batch.NewBatchSigner(msgStore, keyStore, assigner)
+		if errors.Is(err, store.ErrKeyConflict) {
+			// another live shard signs with the same key, signing
+			// concurrently would race on the key nonce
+			log.Fatalf("ERROR: signing keys are claimed by another shard, error: %v", err)
+		}
+		if err != nil {
+			log.Printf("ERROR: cannot create record signer, error: %v", err)
+		}
 	}
 
 	router := gin.Default()
@@ -43,10 +98,13 @@ func main() {
 		c.String(http.StatusOK, fmt.Sprintf("live"))
 	})
 
+	// endpoint for prometheus metrics
+	router.GET("/metrics", gin.WrapH(promhttp.Handler()))
+
 	// endpoint to get statistics
 	router.GET("/stats", func(c *gin.Context) {
 		var err error
-		stats, err := batch.GetStats(ctx, store)
+		stats, err := batch.GetStats(srvCtx, msgStore, batchSigner)
 		if err != nil {
 			log.Printf("ERROR: failed to get stats: %v", err)
 			c.String(http.StatusInternalServerError,
@@ -57,6 +115,198 @@ func main() {
 		}
 	})
 
+	// endpoint to submit a single record for signing
+	router.POST("/records", func(c *gin.Context) {
+		var req batch.RecordRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.String(http.StatusBadRequest, fmt.Sprintf("invalid request, error: %v", err))
+			return
+		}
+		submitRecords(srvCtx, c, msgStore, []batch.RecordRequest{req})
+	})
+
+	// endpoint to submit an array of records for signing
+	router.POST("/records/batch", func(c *gin.Context) {
+		var reqs []batch.RecordRequest
+		if err := c.ShouldBindJSON(&reqs); err != nil {
+			c.String(http.StatusBadRequest, fmt.Sprintf("invalid request, error: %v", err))
+			return
+		}
+		submitRecords(srvCtx, c, msgStore, reqs)
+	})
+
+	// endpoint to get a record with its signature, salt and key
+	router.GET("/records/:id", func(c *gin.Context) {
+		record, err := batch.GetRecord(srvCtx, msgStore, c.Param("id"))
+		if err != nil {
+			log.Printf("ERROR: failed to get record: %v", err)
+			c.String(http.StatusInternalServerError,
+				fmt.Sprintf("error to get record, error: %v", err))
+			return
+		}
+		if record.Status == store.RecordUnknown {
+			c.JSON(http.StatusNotFound, record)
+			return
+		}
+		c.JSON(http.StatusOK, record)
+	})
+
+	// endpoint to list records which failed to sign too many times
+	router.GET("/deadletters", func(c *gin.Context) {
+		limit, err := strconv.Atoi(c.DefaultQuery("limit", "100"))
+		if err != nil {
+			c.String(http.StatusBadRequest, fmt.Sprintf("invalid limit, error: %v", err))
+			return
+		}
+		records, err := batch.ListDeadLetters(srvCtx, msgStore, limit)
+		if err != nil {
+			log.Printf("ERROR: failed to list dead letters: %v", err)
+			c.String(http.StatusInternalServerError,
+				fmt.Sprintf("error to list dead letters, error: %v", err))
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"records": records})
+	})
+
+	// endpoint to return a dead letter to unsigned records
+	router.POST("/deadletters/:id/requeue", func(c *gin.Context) {
+		err := batch.RequeueDeadLetter(srvCtx, msgStore, c.Param("id"))
+		if errors.Is(err, store.ErrNotFound) {
+			c.String(http.StatusNotFound, "dead letter not found")
+			return
+		}
+		if err != nil {
+			log.Printf("ERROR: failed to requeue dead letter: %v", err)
+			c.String(http.StatusInternalServerError,
+				fmt.Sprintf("error to requeue dead letter, error: %v", err))
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"requeued": c.Param("id")})
+	})
+
+	// endpoint to list records quarantined because of invalid id
+	router.GET("/quarantine", func(c *gin.Context) {
+		limit, err := strconv.Atoi(c.DefaultQuery("limit", "100"))
+		if err != nil {
+			c.String(http.StatusBadRequest, fmt.Sprintf("invalid limit, error: %v", err))
+			return
+		}
+		records, err := batch.ListQuarantine(srvCtx, msgStore, limit)
+		if err != nil {
+			log.Printf("ERROR: failed to list quarantine: %v", err)
+			c.String(http.StatusInternalServerError,
+				fmt.Sprintf("error to list quarantine, error: %v", err))
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"records": records})
+	})
+
+	// endpoint to get a signed merkle batch root
+	router.GET("/batches/:id", func(c *gin.Context) {
+		merkleBatch, err := batch.GetMerkleBatch(srvCtx, msgStore, c.Param("id"))
+		if errors.Is(err, store.ErrNotFound) {
+			c.String(http.StatusNotFound, "batch not found")
+			return
+		}
+		if err != nil {
+			log.Printf("ERROR: failed to get batch: %v", err)
+			c.String(http.StatusInternalServerError,
+				fmt.Sprintf("error to get batch, error: %v", err))
+			return
+		}
+		c.JSON(http.StatusOK, merkleBatch)
+	})
+
+	// endpoint to verify a signature
+	router.POST("/verify", func(c *gin.Context) {
+		var req batch.VerifyRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.String(http.StatusBadRequest, fmt.Sprintf("invalid request, error: %v", err))
+			return
+		}
+		valid, err := batch.VerifySignature(req)
+		if err != nil {
+			c.String(http.StatusBadRequest, fmt.Sprintf("invalid signature, error: %v", err))
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"valid": valid})
+	})
+
+	// endpoint to re-verify all signed records
+	router.POST("/verify/all", func(c *gin.Context) {
+		report, err := batch.VerifySignedRecords(srvCtx, msgStore)
+		if err != nil {
+			log.Printf("ERROR: failed to verify signed records: %v", err)
+			c.String(http.StatusInternalServerError,
+				fmt.Sprintf("error to verify signed records, error: %v", err))
+			return
+		}
+		c.JSON(http.StatusOK, report)
+	})
+
+	// endpoint to check that nonces of each key are contiguous,
+	// POST with repair=true signs records after the first gap again
+	checkNonces := func(c *gin.Context, repair bool) {
+		report, err := batch.CheckNonces(srvCtx, msgStore, repair)
+		if err != nil {
+			log.Printf("ERROR: failed to check nonces: %v", err)
+			c.String(http.StatusInternalServerError,
+				fmt.Sprintf("error to check nonces, error: %v", err))
+			return
+		}
+		c.JSON(http.StatusOK, report)
+	}
+	router.GET("/admin/nonces/check", func(c *gin.Context) {
+		checkNonces(c, false)
+	})
+	router.POST("/admin/nonces/check", func(c *gin.Context) {
+		checkNonces(c, c.Query("repair") == "true")
+	})
+
+	// endpoint to show key set version and status of each key
+	router.GET("/keys", func(c *gin.Context) {
+		keys, err := batch.GetKeys(srvCtx, msgStore, keyStore)
+		if err != nil {
+			log.Printf("ERROR: failed to get keys: %v", err)
+			c.String(http.StatusInternalServerError,
+				fmt.Sprintf("error to get keys, error: %v", err))
+			return
+		}
+		c.JSON(http.StatusOK, keys)
+	})
+
+	// endpoint to show how evenly signing keys are used
+	router.GET("/keys/usage", func(c *gin.Context) {
+		usage, err := batch.GetKeyUsage(srvCtx, msgStore, keyStore)
+		if err != nil {
+			log.Printf("ERROR: failed to get key usage: %v", err)
+			c.String(http.StatusInternalServerError,
+				fmt.Sprintf("error to get key usage, error: %v", err))
+			return
+		}
+		c.JSON(http.StatusOK, usage)
+	})
+
+	// broadcaster sends signed transactions to ethereum node
+	var broadcaster *broadcast.Broadcaster
+	if config.GetBroadcasterEnabled() {
+		backend, err := broadcast.NewRpcBackend(ctx, config.GetEthRpcUrl())
+		if err != nil {
+			log.Printf("ERROR: cannot connect to ethereum node: %v, error: %v", config.GetEthRpcUrl(), err)
+		} else {
+			broadcaster = broadcast.NewBroadcaster(msgStore, backend, config.GetMyPodName())
+		}
+	}
+
+	// endpoint to show broadcast status and nonce gaps of each key
+	router.GET("/broadcast/status", func(c *gin.Context) {
+		if broadcaster == nil {
+			c.String(http.StatusNotFound, "broadcaster is disabled")
+			return
+		}
+		c.JSON(http.StatusOK, broadcaster.Status())
+	})
+
 	srv := &http.Server{
 		Addr:    fmt.Sprintf(":%s", config.GetSignerPort()),
 		Handler: router,
@@ -71,13 +321,16 @@ func main() {
 	}()
 
 	// start periodic signers
-	batchSigner, err := batch.NewBatchSigner(store, keyStore, mongoClient.GetMongo())
-	if err != nil {
-		log.Printf("ERROR: cannot create record signer, error: %v", err)
-	} else {
+	if batchSigner != nil {
 		batchSigner.StartPeriodicBatchSigner(ctx)
 	}
 
+	if broadcaster != nil {
+		broadcaster.Start(ctx)
+	}
+
+	batch.StartQuarantineSweeper(ctx, msgStore)
+
 	// Listen for the interrupt signal.
 	<-ctx.Done()
 
@@ -85,13 +338,66 @@ func main() {
 	stop()
 	log.Println("shutting down gracefully, press Ctrl+C again to force")
 
+	// wait for the signer to finish or abort its in-flight batch
+	if batchSigner != nil {
+		if err := batchSigner.Wait(); err != nil {
+			log.Printf("ERROR: signer did not stop cleanly: %v", err)
+		} else {
+			log.Println("signer stopped cleanly")
+		}
+	}
+	if assignerDone != nil {
+		stopAssigner()
+		<-assignerDone
+	}
+	if broadcaster != nil {
+		<-broadcaster.Done()
+	}
+
 	// The context is used to inform the server it has 5 seconds to finish
 	// the request it is currently handling
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
-	if err := srv.Shutdown(ctx); err != nil {
+	if err := srv.Shutdown(shutdownCtx); err != nil {
 		log.Fatal("Server forced to shutdown: ", err)
 	}
+	stopSrv()
+
+	if mongoClient != nil {
+		mongoClient.Close(shutdownCtx)
+	}
 
 	log.Println("Server exiting")
 }
+
+// newShardAssigner creates shard assigner selected by config,
+// returned channel is closed when assigner stops after ctx is done
+func newShardAssigner(ctx context.Context, leaseStore store.LeaseStore) (batch.ShardAssigner, <-chan struct{}, error) {
+	if config.GetShardAssignment() != "lease" {
+		assigner, err := batch.NewStaticShardAssigner()
+		return assigner, nil, err
+	}
+	ttl := time.Duration(config.GetLeaseTtlSec()) * time.Second
+	manager, err := lease.NewManager(leaseStore, config.GetMyPodName(), config.GetShardCount(), ttl)
+	if err != nil {
+		return nil, nil, err
+	}
+	manager.Start(ctx)
+	return manager, manager.Done(), nil
+}
+
+func submitRecords(ctx context.Context, c *gin.Context, msgStore store.MessageStore, reqs []batch.RecordRequest) {
+	err := batch.SubmitRecords(ctx, msgStore, reqs)
+	switch {
+	case errors.Is(err, store.ErrInvalidRecordId), errors.Is(err, batch.ErrInvalidRecord):
+		c.String(http.StatusBadRequest, fmt.Sprintf("invalid record, error: %v", err))
+	case errors.Is(err, store.ErrDuplicateRecord):
+		c.String(http.StatusConflict, fmt.Sprintf("duplicate record, error: %v", err))
+	case err != nil:
+		log.Printf("ERROR: failed to submit records: %v", err)
+		c.String(http.StatusInternalServerError,
+			fmt.Sprintf("error to submit records, error: %v", err))
+	default:
+		c.JSON(http.StatusCreated, gin.H{"inserted": len(reqs)})
+	}
+}
@@ -3,6 +3,8 @@ package config
 import (
 	"github.com/spf13/viper"
 	"os"
+	"path"
+	"strings"
 )
 
 func init() {
@@ -13,8 +15,28 @@ func init() {
 	viper.SetDefault("mongo_pwd", "")
 	viper.SetDefault("keys_dir", "")
 
+	// key store backend: file (plain keys.csv) or keystore (encrypted V3 json files)
+	viper.SetDefault("key_store", "file")
+	// directory of V3 keystore json files, default is <keys_dir>/keystore
+	viper.SetDefault("keystore_dir", "")
+	// keystore passphrase is read from keystore_passphrase_file if it is set,
+	// otherwise from keystore_passphrase
+	viper.SetDefault("keystore_passphrase", "")
+	viper.SetDefault("keystore_passphrase_file", "")
+	// decrypted keys are zeroed when not used for this time
+	viper.SetDefault("keystore_unlock_ttl_sec", 60)
+	// key source is checked for changes every interval, 0 disables key reload
+	viper.SetDefault("key_reload_sec", 10)
+	viper.SetDefault("key_claim_ttl_sec", 30)
+	// use light scrypt parameters when key-generator writes keystore files
+	viper.SetDefault("keystore_light_scrypt", false)
+
 	viper.SetDefault("enable_mongo_xact", false)
 
+	// message store backend: mongo or memory,
+	// memory store is used for local runs and doesn't persist records
+	viper.SetDefault("message_store", "mongo")
+
 	viper.SetDefault("msg_signer_url", "http://localhost:8080")
 	viper.SetDefault("signer_port", "8080")
 
@@ -25,6 +47,71 @@ func init() {
 	viper.SetDefault("total_signers", 1)
 
 	viper.SetDefault("batch_size", 100)
+	// batch size adapts between min and max by commit latency and conflicts,
+	// 0 means batch_size, so the size is fixed by default
+	viper.SetDefault("batch_size_min", 0)
+	viper.SetDefault("batch_size_max", 0)
+	// batch size shrinks if commit takes longer than target latency
+	viper.SetDefault("batch_target_latency_ms", 5000)
+	// number of goroutines signing records of a batch, 0 uses all CPUs
+	viper.SetDefault("sign_workers", 0)
+
+	// default sign scheme of messages: raw, eip191 or eip712,
+	// records may override it
+	viper.SetDefault("sign_scheme", "raw")
+	// EIP-712 domain, empty fields are omitted from domain separator
+	viper.SetDefault("eip712_domain_name", "message-sign")
+	viper.SetDefault("eip712_domain_version", "1")
+	viper.SetDefault("eip712_chain_id", 0)
+	viper.SetDefault("eip712_verifying_contract", "")
+
+	// sign messages of a batch once as a merkle root,
+	// each record gets root signature and its inclusion proof
+	viper.SetDefault("merkle_batches", false)
+
+	// record which failed to sign this many times is moved to dead letters
+	viper.SetDefault("max_sign_attempts", 5)
+
+	// append every signed batch to hash-chained audit log,
+	// the chain is global so batches of all shards are serialized on its head
+	viper.SetDefault("audit_log", false)
+
+	// broadcaster sends signed transactions to ethereum node
+	viper.SetDefault("broadcaster_enabled", false)
+	viper.SetDefault("eth_rpc_url", "http://localhost:8545")
+	viper.SetDefault("broadcast_interval_ms", 2000)
+	viper.SetDefault("broadcast_batch_size", 100)
+	// pending transaction is sent again if node has no transaction with
+	// its nonce or if it is not mined after this timeout
+	viper.SetDefault("broadcast_resend_sec", 60)
+
+	// signer trigger: poll or changestream
+	// poll starts signing every second
+	// changestream wakes signer on inserts into its shards and signs back-to-back
+	// while there is a backlog, falls back to polling with exponential idle backoff
+	// when change streams are not available (standalone mongod)
+	viper.SetDefault("signer_trigger", "poll")
+	viper.SetDefault("idle_backoff_min_ms", 50)
+	viper.SetDefault("idle_backoff_max_ms", 2000)
+
+	// on shutdown in-flight batch is given this time to commit before it is aborted
+	viper.SetDefault("shutdown_drain_timeout_sec", 20)
+
+	// shard assignment: static or lease
+	// static uses pod name ordinal and total_signers, requires stateful set
+	// lease lets signers claim shard leases in mongo, any number of replicas can run
+	viper.SetDefault("shard_assignment", "static")
+	// number of shards when lease shard assignment is used,
+	// number of keys must be at least number of shards
+	viper.SetDefault("shard_count", 16)
+	// shard lease ttl, leases are renewed every ttl/3
+	viper.SetDefault("lease_ttl_sec", 15)
+	// shard key function of record id:
+	// le64 uses first 8 bytes of hex id, fnv hashes any string id
+	viper.SetDefault("shard_hash", "le64")
+	// unsigned records without shard key are swept every interval,
+	// records with invalid ids are moved to quarantine, 0 disables the sweep
+	viper.SetDefault("quarantine_sweep_sec", 60)
 
 	// signer id is identifier for the current pod
 	// we adapt k8s format e.g. <signer name>-0, <signer name>-2, ...
@@ -46,11 +133,46 @@ func init() {
 	viper.BindEnv("signer_port")
 
 	viper.BindEnv("keys_dir")
+	viper.BindEnv("key_store")
+	viper.BindEnv("keystore_dir")
+	viper.BindEnv("keystore_passphrase")
+	viper.BindEnv("keystore_passphrase_file")
+	viper.BindEnv("keystore_unlock_ttl_sec")
+	viper.BindEnv("key_reload_sec")
+	viper.BindEnv("key_claim_ttl_sec")
+	viper.BindEnv("keystore_light_scrypt")
 
 	viper.BindEnv("enable_mongo_xact")
+	viper.BindEnv("message_store")
 
 	viper.BindEnv("total_signers")
 	viper.BindEnv("batch_size")
+	viper.BindEnv("batch_size_min")
+	viper.BindEnv("batch_size_max")
+	viper.BindEnv("batch_target_latency_ms")
+	viper.BindEnv("sign_workers")
+	viper.BindEnv("sign_scheme")
+	viper.BindEnv("eip712_domain_name")
+	viper.BindEnv("eip712_domain_version")
+	viper.BindEnv("eip712_chain_id")
+	viper.BindEnv("eip712_verifying_contract")
+	viper.BindEnv("merkle_batches")
+	viper.BindEnv("audit_log")
+	viper.BindEnv("max_sign_attempts")
+	viper.BindEnv("broadcaster_enabled")
+	viper.BindEnv("eth_rpc_url")
+	viper.BindEnv("broadcast_interval_ms")
+	viper.BindEnv("broadcast_batch_size")
+	viper.BindEnv("broadcast_resend_sec")
+	viper.BindEnv("signer_trigger")
+	viper.BindEnv("idle_backoff_min_ms")
+	viper.BindEnv("idle_backoff_max_ms")
+	viper.BindEnv("shutdown_drain_timeout_sec")
+	viper.BindEnv("shard_assignment")
+	viper.BindEnv("shard_count")
+	viper.BindEnv("shard_hash")
+	viper.BindEnv("quarantine_sweep_sec")
+	viper.BindEnv("lease_ttl_sec")
 	viper.BindEnv("my_pod_name")
 	viper.BindEnv("test_sign_failure_rate_pct")
 
@@ -83,10 +205,55 @@ func GetKeysDir() string {
 	return viper.GetString("keys_dir")
 }
 
+func GetKeyStore() string {
+	return viper.GetString("key_store")
+}
+
+func GetKeyReloadSec() int {
+	return viper.GetInt("key_reload_sec")
+}
+
+func GetKeyClaimTtlSec() int {
+	return viper.GetInt("key_claim_ttl_sec")
+}
+
+func GetKeystoreDir() string {
+	dir := viper.GetString("keystore_dir")
+	if dir == "" {
+		return path.Join(GetKeysDir(), "keystore")
+	}
+	return dir
+}
+
+// GetKeystorePassphrase reads passphrase from file or env variable
+func GetKeystorePassphrase() (string, error) {
+	file := viper.GetString("keystore_passphrase_file")
+	if file == "" {
+		return viper.GetString("keystore_passphrase"), nil
+	}
+	content, err := os.ReadFile(file)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(string(content), "\r\n"), nil
+}
+
+func GetKeystoreUnlockTtlSec() int {
+	return viper.GetInt("keystore_unlock_ttl_sec")
+}
+
+func GetKeystoreLightScrypt() bool {
+	return viper.GetBool("keystore_light_scrypt")
+}
+
 func GetEnableMongoXact() bool {
 	return viper.GetBool("enable_mongo_xact")
 }
 
+func GetMessageStore() string {
+	return viper.GetString("message_store")
+}
+
 func GetTotalSigners() int {
 	return viper.GetInt("total_signers")
 }
@@ -108,6 +275,110 @@ func GetBatchSize() int {
 	return viper.GetInt("batch_size")
 }
 
+func GetBatchSizeMin() int {
+	return viper.GetInt("batch_size_min")
+}
+
+func GetBatchSizeMax() int {
+	return viper.GetInt("batch_size_max")
+}
+
+func GetBatchTargetLatencyMs() int {
+	return viper.GetInt("batch_target_latency_ms")
+}
+
+func GetSignWorkers() int {
+	return viper.GetInt("sign_workers")
+}
+
+func GetSignScheme() string {
+	return viper.GetString("sign_scheme")
+}
+
+func GetEip712DomainName() string {
+	return viper.GetString("eip712_domain_name")
+}
+
+func GetEip712DomainVersion() string {
+	return viper.GetString("eip712_domain_version")
+}
+
+func GetEip712ChainId() int64 {
+	return viper.GetInt64("eip712_chain_id")
+}
+
+func GetEip712VerifyingContract() string {
+	return viper.GetString("eip712_verifying_contract")
+}
+
+func GetMerkleBatches() bool {
+	return viper.GetBool("merkle_batches")
+}
+
+func GetMaxSignAttempts() int {
+	return viper.GetInt("max_sign_attempts")
+}
+
+func GetAuditLog() bool {
+	return viper.GetBool("audit_log")
+}
+
+func GetBroadcasterEnabled() bool {
+	return viper.GetBool("broadcaster_enabled")
+}
+
+func GetEthRpcUrl() string {
+	return viper.GetString("eth_rpc_url")
+}
+
+func GetBroadcastIntervalMs() int {
+	return viper.GetInt("broadcast_interval_ms")
+}
+
+func GetBroadcastBatchSize() int {
+	return viper.GetInt("broadcast_batch_size")
+}
+
+func GetBroadcastResendSec() int {
+	return viper.GetInt("broadcast_resend_sec")
+}
+
+func GetSignerTrigger() string {
+	return viper.GetString("signer_trigger")
+}
+
+func GetIdleBackoffMinMs() int {
+	return viper.GetInt("idle_backoff_min_ms")
+}
+
+func GetIdleBackoffMaxMs() int {
+	return viper.GetInt("idle_backoff_max_ms")
+}
+
+func GetShutdownDrainTimeoutSec() int {
+	return viper.GetInt("shutdown_drain_timeout_sec")
+}
+
+func GetShardAssignment() string {
+	return viper.GetString("shard_assignment")
+}
+
+func GetShardCount() int {
+	return viper.GetInt("shard_count")
+}
+
+func GetShardHash() string {
+	return viper.GetString("shard_hash")
+}
+
+func GetQuarantineSweepSec() int {
+	return viper.GetInt("quarantine_sweep_sec")
+}
+
+func GetLeaseTtlSec() int {
+	return viper.GetInt("lease_ttl_sec")
+}
+
 // generate-record tool
 func GetRecordGeneratorBatchSize() int {
 	return viper.GetInt("record_generator_batch_size")
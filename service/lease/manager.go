@@ -0,0 +1,286 @@
+package lease
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/rovechkin1/message-sign/service/store"
+)
+
+// heldLease is a shard lease held by this member
+type heldLease struct {
+	expiresAt time.Time
+	// cancel aborts signing of the shard when the lease is lost
+	cancel context.CancelFunc
+}
+
+// Manager claims shard leases for a signer and rebalances
+// shards between live signers. Each signer heartbeats its membership
+// and renews its leases, shards are evenly spread between live members
+type Manager struct {
+	store      store.LeaseStore
+	member     string
+	shardCount int
+	ttl        time.Duration
+
+	mu   sync.Mutex
+	held map[int]*heldLease
+	done chan struct{}
+}
+
+func NewManager(leaseStore store.LeaseStore, member string, shardCount int, ttl time.Duration) (*Manager, error) {
+	if shardCount <= 0 {
+		return nil, fmt.Errorf("ERROR: invalid shard count: %v", shardCount)
+	}
+	if ttl <= 0 {
+		return nil, fmt.Errorf("ERROR: invalid lease ttl: %v", ttl)
+	}
+	return &Manager{
+		store:      leaseStore,
+		member:     member,
+		shardCount: shardCount,
+		ttl:        ttl,
+		held:       make(map[int]*heldLease),
+		done:       make(chan struct{}),
+	}, nil
+}
+
+// Start claims initial leases and periodically
+// renews and rebalances them until ctx is done,
+// then leases are released and Done channel is closed
+func (c *Manager) Start(ctx context.Context) {
+	if err := c.Rebalance(ctx); err != nil {
+		log.Printf("ERROR: failed to rebalance shard leases, member: %v, error: %v", c.member, err)
+	}
+	go func() {
+		defer close(c.done)
+		ticker := time.NewTicker(c.ttl / 3)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				c.releaseAll()
+				log.Printf("INFO: lease manager is done, member: %v", c.member)
+				return
+			case <-ticker.C:
+			}
+			if err := c.Rebalance(ctx); err != nil {
+				log.Printf("ERROR: failed to rebalance shard leases, member: %v, error: %v", c.member, err)
+			}
+			c.dropExpired()
+		}
+	}()
+}
+
+// Done returns channel which is closed when manager is stopped
+func (c *Manager) Done() <-chan struct{} {
+	return c.done
+}
+
+// ShardCount returns total number of shards
+func (c *Manager) ShardCount() int {
+	return c.shardCount
+}
+
+// Shards returns shards which leases are currently held
+func (c *Manager) Shards() []int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	var shards []int
+	for shard, l := range c.held {
+		if l.expiresAt.After(now) {
+			shards = append(shards, shard)
+		}
+	}
+	sort.Ints(shards)
+	return shards
+}
+
+// ShardContext returns context which is canceled when shard lease is lost or expires
+func (c *Manager) ShardContext(ctx context.Context, shard int) (context.Context, context.CancelFunc, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	l, ok := c.held[shard]
+	if !ok || !l.expiresAt.After(time.Now()) {
+		return nil, nil, store.ErrLeaseLost
+	}
+	// lease is renewed while shard is signed, so context
+	// is canceled by drop rather than by lease deadline
+	shardCtx, cancel := context.WithCancel(ctx)
+	l.cancel = cancel
+	return shardCtx, cancel, nil
+}
+
+// Fence checks that shard lease is still held,
+// within a transaction it conflicts with a concurrent lease takeover
+func (c *Manager) Fence(ctx context.Context, shard int) error {
+	return c.store.FenceLease(ctx, shard, c.member, time.Now())
+}
+
+// Rebalance heartbeats membership, renews held leases and
+// claims or releases leases so each live member holds its share of shards
+func (c *Manager) Rebalance(ctx context.Context) error {
+	now := time.Now()
+	expiresAt := now.Add(c.ttl)
+	if err := c.store.Heartbeat(ctx, c.member, expiresAt); err != nil {
+		return err
+	}
+
+	members, err := c.store.LiveMembers(ctx, now)
+	if err != nil {
+		return err
+	}
+	live := map[string]bool{c.member: true}
+	for _, m := range members {
+		live[m] = true
+	}
+	members = members[:0]
+	for m := range live {
+		members = append(members, m)
+	}
+	sort.Strings(members)
+	target := c.targetShards(members)
+
+	// renew held leases, stop signing shards which leases are lost
+	for _, shard := range c.heldShards() {
+		err := c.store.AcquireLease(ctx, shard, c.member, now, expiresAt)
+		if err == store.ErrLeaseLost {
+			log.Printf("WARN: lease lost, member: %v, shard: %v", c.member, shard)
+			c.drop(shard)
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		c.hold(shard, expiresAt)
+	}
+
+	// release extra shards so joining members can claim them
+	held := c.heldShards()
+	for len(held) > target {
+		shard := held[len(held)-1]
+		held = held[:len(held)-1]
+		c.drop(shard)
+		if err := c.store.ReleaseLease(ctx, shard, c.member); err != nil {
+			return err
+		}
+		log.Printf("INFO: released lease, member: %v, shard: %v", c.member, shard)
+	}
+
+	if len(held) >= target {
+		return nil
+	}
+
+	// claim free shards, shards held by dead members or expired
+	leases, err := c.store.ReadLeases(ctx)
+	if err != nil {
+		return err
+	}
+	taken := make(map[int]bool)
+	for _, l := range leases {
+		if l.Owner != "" && l.Owner != c.member && live[l.Owner] && l.ExpiresAt.After(now) {
+			taken[l.Shard] = true
+		}
+	}
+	for shard := 0; shard < c.shardCount && len(held) < target; shard += 1 {
+		if taken[shard] || c.isHeld(shard) {
+			continue
+		}
+		err := c.store.AcquireLease(ctx, shard, c.member, now, expiresAt)
+		if err == store.ErrLeaseLost {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		c.hold(shard, expiresAt)
+		held = append(held, shard)
+		log.Printf("INFO: acquired lease, member: %v, shard: %v", c.member, shard)
+	}
+	return nil
+}
+
+// targetShards returns number of shards this member should hold,
+// shards which can't be spread evenly go to the first members
+func (c *Manager) targetShards(members []string) int {
+	idx := sort.SearchStrings(members, c.member)
+	target := c.shardCount / len(members)
+	if idx < c.shardCount%len(members) {
+		target += 1
+	}
+	return target
+}
+
+func (c *Manager) heldShards() []int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var shards []int
+	for shard := range c.held {
+		shards = append(shards, shard)
+	}
+	sort.Ints(shards)
+	return shards
+}
+
+func (c *Manager) isHeld(shard int) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	_, ok := c.held[shard]
+	return ok
+}
+
+func (c *Manager) hold(shard int, expiresAt time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if l, ok := c.held[shard]; ok {
+		l.expiresAt = expiresAt
+		return
+	}
+	c.held[shard] = &heldLease{expiresAt: expiresAt}
+}
+
+// drop stops signing of the shard immediately
+func (c *Manager) drop(shard int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if l, ok := c.held[shard]; ok {
+		if l.cancel != nil {
+			l.cancel()
+		}
+		delete(c.held, shard)
+	}
+}
+
+// dropExpired stops signing of shards which leases
+// were not renewed in time, e.g. mongo is not available
+func (c *Manager) dropExpired() {
+	now := time.Now()
+	for _, shard := range c.heldShards() {
+		c.mu.Lock()
+		expired := !c.held[shard].expiresAt.After(now)
+		c.mu.Unlock()
+		if expired {
+			log.Printf("WARN: lease expired, member: %v, shard: %v", c.member, shard)
+			c.drop(shard)
+		}
+	}
+}
+
+// releaseAll releases all held leases, so other members
+// can claim them without waiting for expiration
+func (c *Manager) releaseAll() {
+	ctx, cancel := context.WithTimeout(context.Background(), c.ttl)
+	defer cancel()
+	for _, shard := range c.heldShards() {
+		c.drop(shard)
+		if err := c.store.ReleaseLease(ctx, shard, c.member); err != nil {
+			log.Printf("ERROR: failed to release lease, member: %v, shard: %v, error: %v",
+				c.member, shard, err)
+		}
+	}
+}
@@ -0,0 +1,134 @@
+package merkle
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+// leaves and nodes are hashed with different prefixes,
+// so a node can't be passed off as a leaf
+var (
+	leafPrefix = []byte{0}
+	nodePrefix = []byte{1}
+)
+
+// ProofStep is a sibling hash on the path from leaf to root
+type ProofStep struct {
+	Hash []byte
+	// Left is true if sibling is the left node
+	Left bool
+}
+
+// Tree is a binary keccak256 merkle tree,
+// the last node of a level with odd number of nodes is promoted to the next level
+type Tree struct {
+	levels [][][]byte
+}
+
+// LeafHash hashes leaf data
+func LeafHash(parts ...[]byte) []byte {
+	return crypto.Keccak256(append([][]byte{leafPrefix}, parts...)...)
+}
+
+func nodeHash(left []byte, right []byte) []byte {
+	return crypto.Keccak256(nodePrefix, left, right)
+}
+
+// NewTree builds tree over leaf hashes
+func NewTree(leaves [][]byte) (*Tree, error) {
+	if len(leaves) == 0 {
+		return nil, fmt.Errorf("merkle tree requires at least one leaf")
+	}
+	levels := [][][]byte{leaves}
+	for level := leaves; len(level) > 1; {
+		var next [][]byte
+		for i := 0; i < len(level); i += 2 {
+			if i+1 == len(level) {
+				next = append(next, level[i])
+				continue
+			}
+			next = append(next, nodeHash(level[i], level[i+1]))
+		}
+		levels = append(levels, next)
+		level = next
+	}
+	return &Tree{levels: levels}, nil
+}
+
+// Root returns root hash of the tree
+func (c *Tree) Root() []byte {
+	return c.levels[len(c.levels)-1][0]
+}
+
+// Proof returns inclusion proof of leaf i
+func (c *Tree) Proof(i int) []ProofStep {
+	var proof []ProofStep
+	for _, level := range c.levels[:len(c.levels)-1] {
+		if i%2 == 1 {
+			proof = append(proof, ProofStep{Hash: level[i-1], Left: true})
+		} else if i+1 < len(level) {
+			proof = append(proof, ProofStep{Hash: level[i+1]})
+		}
+		i /= 2
+	}
+	return proof
+}
+
+// Verify checks that leaf is included into tree with root
+func Verify(root []byte, leaf []byte, proof []ProofStep) bool {
+	hash := leaf
+	for _, step := range proof {
+		if step.Left {
+			hash = nodeHash(step.Hash, hash)
+		} else {
+			hash = nodeHash(hash, step.Hash)
+		}
+	}
+	return bytes.Equal(hash, root)
+}
+
+// EncodeProof encodes proof as strings "l:<hex>" or "r:<hex>"
+// by side of the sibling
+func EncodeProof(proof []ProofStep) []string {
+	encoded := []string{}
+	for _, step := range proof {
+		side := "r:"
+		if step.Left {
+			side = "l:"
+		}
+		encoded = append(encoded, side+hexutil.Encode(step.Hash))
+	}
+	return encoded
+}
+
+// DecodeProof decodes proof encoded by EncodeProof
+func DecodeProof(encoded []string) ([]ProofStep, error) {
+	var proof []ProofStep
+	for _, s := range encoded {
+		var step ProofStep
+		switch {
+		case strings.HasPrefix(s, "l:"):
+			step.Left = true
+		case strings.HasPrefix(s, "r:"):
+		default:
+			return nil, fmt.Errorf("invalid proof step: %v", s)
+		}
+		hash, err := hexutil.Decode(s[2:])
+		if err != nil {
+			return nil, fmt.Errorf("invalid proof step: %v", s)
+		}
+		step.Hash = hash
+		proof = append(proof, step)
+	}
+	return proof, nil
+}
+
+// RecordLeaf is a leaf hash of a signed record,
+// record id is hashed separately from salted message
+func RecordLeaf(id string, salt string, msg string) []byte {
+	return LeafHash(crypto.Keccak256([]byte(id)), crypto.Keccak256([]byte(salt+msg)))
+}
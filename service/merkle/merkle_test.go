@@ -0,0 +1,72 @@
+package merkle
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestProofs(t *testing.T) {
+	// odd levels promote their last node
+	for n := 1; n <= 7; n++ {
+		var leaves [][]byte
+		for i := 0; i < n; i++ {
+			leaves = append(leaves, RecordLeaf(fmt.Sprint(i), fmt.Sprint(i), "message"))
+		}
+		tree, err := NewTree(leaves)
+		if err != nil {
+			t.Fatal(err)
+		}
+		root := tree.Root()
+		for i, leaf := range leaves {
+			proof, err := DecodeProof(EncodeProof(tree.Proof(i)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !Verify(root, leaf, proof) {
+				t.Errorf("leaves: %v, proof of leaf %v is not valid", n, i)
+			}
+			if n > 1 && Verify(root, leaves[(i+1)%n], proof) {
+				t.Errorf("leaves: %v, proof of leaf %v is valid for leaf %v", n, i, (i+1)%n)
+			}
+		}
+	}
+}
+
+func TestVerifyTamperedRoot(t *testing.T) {
+	leaves := [][]byte{LeafHash([]byte("a")), LeafHash([]byte("b")), LeafHash([]byte("c"))}
+	tree, err := NewTree(leaves)
+	if err != nil {
+		t.Fatal(err)
+	}
+	root := append([]byte{}, tree.Root()...)
+	root[0] ^= 1
+	if Verify(root, leaves[0], tree.Proof(0)) {
+		t.Errorf("proof is valid for tampered root")
+	}
+}
+
+func TestLeafIsNotNode(t *testing.T) {
+	a, b := LeafHash([]byte("a")), LeafHash([]byte("b"))
+	tree, err := NewTree([][]byte{a, b})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// root of two leaves must not be a leaf over their concatenation
+	if Verify(tree.Root(), LeafHash(a, b), nil) {
+		t.Errorf("node hash equals leaf hash")
+	}
+}
+
+func TestNewTreeWithoutLeaves(t *testing.T) {
+	if _, err := NewTree(nil); err == nil {
+		t.Errorf("tree without leaves is built")
+	}
+}
+
+func TestDecodeInvalidProof(t *testing.T) {
+	for _, encoded := range []string{"x:0x01", "l:01", "l"} {
+		if _, err := DecodeProof([]string{encoded}); err == nil {
+			t.Errorf("proof step %q is decoded", encoded)
+		}
+	}
+}
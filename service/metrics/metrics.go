@@ -0,0 +1,105 @@
+package metrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const namespace = "msg_signer"
+
+var (
+	// RecordsSigned counts signed records per key and shard
+	RecordsSigned = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "records_signed_total",
+		Help:      "Number of signed records",
+	}, []string{"key", "shard"})
+
+	// SignFailures counts records which failed to sign per key
+	SignFailures = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "sign_failures_total",
+		Help:      "Number of records which failed to sign",
+	}, []string{"key"})
+
+	// BatchLatency measures time to sign and write a batch per shard
+	BatchLatency = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "batch_duration_seconds",
+		Help:      "Time to sign and write a batch",
+		Buckets:   prometheus.ExponentialBuckets(0.005, 2, 14),
+	}, []string{"shard"})
+
+	// XactAborts counts transactions which failed
+	XactAborts = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "xact_aborts_total",
+		Help:      "Number of aborted transactions",
+	})
+
+	// XactRetries counts transaction callbacks retried on transient errors
+	XactRetries = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "xact_retries_total",
+		Help:      "Number of transaction retries",
+	})
+
+	// KeyNonce is the last written nonce per key
+	KeyNonce = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "key_nonce",
+		Help:      "Current nonce of signing key",
+	}, []string{"key"})
+
+	// TxBroadcast counts broadcast transactions by status
+	TxBroadcast = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "tx_broadcast_total",
+		Help:      "Number of broadcast transactions by status",
+	}, []string{"status"})
+
+	// NonceGaps is the number of nonce gaps per key found by broadcaster
+	NonceGaps = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "nonce_gaps",
+		Help:      "Number of nonce gaps of signing key",
+	}, []string{"key"})
+
+	// DeadLetters is the number of records moved to dead letters
+	DeadLetters = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "dead_letters_total",
+		Help:      "Number of records moved to dead letters after failed sign attempts",
+	})
+
+	// BatchSize is the current adaptive batch size
+	BatchSize = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "batch_size",
+		Help:      "Current number of records read per batch",
+	})
+
+	// RecordsQuarantined is the number of records moved to quarantine because of invalid id
+	RecordsQuarantined = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "records_quarantined_total",
+		Help:      "Number of unsigned records moved to quarantine because of invalid id",
+	})
+
+	// AuditFailures is the number of committed batches which are missing in audit log
+	AuditFailures = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "audit_failures_total",
+		Help:      "Number of committed batches which failed to append to audit log",
+	})
+)
+
+// RegisterUnsignedBacklog registers gauge reporting number of unsigned records,
+// backlog is evaluated on every scrape
+func RegisterUnsignedBacklog(backlog func() float64) {
+	promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "unsigned_backlog",
+		Help:      "Number of records waiting to be signed",
+	}, backlog)
+}
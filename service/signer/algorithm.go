@@ -0,0 +1,177 @@
+package signer
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"fmt"
+
+	"github.com/btcsuite/btcd/btcec/v2"
+	"github.com/btcsuite/btcd/btcec/v2/schnorr"
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+// Algorithm is a signature algorithm of a key
+type Algorithm string
+
+const (
+	// AlgEcdsaSecp256k1 is ethereum ECDSA, key id is uncompressed public key
+	AlgEcdsaSecp256k1 Algorithm = "ecdsa-secp256k1"
+	// AlgEd25519 is Ed25519, key id is 32 bytes public key
+	AlgEd25519 Algorithm = "ed25519"
+	// AlgSchnorrSecp256k1 is BIP-340 Schnorr, key id is 32 bytes x-only public key
+	AlgSchnorrSecp256k1 Algorithm = "schnorr-secp256k1"
+)
+
+// Signer signs and verifies digests with a single algorithm,
+// keys and signatures are raw bytes in the encoding of the algorithm
+type Signer interface {
+	// GenerateKey returns a new private key
+	GenerateKey() ([]byte, error)
+	// PublicKey derives public key from private key
+	PublicKey(privateKey []byte) ([]byte, error)
+	// Sign signs 32 bytes digest, Ed25519 signs a message of any length
+	Sign(privateKey []byte, digest []byte) ([]byte, error)
+	// Verify checks signature of digest by public key
+	Verify(publicKey []byte, digest []byte, signature []byte) (bool, error)
+}
+
+// ParseAlgorithm validates algorithm, empty algorithm is ECDSA secp256k1
+func ParseAlgorithm(alg string) (Algorithm, error) {
+	if alg == "" {
+		return AlgEcdsaSecp256k1, nil
+	}
+	if _, err := SignerFor(Algorithm(alg)); err != nil {
+		return "", err
+	}
+	return Algorithm(alg), nil
+}
+
+// SignerFor returns signer of algorithm
+func SignerFor(alg Algorithm) (Signer, error) {
+	switch alg {
+	case AlgEcdsaSecp256k1:
+		return ecdsaSigner{}, nil
+	case AlgEd25519:
+		return ed25519Signer{}, nil
+	case AlgSchnorrSecp256k1:
+		return schnorrSigner{}, nil
+	default:
+		return nil, fmt.Errorf("unknown algorithm: %v", alg)
+	}
+}
+
+// ecdsaSigner produces 65 bytes [R || S || V] signatures with recovery id 0/1
+type ecdsaSigner struct{}
+
+func (ecdsaSigner) GenerateKey() ([]byte, error) {
+	privateKey, err := crypto.GenerateKey()
+	if err != nil {
+		return nil, err
+	}
+	return crypto.FromECDSA(privateKey), nil
+}
+
+func (ecdsaSigner) PublicKey(privateKey []byte) ([]byte, error) {
+	key, err := crypto.ToECDSA(privateKey)
+	if err != nil {
+		return nil, err
+	}
+	return crypto.FromECDSAPub(&key.PublicKey), nil
+}
+
+func (ecdsaSigner) Sign(privateKey []byte, digest []byte) ([]byte, error) {
+	key, err := crypto.ToECDSA(privateKey)
+	if err != nil {
+		return nil, err
+	}
+	return crypto.Sign(digest, key)
+}
+
+func (ecdsaSigner) Verify(publicKey []byte, digest []byte, signature []byte) (bool, error) {
+	if len(signature) != crypto.SignatureLength {
+		return false, fmt.Errorf("invalid signature length: %v", len(signature))
+	}
+	recovered, err := crypto.Ecrecover(digest, signature)
+	if err != nil {
+		return false, nil
+	}
+	return string(recovered) == string(publicKey), nil
+}
+
+// ed25519Signer keeps private key as 32 bytes seed
+type ed25519Signer struct{}
+
+func (ed25519Signer) GenerateKey() ([]byte, error) {
+	_, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	return privateKey.Seed(), nil
+}
+
+func (ed25519Signer) PublicKey(privateKey []byte) ([]byte, error) {
+	if len(privateKey) != ed25519.SeedSize {
+		return nil, fmt.Errorf("invalid private key length: %v", len(privateKey))
+	}
+	return ed25519.NewKeyFromSeed(privateKey).Public().(ed25519.PublicKey), nil
+}
+
+func (ed25519Signer) Sign(privateKey []byte, digest []byte) ([]byte, error) {
+	if len(privateKey) != ed25519.SeedSize {
+		return nil, fmt.Errorf("invalid private key length: %v", len(privateKey))
+	}
+	return ed25519.Sign(ed25519.NewKeyFromSeed(privateKey), digest), nil
+}
+
+func (ed25519Signer) Verify(publicKey []byte, digest []byte, signature []byte) (bool, error) {
+	if len(publicKey) != ed25519.PublicKeySize {
+		return false, fmt.Errorf("invalid public key length: %v", len(publicKey))
+	}
+	if len(signature) != ed25519.SignatureSize {
+		return false, fmt.Errorf("invalid signature length: %v", len(signature))
+	}
+	return ed25519.Verify(publicKey, digest, signature), nil
+}
+
+// schnorrSigner produces 64 bytes BIP-340 signatures
+type schnorrSigner struct{}
+
+func (schnorrSigner) GenerateKey() ([]byte, error) {
+	privateKey, err := btcec.NewPrivateKey()
+	if err != nil {
+		return nil, err
+	}
+	return privateKey.Serialize(), nil
+}
+
+func (schnorrSigner) PublicKey(privateKey []byte) ([]byte, error) {
+	if len(privateKey) != btcec.PrivKeyBytesLen {
+		return nil, fmt.Errorf("invalid private key length: %v", len(privateKey))
+	}
+	key, _ := btcec.PrivKeyFromBytes(privateKey)
+	return schnorr.SerializePubKey(key.PubKey()), nil
+}
+
+func (schnorrSigner) Sign(privateKey []byte, digest []byte) ([]byte, error) {
+	if len(privateKey) != btcec.PrivKeyBytesLen {
+		return nil, fmt.Errorf("invalid private key length: %v", len(privateKey))
+	}
+	key, _ := btcec.PrivKeyFromBytes(privateKey)
+	signature, err := schnorr.Sign(key, digest)
+	if err != nil {
+		return nil, err
+	}
+	return signature.Serialize(), nil
+}
+
+func (schnorrSigner) Verify(publicKey []byte, digest []byte, signature []byte) (bool, error) {
+	key, err := schnorr.ParsePubKey(publicKey)
+	if err != nil {
+		return false, fmt.Errorf("invalid public key: %v", err)
+	}
+	sig, err := schnorr.ParseSignature(signature)
+	if err != nil {
+		return false, fmt.Errorf("invalid signature: %v", err)
+	}
+	return sig.Verify(digest, key), nil
+}
@@ -0,0 +1,80 @@
+package signer
+
+import (
+	"crypto/ed25519"
+	"encoding/hex"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common/hexutil"
+)
+
+// newTestKey generates key of algorithm
+func newTestKey(t *testing.T, alg Algorithm) *SigningKey {
+	s, err := SignerFor(alg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	privateKey, err := s.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	publicKey, err := s.PublicKey(privateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &SigningKey{KeyId: hexutil.Encode(publicKey), Algorithm: alg, pk: hex.EncodeToString(privateKey)}
+}
+
+func TestSignVerifyAlgorithms(t *testing.T) {
+	for _, alg := range []Algorithm{AlgEcdsaSecp256k1, AlgEd25519, AlgSchnorrSecp256k1} {
+		key := newTestKey(t, alg)
+		sig, err := key.SignScheme(SchemeRaw, "1", "message")
+		if err != nil {
+			t.Fatalf("%v: %v", alg, err)
+		}
+		if ok, err := VerifyScheme(alg, SchemeRaw, key.KeyId, "1", "message", sig); !ok || err != nil {
+			t.Errorf("%v: signature is not valid, error: %v", alg, err)
+		}
+		// salt is a part of the signed message
+		if ok, _ := VerifyScheme(alg, SchemeRaw, key.KeyId, "2", "message", sig); ok {
+			t.Errorf("%v: signature is valid for another salt", alg)
+		}
+		other := newTestKey(t, alg)
+		if ok, _ := VerifyScheme(alg, SchemeRaw, other.KeyId, "1", "message", sig); ok {
+			t.Errorf("%v: signature is valid for another key", alg)
+		}
+	}
+}
+
+func TestEd25519SignsMessageAsIs(t *testing.T) {
+	key := newTestKey(t, AlgEd25519)
+	sig, err := key.SignScheme(SchemeRaw, "1", "message")
+	if err != nil {
+		t.Fatal(err)
+	}
+	publicKey := hexutil.MustDecode(key.KeyId)
+	if !ed25519.Verify(publicKey, []byte("1message"), hexutil.MustDecode(sig)) {
+		t.Errorf("signature is not valid for standard Ed25519 verifier")
+	}
+
+	// signature over digest of salt+msg is not accepted
+	digest, err := Digest(SchemeRaw, "1", "message")
+	if err != nil {
+		t.Fatal(err)
+	}
+	digestSig, err := key.signDigest(digest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok, _ := VerifyScheme(AlgEd25519, SchemeRaw, key.KeyId, "1", "message", hexutil.Encode(digestSig)); ok {
+		t.Errorf("signature of digest is valid")
+	}
+}
+
+func TestSchemesRequireEcdsa(t *testing.T) {
+	for _, alg := range []Algorithm{AlgEd25519, AlgSchnorrSecp256k1} {
+		if _, err := newTestKey(t, alg).SignScheme(SchemeEIP191, "1", "message"); err == nil {
+			t.Errorf("%v: EIP-191 signature is produced", alg)
+		}
+	}
+}
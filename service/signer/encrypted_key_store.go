@@ -0,0 +1,210 @@
+package signer
+
+import (
+	"crypto/ecdsa"
+	"fmt"
+	"log"
+	"math/big"
+	"os"
+	"path"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum/accounts/keystore"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+// unlockedKey is a decrypted private key cached until expiresAt
+type unlockedKey struct {
+	privateKey *ecdsa.PrivateKey
+	expiresAt  time.Time
+}
+
+// encryptedKeyStore loads keys from a directory of Web3 Secret Storage
+// (Ethereum V3 keystore) json files. Keys are kept encrypted in memory,
+// they are decrypted on demand and zeroed once not used for unlockTtl
+type encryptedKeyStore struct {
+	passphrase string
+	unlockTtl  time.Duration
+
+	mu        sync.Mutex
+	encrypted map[string][]byte
+	unlocked  map[string]*unlockedKey
+	// stop is closed by Close, closed store doesn't cache decrypted keys
+	stop   chan struct{}
+	closed bool
+}
+
+func NewEncryptedKeyStore(dir string, passphrase string, unlockTtl time.Duration) (KeyStore, error) {
+	return newEncryptedKeyStore(dir, passphrase, unlockTtl, nil)
+}
+
+// newEncryptedKeyStore loads keystore files of dir, files which were
+// loaded by prev keep their key id, so only new files are decrypted
+func newEncryptedKeyStore(dir string, passphrase string, unlockTtl time.Duration,
+	prev *encryptedKeyStore) (*encryptedKeyStore, error) {
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	known := make(map[string]string)
+	if prev != nil {
+		prev.mu.Lock()
+		for keyId, keyJson := range prev.encrypted {
+			known[string(keyJson)] = keyId
+		}
+		prev.mu.Unlock()
+	}
+	c := &encryptedKeyStore{
+		passphrase: passphrase,
+		unlockTtl:  unlockTtl,
+		encrypted:  make(map[string][]byte),
+		unlocked:   make(map[string]*unlockedKey),
+		stop:       make(chan struct{}),
+	}
+	for _, f := range files {
+		if f.IsDir() {
+			continue
+		}
+		keyJson, err := os.ReadFile(path.Join(dir, f.Name()))
+		if err != nil {
+			return nil, err
+		}
+		if keyId, ok := known[string(keyJson)]; ok {
+			c.encrypted[keyId] = keyJson
+			continue
+		}
+		// keystore file contains only address, decrypt it once
+		// to get public key which is used as key id
+		key, err := keystore.DecryptKey(keyJson, passphrase)
+		if err != nil {
+			return nil, fmt.Errorf("cannot decrypt key file %v: %v", f.Name(), err)
+		}
+		keyId := hexutil.Encode(crypto.FromECDSAPub(&key.PrivateKey.PublicKey))
+		zeroKey(key.PrivateKey)
+		c.encrypted[keyId] = keyJson
+	}
+	log.Printf("INFO: loaded %v encrypted keys from %v", len(c.encrypted), dir)
+	go c.lockExpired()
+	return c, nil
+}
+
+// Close stops expiration of decrypted keys and zeroes them, keys of
+// closed store are still served but are decrypted on every request
+func (c *encryptedKeyStore) Close() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return
+	}
+	c.closed = true
+	close(c.stop)
+	for keyId, unlocked := range c.unlocked {
+		zeroKey(unlocked.privateKey)
+		delete(c.unlocked, keyId)
+	}
+}
+
+func (c *encryptedKeyStore) GetKeyById(keyId string) (*SigningKey, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	keyJson, ok := c.encrypted[keyId]
+	if !ok {
+		return nil, fmt.Errorf("Cannot find key")
+	}
+	if c.closed {
+		key, err := keystore.DecryptKey(keyJson, c.passphrase)
+		if err != nil {
+			return nil, err
+		}
+		return &SigningKey{
+			KeyId:      keyId,
+			Algorithm:  AlgEcdsaSecp256k1,
+			privateKey: key.PrivateKey,
+			owned:      true,
+		}, nil
+	}
+	unlocked, ok := c.unlocked[keyId]
+	if !ok {
+		key, err := keystore.DecryptKey(keyJson, c.passphrase)
+		if err != nil {
+			return nil, err
+		}
+		unlocked = &unlockedKey{privateKey: key.PrivateKey}
+		c.unlocked[keyId] = unlocked
+	}
+	unlocked.expiresAt = time.Now().Add(c.unlockTtl)
+	return &SigningKey{
+		KeyId:      keyId,
+		Algorithm:  AlgEcdsaSecp256k1,
+		privateKey: copyKey(unlocked.privateKey),
+		owned:      true,
+	}, nil
+}
+
+// GetKeyAlgorithm returns algorithm of key, keystore files hold ECDSA keys only
+func (c *encryptedKeyStore) GetKeyAlgorithm(keyId string) (Algorithm, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.encrypted[keyId]; !ok {
+		return "", fmt.Errorf("Cannot find key")
+	}
+	return AlgEcdsaSecp256k1, nil
+}
+
+// GetKeyIds returns key ids sorted, so all signers see the same key order
+func (c *encryptedKeyStore) GetKeyIds() ([]string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var keys []string
+	for k := range c.encrypted {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+// lockExpired zeroes decrypted keys which were not used for unlockTtl
+func (c *encryptedKeyStore) lockExpired() {
+	interval := c.unlockTtl / 2
+	if interval < time.Second {
+		interval = time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.stop:
+			return
+		case <-ticker.C:
+		}
+		now := time.Now()
+		c.mu.Lock()
+		for keyId, unlocked := range c.unlocked {
+			if now.After(unlocked.expiresAt) {
+				zeroKey(unlocked.privateKey)
+				delete(c.unlocked, keyId)
+			}
+		}
+		c.mu.Unlock()
+	}
+}
+
+// copyKey returns a copy of private key, so the cached key
+// can be zeroed while the copy is still in use
+func copyKey(k *ecdsa.PrivateKey) *ecdsa.PrivateKey {
+	return &ecdsa.PrivateKey{
+		PublicKey: k.PublicKey,
+		D:         new(big.Int).Set(k.D),
+	}
+}
+
+// zeroKey overwrites private key material
+func zeroKey(k *ecdsa.PrivateKey) {
+	b := k.D.Bits()
+	for i := range b {
+		b[i] = 0
+	}
+}
@@ -0,0 +1,57 @@
+package signer
+
+import (
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/accounts/keystore"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/google/uuid"
+)
+
+// newTestEncryptedKeyStore writes a keystore file of a new ECDSA key
+// and returns key store of its directory and key id
+func newTestEncryptedKeyStore(t *testing.T) (*encryptedKeyStore, string) {
+	privateKey, err := crypto.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyJson, err := keystore.EncryptKey(&keystore.Key{
+		Id:         uuid.New(),
+		Address:    crypto.PubkeyToAddress(privateKey.PublicKey),
+		PrivateKey: privateKey,
+	}, "secret", keystore.LightScryptN, keystore.LightScryptP)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	if err := os.WriteFile(path.Join(dir, "key.json"), keyJson, 0600); err != nil {
+		t.Fatal(err)
+	}
+	c, err := newEncryptedKeyStore(dir, "secret", time.Minute, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(c.Close)
+	return c, hexutil.Encode(crypto.FromECDSAPub(&privateKey.PublicKey))
+}
+
+func TestEncryptedKeyAlgorithm(t *testing.T) {
+	c, keyId := newTestEncryptedKeyStore(t)
+	alg, err := c.GetKeyAlgorithm(keyId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if alg != AlgEcdsaSecp256k1 {
+		t.Errorf("got algorithm %v, want %v", alg, AlgEcdsaSecp256k1)
+	}
+	if len(c.unlocked) != 0 {
+		t.Errorf("key is decrypted to read its algorithm")
+	}
+	if _, err := c.GetKeyAlgorithm("0x00"); err == nil {
+		t.Errorf("algorithm of unknown key is returned")
+	}
+}
@@ -6,9 +6,9 @@ import (
 	"github.com/ethereum/go-ethereum/common/hexutil"
 	"github.com/ethereum/go-ethereum/crypto"
 	"github.com/rovechkin1/message-sign/service/config"
-	"log"
 	"os"
 	"path"
+	"sort"
 	"strings"
 )
 
@@ -19,8 +19,10 @@ type fileKeyStore struct {
 func NewFileKeyStore() (KeyStore, error) {
 	content, err := os.ReadFile(path.Join(config.GetKeysDir(), "keys.csv"))
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
+	// each line is key id, private key and optional algorithm,
+	// ECDSA secp256k1 is used if algorithm is not set
 	lines := strings.Split(string(content), "\n")
 	keys := map[string]SigningKey{}
 	for _, l := range lines {
@@ -28,10 +30,26 @@ func NewFileKeyStore() (KeyStore, error) {
 		if len(ks) < 2 {
 			continue
 		}
-		keys[ks[0]] = SigningKey{
-			KeyId: ks[0],
-			pk:    ks[1][2:],
+		alg := AlgEcdsaSecp256k1
+		if len(ks) > 2 {
+			alg, err = ParseAlgorithm(ks[2])
+			if err != nil {
+				return nil, err
+			}
 		}
+		key := SigningKey{
+			KeyId:     ks[0],
+			Algorithm: alg,
+			pk:        ks[1][2:],
+		}
+		// parse ECDSA key once instead of on every signature
+		if alg == AlgEcdsaSecp256k1 {
+			key.privateKey, err = crypto.HexToECDSA(key.pk)
+			if err != nil {
+				return nil, fmt.Errorf("invalid private key of %v, error: %v", key.KeyId, err)
+			}
+		}
+		keys[ks[0]] = key
 	}
 	return &fileKeyStore{
 		keys: keys,
@@ -73,10 +91,19 @@ func (c *fileKeyStore) GetKeyById(keyId string) (*SigningKey, error) {
 	return nil, fmt.Errorf("Cannot find key")
 }
 
+func (c *fileKeyStore) GetKeyAlgorithm(keyId string) (Algorithm, error) {
+	if key, ok := c.keys[keyId]; ok {
+		return key.Algorithm, nil
+	}
+	return "", fmt.Errorf("Cannot find key")
+}
+
+// GetKeyIds returns key ids sorted, so all signers see the same key order
 func (c *fileKeyStore) GetKeyIds() ([]string, error) {
 	var keys []string
 	for k, _ := range c.keys {
 		keys = append(keys, k)
 	}
+	sort.Strings(keys)
 	return keys, nil
 }
@@ -0,0 +1,307 @@
+package signer
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// KeyEventType is a type of key set change
+type KeyEventType string
+
+const (
+	// KeyAdded key appeared in key source
+	KeyAdded KeyEventType = "added"
+	// KeyRetired key was removed from key source, it is no longer
+	// listed by GetKeyIds but can still be read by GetKeyById
+	KeyRetired KeyEventType = "retired"
+)
+
+// KeyEvent is a change of key set
+type KeyEvent struct {
+	Type    KeyEventType
+	KeyId   string
+	Version int64
+}
+
+// KeyWatcher is implemented by key stores which reload keys from their source
+type KeyWatcher interface {
+	// Version is a version of key set, it is incremented on every change
+	Version() int64
+	// RetiredKeyIds returns ids of keys removed from source
+	RetiredKeyIds() []string
+	// Subscribe returns channel which delivers key set changes,
+	// events are dropped if subscriber doesn't keep up, use Version to resync
+	Subscribe() <-chan KeyEvent
+	// Drained tells that subscriber no longer uses keys retired up to version,
+	// store of retired keys is closed once every subscriber drained them
+	Drained(sub <-chan KeyEvent, version int64)
+}
+
+// reloadingKeyStore polls fingerprint of key source and reloads
+// keys when it changes. Retired keys are served by the store
+// they were loaded with, so in-flight batches can finish with them
+type reloadingKeyStore struct {
+	load        func() (KeyStore, error)
+	fingerprint func() (string, error)
+
+	mu          sync.Mutex
+	current     KeyStore
+	active      map[string]bool
+	retired     map[string]KeyStore
+	version     int64
+	source      string
+	subscribers []chan KeyEvent
+	// drained is the last version drained by each subscriber
+	drained map[<-chan KeyEvent]int64
+	// draining are replaced stores which serve retired keys,
+	// they are closed when every subscriber drained their version
+	draining []drainingStore
+}
+
+// drainingStore is a replaced store and version which retired its keys
+type drainingStore struct {
+	store   KeyStore
+	version int64
+}
+
+// NewReloadingKeyStore loads keys and reloads them every interval
+// if fingerprint of key source changes
+func NewReloadingKeyStore(load func() (KeyStore, error), fingerprint func() (string, error),
+	interval time.Duration) (KeyStore, error) {
+	source, err := fingerprint()
+	if err != nil {
+		return nil, err
+	}
+	current, err := load()
+	if err != nil {
+		return nil, err
+	}
+	keyIds, err := current.GetKeyIds()
+	if err != nil {
+		return nil, err
+	}
+	c := &reloadingKeyStore{
+		load:        load,
+		fingerprint: fingerprint,
+		current:     current,
+		active:      make(map[string]bool),
+		retired:     make(map[string]KeyStore),
+		version:     1,
+		source:      source,
+		drained:     make(map[<-chan KeyEvent]int64),
+	}
+	for _, keyId := range keyIds {
+		c.active[keyId] = true
+	}
+	go c.watch(interval)
+	return c, nil
+}
+
+func (c *reloadingKeyStore) watch(interval time.Duration) {
+	for range time.Tick(interval) {
+		if err := c.reload(); err != nil {
+			log.Printf("ERROR: failed to reload keys, error: %v", err)
+		}
+	}
+}
+
+// reload loads keys if key source changed and publishes changes of key set
+func (c *reloadingKeyStore) reload() error {
+	source, err := c.fingerprint()
+	if err != nil {
+		return err
+	}
+	c.mu.Lock()
+	changed := source != c.source
+	c.mu.Unlock()
+	if !changed {
+		return nil
+	}
+
+	next, err := c.load()
+	if err != nil {
+		return err
+	}
+	keyIds, err := next.GetKeyIds()
+	if err != nil {
+		closeStore(next)
+		return err
+	}
+	active := make(map[string]bool)
+	for _, keyId := range keyIds {
+		active[keyId] = true
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var events []KeyEvent
+	for keyId := range active {
+		if !c.active[keyId] {
+			delete(c.retired, keyId)
+			events = append(events, KeyEvent{Type: KeyAdded, KeyId: keyId})
+		}
+	}
+	retired := false
+	for keyId := range c.active {
+		if !active[keyId] {
+			c.retired[keyId] = c.current
+			retired = true
+			events = append(events, KeyEvent{Type: KeyRetired, KeyId: keyId})
+		}
+	}
+	prev := c.current
+	c.source = source
+	c.current = next
+	c.active = active
+	if len(events) == 0 {
+		closeStore(prev)
+		return nil
+	}
+	c.version += 1
+	// previous store only serves retired keys until they are drained
+	if retired {
+		c.draining = append(c.draining, drainingStore{store: prev, version: c.version})
+		c.closeDrained()
+	} else {
+		closeStore(prev)
+	}
+	log.Printf("INFO: reloaded keys, version: %v, active: %v, retired: %v, changes: %v",
+		c.version, len(c.active), len(c.retired), len(events))
+	for _, event := range events {
+		event.Version = c.version
+		for _, sub := range c.subscribers {
+			select {
+			case sub <- event:
+			default:
+			}
+		}
+	}
+	return nil
+}
+
+func (c *reloadingKeyStore) Drained(sub <-chan KeyEvent, version int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.drained[sub]; !ok {
+		return
+	}
+	c.drained[sub] = version
+	c.closeDrained()
+}
+
+// closeDrained closes replaced stores whose retired keys are drained by
+// every subscriber, all of them are closed if there are no subscribers
+func (c *reloadingKeyStore) closeDrained() {
+	var draining []drainingStore
+	for _, d := range c.draining {
+		drained := true
+		for _, version := range c.drained {
+			if version < d.version {
+				drained = false
+				break
+			}
+		}
+		if !drained {
+			draining = append(draining, d)
+			continue
+		}
+		closeStore(d.store)
+		log.Printf("INFO: closed key store of keys retired at version: %v", d.version)
+	}
+	c.draining = draining
+}
+
+func closeStore(keyStore KeyStore) {
+	if s, ok := keyStore.(closer); ok {
+		s.Close()
+	}
+}
+
+func (c *reloadingKeyStore) GetKeyById(keyId string) (*SigningKey, error) {
+	return c.storeOf(keyId).GetKeyById(keyId)
+}
+
+func (c *reloadingKeyStore) GetKeyAlgorithm(keyId string) (Algorithm, error) {
+	return c.storeOf(keyId).GetKeyAlgorithm(keyId)
+}
+
+// storeOf returns store which serves key, retired keys
+// are served by the store they were loaded with
+func (c *reloadingKeyStore) storeOf(keyId string) KeyStore {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if retired, ok := c.retired[keyId]; ok {
+		return retired
+	}
+	return c.current
+}
+
+func (c *reloadingKeyStore) GetKeyIds() ([]string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.current.GetKeyIds()
+}
+
+func (c *reloadingKeyStore) Version() int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.version
+}
+
+func (c *reloadingKeyStore) RetiredKeyIds() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var keys []string
+	for keyId := range c.retired {
+		keys = append(keys, keyId)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func (c *reloadingKeyStore) Subscribe() <-chan KeyEvent {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	sub := make(chan KeyEvent, 1024)
+	c.subscribers = append(c.subscribers, sub)
+	// subscriber doesn't use keys retired before it subscribed
+	c.drained[sub] = c.version
+	return sub
+}
+
+// fileFingerprint returns size and modification time of files,
+// directories are fingerprinted by their files
+func fileFingerprint(paths ...string) (string, error) {
+	var parts []string
+	for _, p := range paths {
+		info, err := os.Stat(p)
+		if err != nil {
+			return "", err
+		}
+		if !info.IsDir() {
+			parts = append(parts, fmt.Sprintf("%s:%d:%d", p, info.Size(), info.ModTime().UnixNano()))
+			continue
+		}
+		files, err := os.ReadDir(p)
+		if err != nil {
+			return "", err
+		}
+		for _, f := range files {
+			if f.IsDir() {
+				continue
+			}
+			fp, err := fileFingerprint(path.Join(p, f.Name()))
+			if err != nil {
+				return "", err
+			}
+			parts = append(parts, fp)
+		}
+	}
+	return strings.Join(parts, ","), nil
+}
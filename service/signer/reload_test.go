@@ -0,0 +1,70 @@
+package signer
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+// closingKeyStore is a key store which records when it is closed
+type closingKeyStore struct {
+	keyIds []string
+	closed bool
+}
+
+func (c *closingKeyStore) GetKeyById(keyId string) (*SigningKey, error) {
+	return &SigningKey{KeyId: keyId, Algorithm: AlgEcdsaSecp256k1}, nil
+}
+
+func (c *closingKeyStore) GetKeyIds() ([]string, error) {
+	return c.keyIds, nil
+}
+
+func (c *closingKeyStore) GetKeyAlgorithm(keyId string) (Algorithm, error) {
+	return AlgEcdsaSecp256k1, nil
+}
+
+func (c *closingKeyStore) Close() {
+	c.closed = true
+}
+
+func TestReloadClosesDrainedStore(t *testing.T) {
+	stores := []*closingKeyStore{{keyIds: []string{"a", "b"}}, {keyIds: []string{"a"}}, {keyIds: []string{"a"}}}
+	loaded := 0
+	load := func() (KeyStore, error) {
+		loaded += 1
+		return stores[loaded-1], nil
+	}
+	fingerprint := func() (string, error) {
+		return fmt.Sprint(loaded), nil
+	}
+	keyStore, err := NewReloadingKeyStore(load, fingerprint, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := keyStore.(*reloadingKeyStore)
+	sub := c.Subscribe()
+
+	// key b is retired, its store serves it until subscriber drains it
+	if err := c.reload(); err != nil {
+		t.Fatal(err)
+	}
+	if stores[0].closed {
+		t.Fatal("store of retired key is closed before it is drained")
+	}
+	if _, err := c.GetKeyById("b"); err != nil {
+		t.Fatal(err)
+	}
+	c.Drained(sub, c.Version())
+	if !stores[0].closed {
+		t.Error("store of drained key is not closed")
+	}
+
+	// store without retired keys is closed right away
+	if err := c.reload(); err != nil {
+		t.Fatal(err)
+	}
+	if !stores[1].closed || stores[2].closed {
+		t.Errorf("got closed %v, %v, want true, false", stores[1].closed, stores[2].closed)
+	}
+}
@@ -0,0 +1,137 @@
+package signer
+
+import (
+	"fmt"
+	"math/big"
+
+	"github.com/ethereum/go-ethereum/accounts"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/common/math"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/signer/core/apitypes"
+	"github.com/rovechkin1/message-sign/service/config"
+)
+
+// Scheme defines how salt+msg is hashed before signing
+type Scheme string
+
+const (
+	// SchemeRaw signs keccak256 of salt+msg
+	SchemeRaw Scheme = "raw"
+	// SchemeEIP191 signs salt+msg as EIP-191 personal message,
+	// signature can be checked with personal_ecRecover
+	SchemeEIP191 Scheme = "eip191"
+	// SchemeEIP712 signs salt and msg as EIP-712 typed data
+	// with domain separator from config
+	SchemeEIP712 Scheme = "eip712"
+)
+
+// eip712PrimaryType is a typed data struct of a signed message
+const eip712PrimaryType = "SignedMessage"
+
+// ParseScheme validates scheme, empty scheme is the default one from config
+func ParseScheme(scheme string) (Scheme, error) {
+	if scheme == "" {
+		scheme = config.GetSignScheme()
+	}
+	switch Scheme(scheme) {
+	case SchemeRaw, SchemeEIP191, SchemeEIP712:
+		return Scheme(scheme), nil
+	default:
+		return "", fmt.Errorf("unknown sign scheme: %v", scheme)
+	}
+}
+
+// Digest returns hash of salt+msg which is signed for scheme
+func Digest(scheme Scheme, salt string, msg string) ([]byte, error) {
+	switch scheme {
+	case SchemeRaw:
+		return crypto.Keccak256([]byte(salt + msg)), nil
+	case SchemeEIP191:
+		return accounts.TextHash([]byte(salt + msg)), nil
+	case SchemeEIP712:
+		hash, _, err := apitypes.TypedDataAndHash(typedData(salt, msg))
+		return hash, err
+	default:
+		return nil, fmt.Errorf("unknown sign scheme: %v", scheme)
+	}
+}
+
+// Payload returns bytes of salt+msg which algorithm signs for scheme.
+// Ed25519 hashes the message itself, so it signs salt+msg as is and
+// the signature is checked by standard Ed25519 verifiers, other
+// algorithms sign digest of scheme
+func Payload(alg Algorithm, scheme Scheme, salt string, msg string) ([]byte, error) {
+	if alg == AlgEd25519 && scheme == SchemeRaw {
+		return []byte(salt + msg), nil
+	}
+	return Digest(scheme, salt, msg)
+}
+
+// SignScheme signs salt+msg with scheme, EIP-191 and EIP-712 signatures
+// have recovery id 27/28 as expected by wallets and ecrecover
+func (c *SigningKey) SignScheme(scheme Scheme, salt string, msg string) (string, error) {
+	if err := checkScheme(c.Algorithm, scheme); err != nil {
+		return "", err
+	}
+	payload, err := Payload(c.Algorithm, scheme, salt, msg)
+	if err != nil {
+		return "", err
+	}
+	signature, err := c.signDigest(payload)
+	if err != nil {
+		return "", err
+	}
+	if scheme != SchemeRaw {
+		signature[crypto.RecoveryIDOffset] += 27
+	}
+	return hexutil.Encode(signature), nil
+}
+
+// checkScheme checks that scheme can be used with algorithm,
+// EIP-191 and EIP-712 are defined for ethereum keys only
+func checkScheme(alg Algorithm, scheme Scheme) error {
+	if scheme != SchemeRaw && alg != AlgEcdsaSecp256k1 {
+		return fmt.Errorf("sign scheme %v is not supported by %v keys", scheme, alg)
+	}
+	return nil
+}
+
+// typedData builds EIP-712 typed data of a signed message
+func typedData(salt string, msg string) apitypes.TypedData {
+	domain := apitypes.TypedDataDomain{
+		Name:              config.GetEip712DomainName(),
+		Version:           config.GetEip712DomainVersion(),
+		VerifyingContract: config.GetEip712VerifyingContract(),
+	}
+	// domain type lists only fields which are set
+	var domainType []apitypes.Type
+	if domain.Name != "" {
+		domainType = append(domainType, apitypes.Type{Name: "name", Type: "string"})
+	}
+	if domain.Version != "" {
+		domainType = append(domainType, apitypes.Type{Name: "version", Type: "string"})
+	}
+	if chainId := config.GetEip712ChainId(); chainId > 0 {
+		domain.ChainId = (*math.HexOrDecimal256)(big.NewInt(chainId))
+		domainType = append(domainType, apitypes.Type{Name: "chainId", Type: "uint256"})
+	}
+	if domain.VerifyingContract != "" {
+		domainType = append(domainType, apitypes.Type{Name: "verifyingContract", Type: "address"})
+	}
+	return apitypes.TypedData{
+		Types: apitypes.Types{
+			"EIP712Domain": domainType,
+			eip712PrimaryType: {
+				{Name: "salt", Type: "string"},
+				{Name: "msg", Type: "string"},
+			},
+		},
+		PrimaryType: eip712PrimaryType,
+		Domain:      domain,
+		Message: apitypes.TypedDataMessage{
+			"salt": salt,
+			"msg":  msg,
+		},
+	}
+}
@@ -0,0 +1,69 @@
+package signer
+
+import (
+	"bytes"
+	"encoding/hex"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+func TestSchnorrVector(t *testing.T) {
+	// BIP-340 test vector 0
+	privateKey, _ := hex.DecodeString("0000000000000000000000000000000000000000000000000000000000000003")
+	publicKey, _ := hex.DecodeString("f9308a019258c31049344f85f89d5229b531c845836f99b08601f113bce036f9")
+	digest := make([]byte, 32)
+	signature, _ := hex.DecodeString("e907831f80848d1069a5371b402410364bdf1c5f8307b0084c55f1ce2dca8215" +
+		"25f66a4a85ea8b71e482a74f382d2ce5ebeee8fdb2172f477df4900d310536c0")
+
+	s := schnorrSigner{}
+	derived, err := s.PublicKey(privateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(derived, publicKey) {
+		t.Errorf("got public key %x, want %x", derived, publicKey)
+	}
+	if ok, err := s.Verify(publicKey, digest, signature); !ok || err != nil {
+		t.Errorf("signature of test vector is not valid, error: %v", err)
+	}
+}
+
+func TestSchnorrSignVerify(t *testing.T) {
+	s := schnorrSigner{}
+	privateKey, err := s.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	publicKey, err := s.PublicKey(privateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(publicKey) != 32 {
+		t.Fatalf("got public key of %v bytes, want x-only 32 bytes", len(publicKey))
+	}
+	digest := crypto.Keccak256([]byte("1message"))
+	signature, err := s.Sign(privateKey, digest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(signature) != 64 {
+		t.Fatalf("got signature of %v bytes, want 64", len(signature))
+	}
+	if ok, err := s.Verify(publicKey, digest, signature); !ok || err != nil {
+		t.Errorf("signature is not valid, error: %v", err)
+	}
+	if ok, _ := s.Verify(publicKey, crypto.Keccak256([]byte("2message")), signature); ok {
+		t.Errorf("signature is valid for another digest")
+	}
+	signature[63] ^= 1
+	if ok, _ := s.Verify(publicKey, digest, signature); ok {
+		t.Errorf("tampered signature is valid")
+	}
+	if _, err := s.Verify(publicKey[:31], digest, signature); err == nil {
+		t.Errorf("short public key is accepted")
+	}
+	if _, err := s.Sign(privateKey[:31], digest); err == nil {
+		t.Errorf("short private key is accepted")
+	}
+}
@@ -1,36 +1,118 @@
 package signer
 
 import (
-	"github.com/ethereum/go-ethereum/common/hexutil"
+	"crypto/ecdsa"
+	"encoding/hex"
+	"fmt"
 	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/rovechkin1/message-sign/service/config"
+	"path"
+	"time"
 )
 
 // SigningKey contains key id, public key and private key
 type SigningKey struct {
 	KeyId string
-	pk    string
+	// Algorithm is a signature algorithm of the key
+	Algorithm Algorithm
+	pk        string
+	// privateKey is set by key stores which keep parsed keys,
+	// pk is used otherwise
+	privateKey *ecdsa.PrivateKey
+	// owned private key is a decrypted copy which is zeroed by Release
+	owned bool
+}
+
+// Release zeroes private key of key returned by encrypted key store,
+// the key can't be used afterwards. Keys shared with key store are kept
+func (c *SigningKey) Release() {
+	if c.owned && c.privateKey != nil {
+		zeroKey(c.privateKey)
+		c.privateKey = nil
+	}
+}
+
+// closer is implemented by key stores which run background goroutines
+type closer interface {
+	Close()
 }
 
 // KeyStore store of public/private key pairs
 type KeyStore interface {
 	// GetKeyById returns key by key id
 	GetKeyById(keyId string) (*SigningKey, error)
-	// GetKeyIds returns key ids
+	// GetKeyIds returns key ids in sorted order
 	GetKeyIds() ([]string, error)
+	// GetKeyAlgorithm returns algorithm of key, private key is not decrypted
+	GetKeyAlgorithm(keyId string) (Algorithm, error)
 }
 
 func (c *SigningKey) Sign(msg string) (string, error) {
-	data := []byte(msg)
-	hash := crypto.Keccak256Hash(data)
-	privateKey, err := crypto.HexToECDSA(c.pk)
+	return c.SignScheme(SchemeRaw, "", msg)
+}
+
+// signDigest signs digest with algorithm of the key,
+// Ed25519 keys sign payload of any length
+func (c *SigningKey) signDigest(digest []byte) ([]byte, error) {
+	if c.privateKey != nil {
+		return crypto.Sign(digest, c.privateKey)
+	}
+	s, err := SignerFor(c.Algorithm)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
-
-	signature, err := crypto.Sign(hash.Bytes(), privateKey)
+	privateKey, err := hex.DecodeString(c.pk)
 	if err != nil {
-		return "", err
+		return nil, err
+	}
+	return s.Sign(privateKey, digest)
+}
+
+// ecdsaKey returns parsed private key of ECDSA secp256k1 key
+func (c *SigningKey) ecdsaKey() (*ecdsa.PrivateKey, error) {
+	if c.Algorithm != AlgEcdsaSecp256k1 {
+		return nil, fmt.Errorf("key algorithm %v is not %v", c.Algorithm, AlgEcdsaSecp256k1)
+	}
+	if c.privateKey != nil {
+		return c.privateKey, nil
+	}
+	return crypto.HexToECDSA(c.pk)
+}
+
+// NewKeyStore creates key store backend selected by config,
+// keys are reloaded when their source changes if key_reload_sec is set
+func NewKeyStore() (KeyStore, error) {
+	var load func() (KeyStore, error)
+	var source string
+	switch config.GetKeyStore() {
+	case "file":
+		load = NewFileKeyStore
+		source = path.Join(config.GetKeysDir(), "keys.csv")
+	case "keystore":
+		passphrase, err := config.GetKeystorePassphrase()
+		if err != nil {
+			return nil, err
+		}
+		ttl := time.Duration(config.GetKeystoreUnlockTtlSec()) * time.Second
+		// keys which didn't change are not decrypted again on reload
+		var prev *encryptedKeyStore
+		load = func() (KeyStore, error) {
+			next, err := newEncryptedKeyStore(config.GetKeystoreDir(), passphrase, ttl, prev)
+			if err != nil {
+				return nil, err
+			}
+			prev = next
+			return next, nil
+		}
+		source = config.GetKeystoreDir()
+	default:
+		return nil, fmt.Errorf("unknown key store: %v", config.GetKeyStore())
+	}
+	interval := time.Duration(config.GetKeyReloadSec()) * time.Second
+	if interval <= 0 {
+		return load()
 	}
-	signatureHex := hexutil.Encode(signature)
-	return signatureHex, nil
+	return NewReloadingKeyStore(load, func() (string, error) {
+		return fileFingerprint(source)
+	}, interval)
 }
@@ -0,0 +1,152 @@
+package signer
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/big"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/common/math"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+// TxTemplate is an ethereum transaction without nonce,
+// nonce is filled in by the signer from the key metadata.
+// If max_fee_per_gas is set EIP-1559 transaction is created,
+// otherwise legacy EIP-155 transaction with gas_price
+type TxTemplate struct {
+	ChainId              *math.HexOrDecimal256 `json:"chain_id"`
+	To                   *common.Address       `json:"to,omitempty"`
+	Value                *math.HexOrDecimal256 `json:"value,omitempty"`
+	Data                 hexutil.Bytes         `json:"data,omitempty"`
+	Gas                  uint64                `json:"gas"`
+	GasPrice             *math.HexOrDecimal256 `json:"gas_price,omitempty"`
+	MaxFeePerGas         *math.HexOrDecimal256 `json:"max_fee_per_gas,omitempty"`
+	MaxPriorityFeePerGas *math.HexOrDecimal256 `json:"max_priority_fee_per_gas,omitempty"`
+}
+
+// ParseTxTemplate decodes and validates transaction template
+func ParseTxTemplate(msg string) (*TxTemplate, error) {
+	var tpl TxTemplate
+	if err := json.Unmarshal([]byte(msg), &tpl); err != nil {
+		return nil, fmt.Errorf("invalid tx template: %v", err)
+	}
+	if err := tpl.Validate(); err != nil {
+		return nil, err
+	}
+	return &tpl, nil
+}
+
+// Validate checks that template can be turned into a transaction
+func (c *TxTemplate) Validate() error {
+	if c.ChainId == nil || bigInt(c.ChainId).Sign() <= 0 {
+		return fmt.Errorf("invalid tx template: chain_id is required")
+	}
+	if c.Gas == 0 {
+		return fmt.Errorf("invalid tx template: gas is required")
+	}
+	if c.MaxFeePerGas == nil && c.GasPrice == nil {
+		return fmt.Errorf("invalid tx template: gas_price or max_fee_per_gas is required")
+	}
+	if c.MaxFeePerGas != nil && c.GasPrice != nil {
+		return fmt.Errorf("invalid tx template: gas_price and max_fee_per_gas are exclusive")
+	}
+	return nil
+}
+
+// NewTx creates unsigned transaction with nonce
+func (c *TxTemplate) NewTx(nonce uint64) *types.Transaction {
+	if c.MaxFeePerGas != nil {
+		return types.NewTx(&types.DynamicFeeTx{
+			ChainID:   bigInt(c.ChainId),
+			Nonce:     nonce,
+			GasTipCap: bigInt(c.MaxPriorityFeePerGas),
+			GasFeeCap: bigInt(c.MaxFeePerGas),
+			Gas:       c.Gas,
+			To:        c.To,
+			Value:     bigInt(c.Value),
+			Data:      c.Data,
+		})
+	}
+	return types.NewTx(&types.LegacyTx{
+		Nonce:    nonce,
+		GasPrice: bigInt(c.GasPrice),
+		Gas:      c.Gas,
+		To:       c.To,
+		Value:    bigInt(c.Value),
+		Data:     c.Data,
+	})
+}
+
+// SignTx fills in nonce and signs transaction, EIP-155 replay protection
+// is applied to legacy transactions
+func (c *SigningKey) SignTx(tpl *TxTemplate, nonce uint64) (*types.Transaction, error) {
+	privateKey, err := c.ecdsaKey()
+	if err != nil {
+		return nil, err
+	}
+	signer := types.LatestSignerForChainID(bigInt(tpl.ChainId))
+	return types.SignTx(tpl.NewTx(nonce), signer, privateKey)
+}
+
+// EncodeTx returns hex encoded raw transaction which can be
+// sent with eth_sendRawTransaction
+func EncodeTx(tx *types.Transaction) (string, error) {
+	raw, err := tx.MarshalBinary()
+	if err != nil {
+		return "", err
+	}
+	return hexutil.Encode(raw), nil
+}
+
+// DecodeTx decodes hex encoded raw transaction
+func DecodeTx(rawTx string) (*types.Transaction, error) {
+	raw, err := hexutil.Decode(rawTx)
+	if err != nil {
+		return nil, fmt.Errorf("invalid raw tx: %v", err)
+	}
+	tx := new(types.Transaction)
+	if err := tx.UnmarshalBinary(raw); err != nil {
+		return nil, fmt.Errorf("invalid raw tx: %v", err)
+	}
+	return tx, nil
+}
+
+// VerifyTx checks that raw transaction was signed by key keyId
+func VerifyTx(keyId string, rawTx string) (bool, error) {
+	tx, err := DecodeTx(rawTx)
+	if err != nil {
+		return false, err
+	}
+	address, err := KeyAddress(keyId)
+	if err != nil {
+		return false, err
+	}
+	sender, err := types.Sender(types.LatestSignerForChainID(tx.ChainId()), tx)
+	if err != nil {
+		return false, nil
+	}
+	return sender == address, nil
+}
+
+// KeyAddress returns ethereum account address of key keyId
+func KeyAddress(keyId string) (common.Address, error) {
+	pubBytes, err := hexutil.Decode(keyId)
+	if err != nil {
+		return common.Address{}, fmt.Errorf("invalid key: %v", err)
+	}
+	publicKey, err := crypto.UnmarshalPubkey(pubBytes)
+	if err != nil {
+		return common.Address{}, fmt.Errorf("invalid key: %v", err)
+	}
+	return crypto.PubkeyToAddress(*publicKey), nil
+}
+
+func bigInt(i *math.HexOrDecimal256) *big.Int {
+	if i == nil {
+		return new(big.Int)
+	}
+	return (*big.Int)(i)
+}
@@ -0,0 +1,93 @@
+package signer
+
+import (
+	"math/big"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/core/types"
+)
+
+// signTestTx signs transaction of template with nonce 7 and checks it with VerifyTx
+func signTestTx(t *testing.T, template string) *types.Transaction {
+	key := newTestKey(t, AlgEcdsaSecp256k1)
+	tpl, err := ParseTxTemplate(template)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tx, err := key.SignTx(tpl, 7)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rawTx, err := EncodeTx(tx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := VerifyTx(key.KeyId, rawTx); !ok || err != nil {
+		t.Errorf("transaction is not signed by key, error: %v", err)
+	}
+	if ok, _ := VerifyTx(newTestKey(t, AlgEcdsaSecp256k1).KeyId, rawTx); ok {
+		t.Errorf("transaction is signed by another key")
+	}
+	decoded, err := DecodeTx(rawTx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decoded.Hash() != tx.Hash() || decoded.Nonce() != 7 {
+		t.Errorf("got decoded tx %v with nonce %v, want %v with nonce 7", decoded.Hash(), decoded.Nonce(), tx.Hash())
+	}
+	return decoded
+}
+
+func TestSignLegacyTx(t *testing.T) {
+	tx := signTestTx(t, `{"chain_id": "5", "to": "0x0000000000000000000000000000000000000001",
+		"value": "0x10", "gas": 21000, "gas_price": "1000000000"}`)
+	if tx.Type() != types.LegacyTxType {
+		t.Errorf("got tx type %v, want legacy", tx.Type())
+	}
+	// EIP-155 replay protection binds signature to chain id
+	if !tx.Protected() || tx.ChainId().Cmp(big.NewInt(5)) != 0 {
+		t.Errorf("got protected %v, chain id %v, want protected tx of chain 5", tx.Protected(), tx.ChainId())
+	}
+	if _, err := types.Sender(types.NewEIP155Signer(big.NewInt(1)), tx); err == nil {
+		t.Errorf("sender is recovered with another chain id")
+	}
+}
+
+func TestSignDynamicFeeTx(t *testing.T) {
+	tx := signTestTx(t, `{"chain_id": "0x1", "to": "0x0000000000000000000000000000000000000001",
+		"gas": 21000, "max_fee_per_gas": "2000000000", "max_priority_fee_per_gas": "1000000000"}`)
+	if tx.Type() != types.DynamicFeeTxType {
+		t.Errorf("got tx type %v, want EIP-1559", tx.Type())
+	}
+	if tx.ChainId().Cmp(big.NewInt(1)) != 0 || tx.GasFeeCap().Cmp(big.NewInt(2000000000)) != 0 ||
+		tx.GasTipCap().Cmp(big.NewInt(1000000000)) != 0 {
+		t.Errorf("got chain id %v, fee cap %v, tip cap %v", tx.ChainId(), tx.GasFeeCap(), tx.GasTipCap())
+	}
+	if _, err := types.Sender(types.NewLondonSigner(big.NewInt(5)), tx); err == nil {
+		t.Errorf("sender is recovered with another chain id")
+	}
+}
+
+func TestInvalidTxTemplate(t *testing.T) {
+	for _, template := range []string{
+		`{"gas": 21000, "gas_price": "1"}`,
+		`{"chain_id": "0", "gas": 21000, "gas_price": "1"}`,
+		`{"chain_id": "1", "gas_price": "1"}`,
+		`{"chain_id": "1", "gas": 21000}`,
+		`{"chain_id": "1", "gas": 21000, "gas_price": "1", "max_fee_per_gas": "1"}`,
+	} {
+		if _, err := ParseTxTemplate(template); err == nil {
+			t.Errorf("template %v is accepted", template)
+		}
+	}
+}
+
+func TestSignTxRequiresEcdsa(t *testing.T) {
+	tpl, err := ParseTxTemplate(`{"chain_id": "1", "gas": 21000, "gas_price": "1"}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := newTestKey(t, AlgEd25519).SignTx(tpl, 0); err == nil {
+		t.Errorf("transaction is signed with Ed25519 key")
+	}
+}
@@ -0,0 +1,55 @@
+package signer
+
+import (
+	"fmt"
+
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+// Verify checks that signature of salt+msg was produced by key keyId.
+// keyId is a hex encoded uncompressed public key as written by key-generator
+func Verify(keyId string, salt string, msg string, sig string) (bool, error) {
+	return VerifyScheme(AlgEcdsaSecp256k1, SchemeRaw, keyId, salt, msg, sig)
+}
+
+// VerifyScheme checks signature of salt+msg produced with algorithm and scheme,
+// keyId is a hex encoded public key in the encoding of the algorithm.
+// ECDSA recovery id 27/28 is accepted as well as 0/1
+func VerifyScheme(alg Algorithm, scheme Scheme, keyId string, salt string, msg string, sig string) (bool, error) {
+	s, err := SignerFor(alg)
+	if err != nil {
+		return false, err
+	}
+	if err := checkScheme(alg, scheme); err != nil {
+		return false, err
+	}
+	signature, err := hexutil.Decode(sig)
+	if err != nil {
+		return false, fmt.Errorf("invalid signature: %v", err)
+	}
+	if alg == AlgEcdsaSecp256k1 {
+		signature = normalizeRecoveryId(signature)
+	}
+	publicKey, err := hexutil.Decode(keyId)
+	if err != nil {
+		return false, fmt.Errorf("invalid key: %v", err)
+	}
+	payload, err := Payload(alg, scheme, salt, msg)
+	if err != nil {
+		return false, err
+	}
+	return s.Verify(publicKey, payload, signature)
+}
+
+// normalizeRecoveryId returns copy of ECDSA signature with recovery id 27/28
+// changed to 0/1, signature of the caller is not changed
+func normalizeRecoveryId(signature []byte) []byte {
+	if len(signature) != crypto.SignatureLength || signature[crypto.RecoveryIDOffset] < 27 {
+		return signature
+	}
+	normalized := make([]byte, len(signature))
+	copy(normalized, signature)
+	normalized[crypto.RecoveryIDOffset] -= 27
+	return normalized
+}
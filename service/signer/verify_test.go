@@ -0,0 +1,115 @@
+package signer
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+func TestVerifyRecoveryIds(t *testing.T) {
+	key := newTestKey(t, AlgEcdsaSecp256k1)
+	sig, err := key.Sign("message")
+	if err != nil {
+		t.Fatal(err)
+	}
+	signature := hexutil.MustDecode(sig)
+	if v := signature[crypto.RecoveryIDOffset]; v > 1 {
+		t.Fatalf("got recovery id %v, want 0/1", v)
+	}
+	if ok, err := Verify(key.KeyId, "", "message", sig); !ok {
+		t.Errorf("signature with recovery id 0/1 is not valid, error: %v", err)
+	}
+	signature[crypto.RecoveryIDOffset] += 27
+	if ok, err := Verify(key.KeyId, "", "message", hexutil.Encode(signature)); !ok {
+		t.Errorf("signature with recovery id 27/28 is not valid, error: %v", err)
+	}
+	// the other recovery id recovers another public key
+	signature[crypto.RecoveryIDOffset] ^= 1
+	if ok, _ := Verify(key.KeyId, "", "message", hexutil.Encode(signature)); ok {
+		t.Errorf("signature with flipped recovery id is valid")
+	}
+}
+
+func TestNormalizeRecoveryIdCopiesSignature(t *testing.T) {
+	signature := make([]byte, crypto.SignatureLength)
+	signature[crypto.RecoveryIDOffset] = 28
+	original := append([]byte{}, signature...)
+	normalized := normalizeRecoveryId(signature)
+	if normalized[crypto.RecoveryIDOffset] != 1 {
+		t.Errorf("got recovery id %v, want 1", normalized[crypto.RecoveryIDOffset])
+	}
+	if !bytes.Equal(signature, original) {
+		t.Errorf("signature of caller is changed")
+	}
+}
+
+func TestVerifySchemes(t *testing.T) {
+	key := newTestKey(t, AlgEcdsaSecp256k1)
+	schemes := []Scheme{SchemeRaw, SchemeEIP191, SchemeEIP712}
+	for _, scheme := range schemes {
+		sig, err := key.SignScheme(scheme, "1", "message")
+		if err != nil {
+			t.Fatalf("%v: %v", scheme, err)
+		}
+		for _, other := range schemes {
+			ok, err := VerifyScheme(AlgEcdsaSecp256k1, other, key.KeyId, "1", "message", sig)
+			if err != nil || ok != (other == scheme) {
+				t.Errorf("%v signature verified with %v: got %v, error: %v", scheme, other, ok, err)
+			}
+		}
+	}
+	if _, err := VerifyScheme(AlgEcdsaSecp256k1, "unknown", key.KeyId, "1", "message", "0x00"); err == nil {
+		t.Errorf("unknown scheme is accepted")
+	}
+	if _, err := VerifyScheme(AlgEcdsaSecp256k1, SchemeRaw, key.KeyId, "1", "message", "00"); err == nil {
+		t.Errorf("signature without 0x prefix is accepted")
+	}
+}
+
+func TestEIP191Digest(t *testing.T) {
+	digest, err := Digest(SchemeEIP191, "1", "message")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// personal_sign prefixes message with its length
+	want := crypto.Keccak256([]byte(fmt.Sprintf("\x19Ethereum Signed Message:\n%d%s", len("1message"), "1message")))
+	if !bytes.Equal(digest, want) {
+		t.Errorf("got digest %x, want %x", digest, want)
+	}
+}
+
+func TestEIP712Digest(t *testing.T) {
+	t.Setenv("BS_EIP712_DOMAIN_NAME", "message-sign")
+	t.Setenv("BS_EIP712_DOMAIN_VERSION", "1")
+	t.Setenv("BS_EIP712_CHAIN_ID", "0")
+	t.Setenv("BS_EIP712_VERIFYING_CONTRACT", "")
+	digest, err := Digest(SchemeEIP712, "1", "message")
+	if err != nil {
+		t.Fatal(err)
+	}
+	keccak := func(s string) []byte {
+		return crypto.Keccak256([]byte(s))
+	}
+	// domain has only fields which are set
+	domainSeparator := crypto.Keccak256(keccak("EIP712Domain(string name,string version)"),
+		keccak("message-sign"), keccak("1"))
+	structHash := crypto.Keccak256(keccak("SignedMessage(string salt,string msg)"),
+		keccak("1"), keccak("message"))
+	want := crypto.Keccak256([]byte{0x19, 0x01}, domainSeparator, structHash)
+	if !bytes.Equal(digest, want) {
+		t.Errorf("got digest %x, want %x", digest, want)
+	}
+
+	// chain id is a part of the domain
+	t.Setenv("BS_EIP712_CHAIN_ID", "1")
+	other, err := Digest(SchemeEIP712, "1", "message")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(digest, other) {
+		t.Errorf("digest doesn't depend on chain id")
+	}
+}
@@ -0,0 +1,42 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// ErrLeaseLost is returned when shard lease is held by another signer
+var ErrLeaseLost = errors.New("shard lease lost")
+
+// ShardLease is a claim of a signer on a shard
+type ShardLease struct {
+	Shard     int
+	Owner     string
+	ExpiresAt time.Time
+}
+
+// LeaseStore keeps shard leases and signer membership
+type LeaseStore interface {
+	// Heartbeat registers member as alive until expiresAt
+	Heartbeat(ctx context.Context, member string, expiresAt time.Time) error
+
+	// LiveMembers returns members which heartbeat is not expired at now
+	LiveMembers(ctx context.Context, now time.Time) ([]string, error)
+
+	// ReadLeases returns all shard leases
+	ReadLeases(ctx context.Context) ([]ShardLease, error)
+
+	// AcquireLease claims or renews shard lease for owner until expiresAt.
+	// It succeeds if shard is free, expired at now or already held by owner,
+	// otherwise returns ErrLeaseLost
+	AcquireLease(ctx context.Context, shard int, owner string, now time.Time, expiresAt time.Time) error
+
+	// ReleaseLease releases shard lease held by owner
+	ReleaseLease(ctx context.Context, shard int, owner string) error
+
+	// FenceLease checks that owner still holds shard lease at now,
+	// when called within a transaction it conflicts with
+	// a concurrent lease takeover. Returns ErrLeaseLost if lease is not held
+	FenceLease(ctx context.Context, shard int, owner string, now time.Time) error
+}
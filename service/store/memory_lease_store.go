@@ -0,0 +1,92 @@
+package store
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// memoryLeaseStore keeps shard leases in memory
+// it is used for tests and local runs
+type memoryLeaseStore struct {
+	mu      sync.Mutex
+	members map[string]time.Time
+	leases  map[int]ShardLease
+}
+
+func NewMemoryLeaseStore() LeaseStore {
+	return &memoryLeaseStore{
+		members: make(map[string]time.Time),
+		leases:  make(map[int]ShardLease),
+	}
+}
+
+// Heartbeat registers member as alive until expiresAt
+func (c *memoryLeaseStore) Heartbeat(ctx context.Context, member string, expiresAt time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.members[member] = expiresAt
+	return nil
+}
+
+// LiveMembers returns members which heartbeat is not expired at now
+func (c *memoryLeaseStore) LiveMembers(ctx context.Context, now time.Time) ([]string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var members []string
+	for m, expiresAt := range c.members {
+		if expiresAt.After(now) {
+			members = append(members, m)
+		}
+	}
+	return members, nil
+}
+
+// ReadLeases returns all shard leases
+func (c *memoryLeaseStore) ReadLeases(ctx context.Context) ([]ShardLease, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var leases []ShardLease
+	for _, l := range c.leases {
+		leases = append(leases, l)
+	}
+	return leases, nil
+}
+
+// AcquireLease claims or renews shard lease for owner until expiresAt
+func (c *memoryLeaseStore) AcquireLease(ctx context.Context, shard int, owner string,
+	now time.Time, expiresAt time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	l, ok := c.leases[shard]
+	if ok && l.Owner != owner && l.ExpiresAt.After(now) {
+		return ErrLeaseLost
+	}
+	c.leases[shard] = ShardLease{
+		Shard:     shard,
+		Owner:     owner,
+		ExpiresAt: expiresAt,
+	}
+	return nil
+}
+
+// ReleaseLease releases shard lease held by owner
+func (c *memoryLeaseStore) ReleaseLease(ctx context.Context, shard int, owner string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if l, ok := c.leases[shard]; ok && l.Owner == owner {
+		delete(c.leases, shard)
+	}
+	return nil
+}
+
+// FenceLease checks that owner still holds shard lease at now
+func (c *memoryLeaseStore) FenceLease(ctx context.Context, shard int, owner string, now time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	l, ok := c.leases[shard]
+	if !ok || l.Owner != owner || !l.ExpiresAt.After(now) {
+		return ErrLeaseLost
+	}
+	return nil
+}
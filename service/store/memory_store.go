@@ -0,0 +1,615 @@
+package store
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/rovechkin1/message-sign/service/config"
+	"github.com/rovechkin1/message-sign/service/metrics"
+)
+
+// memoryStore is an in-memory implementation of MessageStore
+// it follows semantics of mongoStore and is used for tests and local runs
+type memoryStore struct {
+	// xactMu serializes transactions with all other operations
+	xactMu sync.Mutex
+	mu     sync.Mutex
+
+	unsigned   map[string]Record
+	signed     map[string]Record
+	dead       map[string]Record
+	quarantine map[string]QuarantinedRecord
+	keys       map[string]SigningKeyMetadata
+	keyIdx     map[string]int
+	owners     map[string]KeyOwner
+	batches    map[string]MerkleBatch
+	audit      []AuditEntry
+
+	watchMu  sync.Mutex
+	watchers map[chan int64]bool
+}
+
+// memoryXactKey marks context of an active in-memory transaction
+type memoryXactKey struct{}
+
+func NewMemoryStore() MessageStore {
+	return &memoryStore{
+		unsigned:   make(map[string]Record),
+		signed:     make(map[string]Record),
+		dead:       make(map[string]Record),
+		quarantine: make(map[string]QuarantinedRecord),
+		keys:       make(map[string]SigningKeyMetadata),
+		keyIdx:     make(map[string]int),
+		owners:     make(map[string]KeyOwner),
+		batches:    make(map[string]MerkleBatch),
+		watchers:   make(map[chan int64]bool),
+	}
+}
+
+// lock locks the store, operations called outside
+// of a transaction wait for the active transaction to finish
+func (c *memoryStore) lock(ctx context.Context) func() {
+	if ctx.Value(memoryXactKey{}) == c {
+		c.mu.Lock()
+		return c.mu.Unlock
+	}
+	c.xactMu.Lock()
+	c.mu.Lock()
+	return func() {
+		c.mu.Unlock()
+		c.xactMu.Unlock()
+	}
+}
+
+// GetRecordCount records in store which are signed
+func (c *memoryStore) GetRecordCount(ctx context.Context, signed bool) (int, error) {
+	defer c.lock(ctx)()
+	if signed {
+		return len(c.signed), nil
+	}
+	return len(c.unsigned), nil
+}
+
+// ReadBatch reads up to limit messages in batch sorted by id
+// For batch selection use sharding such that ShardOf(shardKey, batchCount) == batchId
+func (c *memoryStore) ReadBatch(ctx context.Context,
+	batchId int, batchCount int, algorithm string, limit int) ([]Record, error) {
+	defer c.lock(ctx)()
+
+	var records []Record
+	for _, r := range c.unsigned {
+		if !isAlgorithm(r.Algorithm, algorithm) {
+			continue
+		}
+		inShard, err := isInShard(r.Id, batchId, batchCount)
+		if err != nil {
+			log.Printf("WARN: failed to convert record id, error: %v, skip the record until it is quarantined", err)
+			continue
+		}
+		if inShard {
+			records = append(records, r)
+		}
+	}
+	sort.Slice(records, func(i, j int) bool {
+		return records[i].Id < records[j].Id
+	})
+	if limit > 0 && len(records) > limit {
+		records = records[:limit]
+	}
+	return records, nil
+}
+
+// InsertRecords inserts new unsigned records
+func (c *memoryStore) InsertRecords(ctx context.Context, records []Record) error {
+	defer c.lock(ctx)()
+
+	seen := make(map[string]bool)
+	for _, record := range records {
+		if err := ValidateRecordId(record.Id); err != nil {
+			return err
+		}
+		_, pending := c.unsigned[record.Id]
+		_, signed := c.signed[record.Id]
+		_, dead := c.dead[record.Id]
+		if seen[record.Id] || pending || signed || dead {
+			return fmt.Errorf("%w: %v", ErrDuplicateRecord, record.Id)
+		}
+		seen[record.Id] = true
+	}
+	for _, record := range records {
+		c.unsigned[record.Id] = Record{
+			Id:        record.Id,
+			Msg:       record.Msg,
+			Type:      record.Type,
+			Scheme:    record.Scheme,
+			Algorithm: record.Algorithm,
+		}
+		shardKey, _ := ShardKey(record.Id)
+		c.notifyInsert(shardKey)
+	}
+	return nil
+}
+
+// GetRecord returns record by id and its signing status
+func (c *memoryStore) GetRecord(ctx context.Context, id string) (*Record, RecordStatus, error) {
+	defer c.lock(ctx)()
+	if r, ok := c.signed[id]; ok {
+		return &r, RecordSigned, nil
+	}
+	if r, ok := c.unsigned[id]; ok {
+		return &r, RecordPending, nil
+	}
+	if r, ok := c.dead[id]; ok {
+		return &r, RecordDeadLetter, nil
+	}
+	return nil, RecordUnknown, nil
+}
+
+// ScanSignedRecords calls fn for every signed record
+func (c *memoryStore) ScanSignedRecords(ctx context.Context, fn func(record Record) error) error {
+	unlock := c.lock(ctx)
+	var records []Record
+	for _, r := range c.signed {
+		records = append(records, r)
+	}
+	unlock()
+
+	for _, r := range records {
+		if err := fn(r); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// WriteRecord writes a single record
+func (c *memoryStore) WriteRecord(ctx context.Context, record Record) error {
+	defer c.lock(ctx)()
+	c.signed[record.Id] = record
+	delete(c.unsigned, record.Id)
+	return nil
+}
+
+// WriteBatch writes records as a batch
+func (c *memoryStore) WriteBatch(ctx context.Context, records []Record) error {
+	defer c.lock(ctx)()
+	for _, record := range records {
+		c.signed[record.Id] = record
+	}
+
+	// simulate test failure
+	testFailureRatePct := config.GetTestSignFailureRatePct()
+	if randGenerator.Intn(100) < testFailureRatePct {
+		return fmt.Errorf("ERROR: This is a test failure")
+	}
+
+	// record is saved, can remove it from usigned collection
+	for _, record := range records {
+		delete(c.unsigned, record.Id)
+	}
+	return nil
+}
+
+// WriteSignFailure increments attempts of unsigned record
+func (c *memoryStore) WriteSignFailure(ctx context.Context, id string, reason string) (int, error) {
+	defer c.lock(ctx)()
+	r, ok := c.unsigned[id]
+	if !ok {
+		return 0, ErrNotFound
+	}
+	r.Attempts += 1
+	r.LastError = reason
+	c.unsigned[id] = r
+	return r.Attempts, nil
+}
+
+// WriteDeadLetter moves unsigned record to dead letters
+func (c *memoryStore) WriteDeadLetter(ctx context.Context, record Record) error {
+	defer c.lock(ctx)()
+	c.dead[record.Id] = Record{
+		Id:        record.Id,
+		Msg:       record.Msg,
+		Type:      record.Type,
+		Scheme:    record.Scheme,
+		Algorithm: record.Algorithm,
+		Attempts:  record.Attempts,
+		LastError: record.LastError,
+	}
+	delete(c.unsigned, record.Id)
+	return nil
+}
+
+// ListDeadLetters reads up to limit dead letters sorted by id
+func (c *memoryStore) ListDeadLetters(ctx context.Context, limit int) ([]Record, error) {
+	defer c.lock(ctx)()
+	var records []Record
+	for _, r := range c.dead {
+		records = append(records, r)
+	}
+	sort.Slice(records, func(i, j int) bool {
+		return records[i].Id < records[j].Id
+	})
+	if limit > 0 && len(records) > limit {
+		records = records[:limit]
+	}
+	return records, nil
+}
+
+// RequeueDeadLetter moves dead letter back to unsigned records
+func (c *memoryStore) RequeueDeadLetter(ctx context.Context, id string) error {
+	defer c.lock(ctx)()
+	r, ok := c.dead[id]
+	if !ok {
+		return ErrNotFound
+	}
+	r.Attempts = 0
+	r.LastError = ""
+	c.unsigned[id] = r
+	delete(c.dead, id)
+	shardKey, _ := ShardKey(id)
+	c.notifyInsert(shardKey)
+	return nil
+}
+
+// SweepRecords moves unsigned records with invalid ids to quarantine,
+// shard key of in-memory records is computed when batch is read
+func (c *memoryStore) SweepRecords(ctx context.Context, limit int) (int, error) {
+	defer c.lock(ctx)()
+	n := 0
+	for id, r := range c.unsigned {
+		if limit > 0 && n >= limit {
+			break
+		}
+		err := ValidateRecordId(id)
+		if err == nil {
+			continue
+		}
+		c.quarantine[id] = QuarantinedRecord{
+			Id:            id,
+			Msg:           r.Msg,
+			Reason:        err.Error(),
+			QuarantinedAt: time.Now().UTC(),
+		}
+		delete(c.unsigned, id)
+		n += 1
+	}
+	return n, nil
+}
+
+// ListQuarantine reads up to limit quarantined records sorted by id
+func (c *memoryStore) ListQuarantine(ctx context.Context, limit int) ([]QuarantinedRecord, error) {
+	defer c.lock(ctx)()
+	var records []QuarantinedRecord
+	for _, r := range c.quarantine {
+		records = append(records, r)
+	}
+	sort.Slice(records, func(i, j int) bool {
+		return records[i].Id < records[j].Id
+	})
+	if limit > 0 && len(records) > limit {
+		records = records[:limit]
+	}
+	return records, nil
+}
+
+// ReadSigningKeyMetadata reads metadata of signing key
+func (c *memoryStore) ReadSigningKeyMetadata(ctx context.Context, keyId string) (*SigningKeyMetadata, error) {
+	defer c.lock(ctx)()
+	md, ok := c.keys[keyId]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return &md, nil
+}
+
+// WriteSigningKeyMetadata upserts key metadata
+func (c *memoryStore) WriteSigningKeyMetadata(ctx context.Context, keyMetadata *SigningKeyMetadata) error {
+	defer c.lock(ctx)()
+	c.keys[keyMetadata.Id] = *keyMetadata
+	return nil
+}
+
+// ListSigningKeyMetadata reads metadata of all signing keys
+func (c *memoryStore) ListSigningKeyMetadata(ctx context.Context) ([]SigningKeyMetadata, error) {
+	defer c.lock(ctx)()
+	var keys []SigningKeyMetadata
+	for _, md := range c.keys {
+		keys = append(keys, md)
+	}
+	return keys, nil
+}
+
+// ReserveNonceRange atomically advances key nonces and marks the range as reserved
+func (c *memoryStore) ReserveNonceRange(ctx context.Context, keyId string, nonce int64, count int64,
+	txNonce int64, txCount int64) error {
+	defer c.lock(ctx)()
+	md, ok := c.keys[keyId]
+	if !ok {
+		md = *NewSigningKeyMetadata(keyId)
+	}
+	if md.Nonce != nonce || md.TxNonce != txNonce || md.Reserved() {
+		return fmt.Errorf("%w: %v, expected nonce: %v, tx nonce: %v, nonce: %v, tx nonce: %v, reserved to: %v",
+			ErrNonceConflict, keyId, nonce, txNonce, md.Nonce, md.TxNonce, md.ReservedTo)
+	}
+	md.Nonce += count
+	md.TxNonce += txCount
+	md.ReservedFrom = nonce
+	md.ReservedTo = nonce + count
+	md.ReservedTxFrom = txNonce
+	c.keys[keyId] = md
+	return nil
+}
+
+// CommitNonceRange clears reservation of key and sets key nonces
+func (c *memoryStore) CommitNonceRange(ctx context.Context, keyId string, from int64, to int64,
+	nonce int64, txNonce int64) error {
+	defer c.lock(ctx)()
+	md, ok := c.keys[keyId]
+	if !ok || md.ReservedFrom != from || md.ReservedTo != to {
+		return fmt.Errorf("%w: %v, range [%v, %v) is not reserved", ErrNonceConflict, keyId, from, to)
+	}
+	md.Nonce = nonce
+	md.TxNonce = txNonce
+	md.ReservedFrom = 0
+	md.ReservedTo = 0
+	md.ReservedTxFrom = 0
+	c.keys[keyId] = md
+	return nil
+}
+
+// ClaimKey claims or renews key for shard until expiresAt
+func (c *memoryStore) ClaimKey(ctx context.Context, owner KeyOwner, now time.Time) error {
+	defer c.lock(ctx)()
+	o, ok := c.owners[owner.KeyId]
+	if ok && o.Shard != owner.Shard && o.ExpiresAt.After(now) {
+		return fmt.Errorf("%w: %v is claimed by shard %v of %v", ErrKeyConflict, owner.KeyId, o.Shard, o.Signer)
+	}
+	c.owners[owner.KeyId] = owner
+	return nil
+}
+
+// ListKeyOwners reads claims of all keys
+func (c *memoryStore) ListKeyOwners(ctx context.Context) ([]KeyOwner, error) {
+	defer c.lock(ctx)()
+	var owners []KeyOwner
+	for _, o := range c.owners {
+		owners = append(owners, o)
+	}
+	return owners, nil
+}
+
+// ReadKeyIndex reads key rotation index of shard and algorithm
+func (c *memoryStore) ReadKeyIndex(ctx context.Context, shard int, algorithm string) (int, error) {
+	defer c.lock(ctx)()
+	return c.keyIdx[keyIndexId(shard, algorithm)], nil
+}
+
+// WriteKeyIndex writes key rotation index of shard and algorithm
+func (c *memoryStore) WriteKeyIndex(ctx context.Context, shard int, algorithm string, keyIdx int) error {
+	defer c.lock(ctx)()
+	c.keyIdx[keyIndexId(shard, algorithm)] = keyIdx
+	return nil
+}
+
+// ReadTxRecords reads signed transaction records of key sorted by tx nonce
+func (c *memoryStore) ReadTxRecords(ctx context.Context, keyId string, fromNonce int64, limit int) ([]Record, error) {
+	defer c.lock(ctx)()
+	var records []Record
+	for _, r := range c.signed {
+		if r.Type == RecordTx && r.KeyId == keyId && r.TxNonce >= fromNonce {
+			records = append(records, r)
+		}
+	}
+	sort.Slice(records, func(i, j int) bool {
+		return records[i].TxNonce < records[j].TxNonce
+	})
+	if limit > 0 && len(records) > limit {
+		records = records[:limit]
+	}
+	return records, nil
+}
+
+// ReadSignedRange reads signed records of key with nonce in range sorted by nonce
+func (c *memoryStore) ReadSignedRange(ctx context.Context, keyId string, fromNonce int64, toNonce int64) ([]Record, error) {
+	defer c.lock(ctx)()
+	var records []Record
+	for _, r := range c.signed {
+		if r.KeyId == keyId && r.Nonce >= fromNonce && r.Nonce < toNonce {
+			records = append(records, r)
+		}
+	}
+	sort.Slice(records, func(i, j int) bool {
+		return records[i].Nonce < records[j].Nonce
+	})
+	return records, nil
+}
+
+// DeleteUnsigned removes unsigned copies of signed records
+func (c *memoryStore) DeleteUnsigned(ctx context.Context, ids []string) error {
+	defer c.lock(ctx)()
+	for _, id := range ids {
+		delete(c.unsigned, id)
+	}
+	return nil
+}
+
+// UnsignRecord moves signed record back to unsigned records
+func (c *memoryStore) UnsignRecord(ctx context.Context, id string) error {
+	defer c.lock(ctx)()
+	r, ok := c.signed[id]
+	if !ok {
+		return ErrNotFound
+	}
+	c.unsigned[id] = unsignedCopy(r)
+	delete(c.signed, id)
+	shardKey, _ := ShardKey(id)
+	c.notifyInsert(shardKey)
+	return nil
+}
+
+// WriteTxStatus updates broadcast status of signed transaction record
+func (c *memoryStore) WriteTxStatus(ctx context.Context, id string, status TxStatus) error {
+	defer c.lock(ctx)()
+	r, ok := c.signed[id]
+	if !ok {
+		return ErrNotFound
+	}
+	r.TxStatus = status
+	c.signed[id] = r
+	return nil
+}
+
+// WriteMerkleBatch writes signed merkle batch root
+func (c *memoryStore) WriteMerkleBatch(ctx context.Context, batch *MerkleBatch) error {
+	defer c.lock(ctx)()
+	c.batches[batch.Id] = *batch
+	return nil
+}
+
+// ReadMerkleBatch reads merkle batch by id
+func (c *memoryStore) ReadMerkleBatch(ctx context.Context, id string) (*MerkleBatch, error) {
+	defer c.lock(ctx)()
+	batch, ok := c.batches[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return &batch, nil
+}
+
+// ReadAuditHead reads the last audit log entry
+func (c *memoryStore) ReadAuditHead(ctx context.Context) (*AuditEntry, error) {
+	defer c.lock(ctx)()
+	if len(c.audit) == 0 {
+		return nil, ErrNotFound
+	}
+	entry := c.audit[len(c.audit)-1]
+	return &entry, nil
+}
+
+// WriteAuditEntry appends entry to audit log
+func (c *memoryStore) WriteAuditEntry(ctx context.Context, entry *AuditEntry) error {
+	defer c.lock(ctx)()
+	if entry.Seq != int64(len(c.audit))+1 {
+		return fmt.Errorf("%w: seq %v", ErrAuditConflict, entry.Seq)
+	}
+	c.audit = append(c.audit, *entry)
+	return nil
+}
+
+// ScanAuditLog calls fn for every audit log entry in sequence order
+func (c *memoryStore) ScanAuditLog(ctx context.Context, fn func(entry AuditEntry) error) error {
+	unlock := c.lock(ctx)
+	entries := append([]AuditEntry(nil), c.audit...)
+	unlock()
+	for _, entry := range entries {
+		if err := fn(entry); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// WatchInserts returns channel which delivers shard keys of inserted records
+func (c *memoryStore) WatchInserts(ctx context.Context) (<-chan int64, error) {
+	events := make(chan int64, 1024)
+	c.watchMu.Lock()
+	c.watchers[events] = true
+	c.watchMu.Unlock()
+	go func() {
+		<-ctx.Done()
+		c.watchMu.Lock()
+		delete(c.watchers, events)
+		close(events)
+		c.watchMu.Unlock()
+	}()
+	return events, nil
+}
+
+func (c *memoryStore) notifyInsert(shardKey int64) {
+	c.watchMu.Lock()
+	defer c.watchMu.Unlock()
+	for events := range c.watchers {
+		select {
+		case events <- shardKey:
+		default:
+		}
+	}
+}
+
+// NewXact starts a new in-memory transaction
+func (c *memoryStore) NewXact(ctx context.Context) (Xact, error) {
+	return &memoryXact{store: c}, nil
+}
+
+// memoryXact implements transaction by taking a snapshot
+// of the store and restoring it on failure
+type memoryXact struct {
+	store *memoryStore
+}
+
+func (c *memoryXact) WithTransaction(ctx context.Context, callback func(ctx context.Context) error) error {
+	s := c.store
+	s.xactMu.Lock()
+	defer s.xactMu.Unlock()
+
+	s.mu.Lock()
+	unsigned := copyRecords(s.unsigned)
+	signed := copyRecords(s.signed)
+	dead := copyRecords(s.dead)
+	quarantine := make(map[string]QuarantinedRecord, len(s.quarantine))
+	for k, v := range s.quarantine {
+		quarantine[k] = v
+	}
+	keys := make(map[string]SigningKeyMetadata, len(s.keys))
+	for k, v := range s.keys {
+		keys[k] = v
+	}
+	keyIdx := make(map[string]int, len(s.keyIdx))
+	for k, v := range s.keyIdx {
+		keyIdx[k] = v
+	}
+	owners := make(map[string]KeyOwner, len(s.owners))
+	for k, v := range s.owners {
+		owners[k] = v
+	}
+	batches := make(map[string]MerkleBatch, len(s.batches))
+	for k, v := range s.batches {
+		batches[k] = v
+	}
+	audit := s.audit[:len(s.audit):len(s.audit)]
+	s.mu.Unlock()
+
+	err := callback(context.WithValue(ctx, memoryXactKey{}, s))
+	if err != nil {
+		s.mu.Lock()
+		s.unsigned = unsigned
+		s.signed = signed
+		s.dead = dead
+		s.quarantine = quarantine
+		s.keys = keys
+		s.keyIdx = keyIdx
+		s.owners = owners
+		s.batches = batches
+		s.audit = audit
+		s.mu.Unlock()
+		metrics.XactAborts.Inc()
+		log.Printf("ERROR: WriteBatch: Failed WithTransaction, error: %v", err)
+		return err
+	}
+	return nil
+}
+
+func (c *memoryXact) Close(ctx context.Context) {
+}
+
+func copyRecords(records map[string]Record) map[string]Record {
+	r := make(map[string]Record, len(records))
+	for k, v := range records {
+		r[k] = v
+	}
+	return r
+}
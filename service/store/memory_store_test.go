@@ -0,0 +1,135 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestMemoryXactRollback(t *testing.T) {
+	ctx := context.Background()
+	c := NewMemoryStore()
+	record := Record{Id: "00000000000000000000000000000001", Msg: "a"}
+	if err := c.InsertRecords(ctx, []Record{record}); err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	owner := KeyOwner{KeyId: "key", Shard: 0, ExpiresAt: now.Add(time.Minute)}
+	if err := c.ClaimKey(ctx, owner, now); err != nil {
+		t.Fatal(err)
+	}
+	xact, err := c.NewXact(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer xact.Close(ctx)
+
+	errAbort := errors.New("abort")
+	err = xact.WithTransaction(ctx, func(ctx context.Context) error {
+		if err := c.WriteSigningKeyMetadata(ctx, &SigningKeyMetadata{Id: "key", Nonce: 1}); err != nil {
+			return err
+		}
+		signed := record
+		signed.KeyId = "key"
+		if err := c.WriteBatch(ctx, []Record{signed}); err != nil {
+			return err
+		}
+		if err := c.WriteAuditEntry(ctx, &AuditEntry{Seq: 1}); err != nil {
+			return err
+		}
+		claim := KeyOwner{KeyId: "key", Shard: 1, ExpiresAt: now.Add(time.Hour)}
+		if err := c.ClaimKey(ctx, claim, now.Add(time.Hour)); err != nil {
+			return err
+		}
+		// requeued record with invalid id is moved to quarantine
+		if err := c.WriteDeadLetter(ctx, Record{Id: "x", Msg: "b"}); err != nil {
+			return err
+		}
+		if err := c.RequeueDeadLetter(ctx, "x"); err != nil {
+			return err
+		}
+		if _, err := c.SweepRecords(ctx, 0); err != nil {
+			return err
+		}
+		return errAbort
+	})
+	if err != errAbort {
+		t.Fatalf("got error %v, want %v", err, errAbort)
+	}
+
+	if n, _ := c.GetRecordCount(ctx, false); n != 1 {
+		t.Errorf("got %v unsigned records, want 1", n)
+	}
+	if n, _ := c.GetRecordCount(ctx, true); n != 0 {
+		t.Errorf("got %v signed records, want 0", n)
+	}
+	if _, err := c.ReadSigningKeyMetadata(ctx, "key"); err != ErrNotFound {
+		t.Errorf("got key metadata error %v, want %v", err, ErrNotFound)
+	}
+	if _, err := c.ReadAuditHead(ctx); err != ErrNotFound {
+		t.Errorf("got audit head error %v, want %v", err, ErrNotFound)
+	}
+	if owners, _ := c.ListKeyOwners(ctx); len(owners) != 1 || owners[0] != owner {
+		t.Errorf("got key owners %+v, want %+v", owners, owner)
+	}
+	if records, _ := c.ListQuarantine(ctx, 0); len(records) != 0 {
+		t.Errorf("got quarantine %+v, want none", records)
+	}
+}
+
+func TestReserveNonceRange(t *testing.T) {
+	ctx := context.Background()
+	c := NewMemoryStore()
+	if err := c.WriteSigningKeyMetadata(ctx, &SigningKeyMetadata{Id: "key", Nonce: 10, TxNonce: 3}); err != nil {
+		t.Fatal(err)
+	}
+	// stale nonces conflict
+	if err := c.ReserveNonceRange(ctx, "key", 8, 5, 3, 0); !errors.Is(err, ErrNonceConflict) {
+		t.Errorf("stale nonce: got error %v, want %v", err, ErrNonceConflict)
+	}
+	if err := c.ReserveNonceRange(ctx, "key", 10, 5, 2, 1); !errors.Is(err, ErrNonceConflict) {
+		t.Errorf("stale tx nonce: got error %v, want %v", err, ErrNonceConflict)
+	}
+
+	if err := c.ReserveNonceRange(ctx, "key", 10, 5, 3, 2); err != nil {
+		t.Fatal(err)
+	}
+	md, err := c.ReadSigningKeyMetadata(ctx, "key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := SigningKeyMetadata{Id: "key", Nonce: 15, TxNonce: 5, ReservedFrom: 10, ReservedTo: 15, ReservedTxFrom: 3}
+	if *md != want {
+		t.Errorf("got %+v, want %+v", *md, want)
+	}
+	// pending reservation blocks the next one even with current nonces
+	if err := c.ReserveNonceRange(ctx, "key", 15, 1, 5, 0); !errors.Is(err, ErrNonceConflict) {
+		t.Errorf("pending reservation: got error %v, want %v", err, ErrNonceConflict)
+	}
+}
+
+func TestCommitNonceRange(t *testing.T) {
+	ctx := context.Background()
+	c := NewMemoryStore()
+	if err := c.ReserveNonceRange(ctx, "key", 0, 5, 0, 2); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.CommitNonceRange(ctx, "key", 0, 4, 4, 2); !errors.Is(err, ErrNonceConflict) {
+		t.Errorf("other range: got error %v, want %v", err, ErrNonceConflict)
+	}
+	// part of the range is written
+	if err := c.CommitNonceRange(ctx, "key", 0, 5, 3, 1); err != nil {
+		t.Fatal(err)
+	}
+	md, err := c.ReadSigningKeyMetadata(ctx, "key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (SigningKeyMetadata{Id: "key", Nonce: 3, TxNonce: 1}); *md != want {
+		t.Errorf("got %+v, want %+v", *md, want)
+	}
+	if err := c.CommitNonceRange(ctx, "key", 0, 5, 5, 2); !errors.Is(err, ErrNonceConflict) {
+		t.Errorf("committed range: got error %v, want %v", err, ErrNonceConflict)
+	}
+}
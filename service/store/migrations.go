@@ -0,0 +1,225 @@
+package store
+
+import (
+	"context"
+	"fmt"
+	"log"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// migration is a one-time change of data in mongo store
+type migration struct {
+	// unique migration id, it is saved in migrations collection once applied
+	id  string
+	run func(ctx context.Context, db *mongo.Database) error
+}
+
+// migrationList contains migrations in order they are applied
+var migrationList = []migration{
+	{id: "0001-backfill-shard-key", run: backfillShardKeys},
+	{id: "0002-backfill-tx-nonce", run: backfillTxNonces},
+}
+
+// createIndexes creates indexes required for queries
+func createIndexes(ctx context.Context, db *mongo.Database) error {
+	indexes := map[string][]mongo.IndexModel{
+		unsignedCollection: {
+			{Keys: bson.D{{shardKeyField, 1}, {"id", 1}}},
+			{Keys: bson.D{{"id", 1}}, Options: options.Index().SetUnique(true)},
+		},
+		signedCollection: {
+			{Keys: bson.D{{"id", 1}}, Options: options.Index().SetUnique(true)},
+			{Keys: bson.D{{"key", 1}, {"nonce", 1}}},
+			{Keys: bson.D{{"key", 1}, {"tx_nonce", 1}}},
+		},
+		shardLeases: {
+			{Keys: bson.D{{"shard", 1}}, Options: options.Index().SetUnique(true)},
+		},
+		signerMembers: {
+			{Keys: bson.D{{"id", 1}}, Options: options.Index().SetUnique(true)},
+		},
+		merkleBatches: {
+			{Keys: bson.D{{"id", 1}}, Options: options.Index().SetUnique(true)},
+		},
+		deadLetters: {
+			{Keys: bson.D{{"id", 1}}, Options: options.Index().SetUnique(true)},
+		},
+		keyOwners: {
+			{Keys: bson.D{{"key", 1}}, Options: options.Index().SetUnique(true)},
+		},
+		quarantine: {
+			{Keys: bson.D{{"id", 1}}},
+		},
+		auditLog: {
+			{Keys: bson.D{{"seq", 1}}, Options: options.Index().SetUnique(true)},
+		},
+	}
+	// id indexes were created without unique option, index with
+	// the same keys and other options can't be created next to it
+	for _, coll := range []string{unsignedCollection, signedCollection} {
+		if err := dropNonUniqueIndex(ctx, db.Collection(coll), "id_1"); err != nil {
+			log.Printf("ERROR: failed to drop index id_1 of %v, error: %v", coll, err)
+			return err
+		}
+	}
+	for coll, models := range indexes {
+		_, err := db.Collection(coll).Indexes().CreateMany(ctx, models)
+		if err != nil {
+			log.Printf("ERROR: failed to create indexes for %v, error: %v", coll, err)
+			return err
+		}
+	}
+	return nil
+}
+
+// dropNonUniqueIndex drops index by name if it exists and is not unique
+func dropNonUniqueIndex(ctx context.Context, coll *mongo.Collection, name string) error {
+	cursor, err := coll.Indexes().List(ctx)
+	if err != nil {
+		return err
+	}
+	defer cursor.Close(ctx)
+	for cursor.Next(ctx) {
+		var index bson.M
+		if err := cursor.Decode(&index); err != nil {
+			return err
+		}
+		if index["name"] != name {
+			continue
+		}
+		if unique, _ := index["unique"].(bool); unique {
+			return nil
+		}
+		log.Printf("INFO: drop non-unique index %v of %v", name, coll.Name())
+		_, err := coll.Indexes().DropOne(ctx, name)
+		return err
+	}
+	return cursor.Err()
+}
+
+// runMigrations applies migrations which were not applied yet
+func runMigrations(ctx context.Context, db *mongo.Database) error {
+	coll := db.Collection(migrations)
+	for _, m := range migrationList {
+		err := coll.FindOne(ctx, bson.D{{"id", m.id}}).Err()
+		if err == nil {
+			continue
+		}
+		if err != mongo.ErrNoDocuments {
+			return err
+		}
+		log.Printf("INFO: running migration: %v", m.id)
+		if err := m.run(ctx, db); err != nil {
+			log.Printf("ERROR: migration %v failed, error: %v", m.id, err)
+			return err
+		}
+		// concurrent pods may run the same migration,
+		// migrations must be idempotent
+		opts := options.Update().SetUpsert(true)
+		_, err = coll.UpdateOne(ctx, bson.D{{"id", m.id}},
+			bson.D{{"$set", bson.D{{"id", m.id}}}}, opts)
+		if err != nil {
+			return err
+		}
+		log.Printf("INFO: migration %v is done", m.id)
+	}
+	return nil
+}
+
+// backfillShardKeys sets shard key on records inserted before shard key
+// was introduced. Records are read in batches in _id order, each batch is
+// a separate query, so a backfill interrupted by restart resumes with
+// records which still have no shard key
+func backfillShardKeys(ctx context.Context, db *mongo.Database) error {
+	const bulkSize = 1000
+	coll := db.Collection(unsignedCollection)
+	total := 0
+	var lastId interface{}
+	for {
+		filter := bson.D{{shardKeyField, bson.D{{"$exists", false}}}}
+		if lastId != nil {
+			// records with invalid ids keep no shard key, skip them
+			filter = append(filter, bson.E{"_id", bson.D{{"$gt", lastId}}})
+		}
+		opts := options.Find().SetSort(bson.D{{"_id", 1}}).SetLimit(bulkSize)
+		cursor, err := coll.Find(ctx, filter, opts)
+		if err != nil {
+			return err
+		}
+		var docs []bson.D
+		if err := cursor.All(ctx, &docs); err != nil {
+			return err
+		}
+		if len(docs) == 0 {
+			break
+		}
+
+		var models []mongo.WriteModel
+		for _, doc := range docs {
+			lastId = doc.Map()["_id"]
+			record := decodeRecord(doc)
+			shardKey, err := ShardKey(record.Id)
+			if err != nil {
+				log.Printf("WARN: cannot compute shard key, error: %v, skip the record", err)
+				continue
+			}
+			models = append(models, mongo.NewUpdateOneModel().
+				SetFilter(bson.D{{"_id", lastId}}).
+				SetUpdate(bson.D{{"$set", bson.D{{shardKeyField, shardKey}}}}))
+		}
+		if len(models) > 0 {
+			_, err = coll.BulkWrite(ctx, models, options.BulkWrite().SetOrdered(false))
+			if err != nil {
+				return err
+			}
+		}
+		total += len(models)
+		log.Printf("INFO: backfilled shard key for %v records", total)
+	}
+	return nil
+}
+
+// backfillTxNonces sets tx nonce of transactions signed before transactions
+// got their own nonce sequence, they were signed with key nonce. Tx nonce of
+// key continues after the last signed transaction
+func backfillTxNonces(ctx context.Context, db *mongo.Database) error {
+	coll := db.Collection(signedCollection)
+	filter := bson.D{
+		{"type", string(RecordTx)},
+		{"tx_nonce", bson.D{{"$exists", false}}},
+	}
+	update := mongo.Pipeline{{{"$set", bson.D{{"tx_nonce", "$nonce"}}}}}
+	res, err := coll.UpdateMany(ctx, filter, update)
+	if err != nil {
+		return err
+	}
+	log.Printf("INFO: backfilled tx nonce for %v records", res.ModifiedCount)
+
+	pipeline := mongo.Pipeline{
+		{{"$match", bson.D{{"type", string(RecordTx)}}}},
+		{{"$group", bson.D{{"_id", "$key"}, {"tx_nonce", bson.D{{"$max", "$tx_nonce"}}}}}},
+	}
+	cursor, err := coll.Aggregate(ctx, pipeline)
+	if err != nil {
+		return err
+	}
+	var keys []bson.M
+	if err := cursor.All(ctx, &keys); err != nil {
+		return err
+	}
+	keyColl := db.Collection(signingKeys)
+	for _, key := range keys {
+		keyId := fmt.Sprintf("%s", key["_id"])
+		_, err := keyColl.UpdateOne(ctx,
+			bson.D{{"id", keyId}, {"tx_nonce", bson.D{{"$exists", false}}}},
+			bson.D{{"$set", bson.D{{"tx_nonce", toInt64(key["tx_nonce"]) + 1}}}})
+		if err != nil {
+			return err
+		}
+	}
+	log.Printf("INFO: backfilled tx nonce for %v keys", len(keys))
+	return nil
+}
@@ -0,0 +1,142 @@
+package store
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// mongoLeaseStore keeps shard leases in mongo
+type mongoLeaseStore struct {
+	client *MongoClient
+}
+
+func NewMongoLeaseStore(client *MongoClient) LeaseStore {
+	return &mongoLeaseStore{
+		client: client,
+	}
+}
+
+// Heartbeat registers member as alive until expiresAt
+func (c *mongoLeaseStore) Heartbeat(ctx context.Context, member string, expiresAt time.Time) error {
+	coll := c.client.Client.Database(dbName).Collection(signerMembers)
+	filter := bson.D{{"id", member}}
+	update := bson.D{{"$set", bson.D{{"expires_at", expiresAt}}}}
+	opts := options.Update().SetUpsert(true)
+	_, err := coll.UpdateOne(ctx, filter, update, opts)
+	return err
+}
+
+// LiveMembers returns members which heartbeat is not expired at now
+func (c *mongoLeaseStore) LiveMembers(ctx context.Context, now time.Time) ([]string, error) {
+	coll := c.client.Client.Database(dbName).Collection(signerMembers)
+	filter := bson.D{{"expires_at", bson.D{{"$gt", now}}}}
+	cursor, err := coll.Find(ctx, filter)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+	var members []string
+	for cursor.Next(ctx) {
+		var result bson.D
+		if err := cursor.Decode(&result); err != nil {
+			return nil, err
+		}
+		members = append(members, fmt.Sprintf("%s", result.Map()["id"]))
+	}
+	return members, cursor.Err()
+}
+
+// ReadLeases returns all shard leases
+func (c *mongoLeaseStore) ReadLeases(ctx context.Context) ([]ShardLease, error) {
+	coll := c.client.Client.Database(dbName).Collection(shardLeases)
+	cursor, err := coll.Find(ctx, bson.D{})
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+	var leases []ShardLease
+	for cursor.Next(ctx) {
+		var result bson.D
+		if err := cursor.Decode(&result); err != nil {
+			return nil, err
+		}
+		lease := ShardLease{}
+		for _, r := range result {
+			switch {
+			case r.Key == "shard":
+				lease.Shard = int(r.Value.(int64))
+			case r.Key == "owner":
+				lease.Owner = fmt.Sprintf("%s", r.Value)
+			case r.Key == "expires_at":
+				lease.ExpiresAt = r.Value.(primitive.DateTime).Time()
+			}
+		}
+		leases = append(leases, lease)
+	}
+	return leases, cursor.Err()
+}
+
+// AcquireLease claims or renews shard lease for owner until expiresAt
+func (c *mongoLeaseStore) AcquireLease(ctx context.Context, shard int, owner string,
+	now time.Time, expiresAt time.Time) error {
+	coll := c.client.Client.Database(dbName).Collection(shardLeases)
+	// match lease which is held by owner or expired,
+	// if lease is held by another owner, upsert fails
+	// with duplicate key error on unique shard index
+	filter := bson.D{
+		{"shard", int64(shard)},
+		{"$or", bson.A{
+			bson.D{{"owner", owner}},
+			bson.D{{"expires_at", bson.D{{"$lte", now}}}},
+		}},
+	}
+	update := bson.D{{"$set", bson.D{
+		{"owner", owner},
+		{"expires_at", expiresAt},
+	}}}
+	opts := options.Update().SetUpsert(true)
+	_, err := coll.UpdateOne(ctx, filter, update, opts)
+	if mongo.IsDuplicateKeyError(err) {
+		return ErrLeaseLost
+	}
+	return err
+}
+
+// ReleaseLease releases shard lease held by owner
+func (c *mongoLeaseStore) ReleaseLease(ctx context.Context, shard int, owner string) error {
+	coll := c.client.Client.Database(dbName).Collection(shardLeases)
+	filter := bson.D{{"shard", int64(shard)}, {"owner", owner}}
+	update := bson.D{{"$set", bson.D{
+		{"owner", ""},
+		{"expires_at", time.Unix(0, 0)},
+	}}}
+	_, err := coll.UpdateOne(ctx, filter, update)
+	return err
+}
+
+// FenceLease checks that owner still holds shard lease at now
+func (c *mongoLeaseStore) FenceLease(ctx context.Context, shard int, owner string, now time.Time) error {
+	coll := c.client.Client.Database(dbName).Collection(shardLeases)
+	// write to the lease document, so a concurrent takeover
+	// of the lease conflicts with the transaction
+	filter := bson.D{
+		{"shard", int64(shard)},
+		{"owner", owner},
+		{"expires_at", bson.D{{"$gt", now}}},
+	}
+	update := bson.D{{"$inc", bson.D{{"fence", 1}}}}
+	res, err := coll.UpdateOne(ctx, filter, update)
+	if err != nil {
+		return err
+	}
+	if res.MatchedCount == 0 {
+		return ErrLeaseLost
+	}
+	return nil
+}
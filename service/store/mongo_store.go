@@ -2,14 +2,14 @@ package store
 
 import (
 	"context"
-	"encoding/binary"
-	"encoding/hex"
 	"fmt"
 	"log"
 	"math/rand"
+	"strconv"
 	"time"
 
 	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
 
@@ -21,6 +21,17 @@ const (
 	unsignedCollection = "records"
 	signedCollection   = "signedrecords"
 	signingKeys        = "signingkeys"
+	migrations         = "migrations"
+	shardLeases        = "shardleases"
+	signerMembers      = "signers"
+	merkleBatches      = "batches"
+	auditLog           = "auditlog"
+	deadLetters        = "deadletters"
+	quarantine         = "quarantine"
+	keyOwners          = "keyowners"
+
+	// shardKeyField is computed from record id on insert and used for shard selection
+	shardKeyField = "shard_key"
 )
 
 type MongoClient struct {
@@ -36,14 +47,14 @@ func init() {
 }
 
 func NewMongoClient(ctx context.Context) (*MongoClient, context.Context, error) {
-	client, ctx, cancel, err := connect(ctx, config.GetMongoUrl())
+	client, connCtx, cancel, err := connect(ctx, config.GetMongoUrl())
 	if err != nil {
 		return nil, nil, err
 	}
 	// create collections if needed
 	cols := make(map[string]interface{})
 	db := client.Database(dbName)
-	names, err := db.ListCollectionNames(ctx, bson.D{})
+	names, err := db.ListCollectionNames(connCtx, bson.D{})
 	if err != nil {
 		return nil, nil, err
 	}
@@ -52,23 +63,51 @@ func NewMongoClient(ctx context.Context) (*MongoClient, context.Context, error)
 		cols[c] = true
 	}
 
-	need := []string{unsignedCollection, signedCollection, signingKeys}
+	need := []string{unsignedCollection, signedCollection, signingKeys, migrations,
+		shardLeases, signerMembers, merkleBatches, auditLog, deadLetters, quarantine, keyOwners}
 	for _, c := range need {
 		if _, ok := cols[c]; !ok {
-			err := db.CreateCollection(ctx, c)
+			err := db.CreateCollection(connCtx, c)
 			if err != nil {
 				return nil, nil, err
 			}
 		}
 	}
 
+	// indexes and migrations may take long on a large store,
+	// they run on caller ctx without connect deadline
+	err = createIndexes(ctx, db)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	err = runMigrations(ctx, db)
+	if err != nil {
+		return nil, nil, err
+	}
+
 	return &MongoClient{
 		Client: client,
 		cancel: cancel,
-	}, ctx, nil
+	}, connCtx, nil
 }
+
+// ConnectMongoClient connects to mongo without creating collections and
+// indexes or running migrations, tools use it so they don't change the schema
+// of a store which is upgraded by the service
+func ConnectMongoClient(ctx context.Context) (*MongoClient, context.Context, error) {
+	client, connCtx, cancel, err := connect(ctx, config.GetMongoUrl())
+	if err != nil {
+		return nil, nil, err
+	}
+	return &MongoClient{
+		Client: client,
+		cancel: cancel,
+	}, connCtx, nil
+}
+
 func (c *MongoClient) Close(ctx context.Context) {
-	close(c.Client, ctx, c.cancel)
+	closeClient(c.Client, ctx, c.cancel)
 }
 
 func (c *MongoClient) GetMongo() *mongo.Client {
@@ -105,60 +144,227 @@ func (c *mongoStore) GetRecordCount(ctx context.Context, signed bool) (int, erro
 	return int(nRecords), nil
 }
 
-// ReadBatch reads messages in batch
-// For batch selection use sharding such that nRecords%batchCount == batchId
+// ReadBatch reads up to limit messages in batch
+// For batch selection use sharding such that ShardOf(shardKey, batchCount) == batchId
 func (c *mongoStore) ReadBatch(ctx context.Context,
-	batchId int, batchCount int) ([]Record, error) {
+	batchId int, batchCount int, algorithm string, limit int) ([]Record, error) {
 
-	// Scan all the records and select records which belong to
-	// this shard. This is not efficient, e.g. each shard has to read all
-	// records. Better approach would be to craft a filter query
-	// to run in record-generator store
+	// Shard key is computed when record is inserted,
+	// so shard selection runs as a filter in mongo and uses shard_key index
 	db := c.client.Client.Database(dbName)
 	coll := db.Collection(unsignedCollection)
+	filter := bson.D{
+		{"$or", shardFilter(batchId, batchCount)},
+		{"algorithm", algorithmFilter(algorithm)},
+	}
 	opts := options.Find()
 	opts.SetSort(bson.D{{"id", 1}})
-	sortCursor, err := coll.Find(ctx, bson.D{}, opts)
+	if limit > 0 {
+		opts.SetLimit(int64(limit))
+	}
+	sortCursor, err := coll.Find(ctx, filter, opts)
 	if err != nil {
 		return nil, err
 	}
+	defer sortCursor.Close(ctx)
 	var records []Record
 	for sortCursor.Next(ctx) == true {
 		var result bson.D
 		if err := sortCursor.Decode(&result); err != nil {
 			return nil, err
 		}
+		records = append(records, decodeRecord(result))
+	}
+	return records, sortCursor.Err()
+}
 
-		nr := Record{}
-		for _, r := range result {
-			switch {
-			case r.Key == "id":
-				nr.Id = fmt.Sprintf("%s", r.Value)
-			case r.Key == "msg":
-				nr.Msg = fmt.Sprintf("%s", r.Value)
-			case r.Key == "sign":
-				nr.Signature = fmt.Sprintf("%s", r.Value)
-			case r.Key == "key":
-				nr.KeyId = fmt.Sprintf("%s", r.Value)
-			}
-		}
-		idBytes, err := hex.DecodeString(nr.Id)
+// shardFilter selects records with ShardOf(shardKey, batchCount) == batchId.
+// Shard keys above max int64 are stored as negative numbers, mongo $mod of
+// them is negative as well, so they are matched by a separate remainder
+func shardFilter(batchId int, batchCount int) bson.A {
+	n := uint64(batchCount)
+	// 2^64 % n, shard key k < 0 is stored for unsigned k + 2^64
+	wrap := (^uint64(0)%n + 1) % n
+	rem := int64((uint64(batchId) + n - wrap) % n)
+	if rem != 0 {
+		rem -= int64(n)
+	}
+	return bson.A{
+		bson.D{{shardKeyField, bson.D{{"$gte", 0}, {"$mod", bson.A{batchCount, batchId}}}}},
+		bson.D{{shardKeyField, bson.D{{"$lt", 0}, {"$mod", bson.A{batchCount, rem}}}}},
+	}
+}
+
+// InsertRecords inserts new unsigned records
+func (c *mongoStore) InsertRecords(ctx context.Context, records []Record) error {
+	if len(records) == 0 {
+		return nil
+	}
+	db := c.client.Client.Database(dbName)
+	coll := db.Collection(unsignedCollection)
+	collSign := db.Collection(signedCollection)
+	collDead := db.Collection(deadLetters)
+
+	var docs []interface{}
+	var ids []string
+	seen := make(map[string]bool)
+	for _, record := range records {
+		shardKey, err := ShardKey(record.Id)
 		if err != nil {
-			log.Printf("WARN: failed to convert record id : %v, skip the record", nr.Id)
-			continue
+			return err
+		}
+		if seen[record.Id] {
+			return fmt.Errorf("%w: %v", ErrDuplicateRecord, record.Id)
+		}
+		seen[record.Id] = true
+		docs = append(docs, bson.D{
+			{"id", record.Id},
+			{"msg", record.Msg},
+			{"type", string(record.Type)},
+			{"scheme", record.Scheme},
+			{"algorithm", record.Algorithm},
+			{shardKeyField, shardKey},
+		})
+		ids = append(ids, record.Id)
+	}
+
+	// reject records which are already pending or signed
+	filter := bson.M{"id": bson.M{"$in": ids}}
+	for _, cl := range []*mongo.Collection{coll, collSign, collDead} {
+		var result bson.D
+		err := cl.FindOne(ctx, filter).Decode(&result)
+		if err == nil {
+			return fmt.Errorf("%w: %v", ErrDuplicateRecord, result.Map()["id"])
+		}
+		if err != mongo.ErrNoDocuments {
+			return err
 		}
-		if len(idBytes) < 8 {
-			log.Printf("WARN: failed to convert record id, it is less than 8 bytes : %v, skip the record", nr.Id)
+	}
+
+	// the check above is not atomic with insert,
+	// concurrent inserts of the same id fail on unique id index
+	ins, err := coll.InsertMany(ctx, docs)
+	if mongo.IsDuplicateKeyError(err) {
+		return fmt.Errorf("%w: %v", ErrDuplicateRecord, err)
+	}
+	if err != nil {
+		log.Printf("ERROR: InsertRecords: Failed InsertMany, error: %v", err)
+		return err
+	}
+	log.Printf("INFO: InsertRecords: InsertMany ok, inserted: %v", len(ins.InsertedIDs))
+	return nil
+}
+
+// GetRecord returns record by id and its signing status
+func (c *mongoStore) GetRecord(ctx context.Context, id string) (*Record, RecordStatus, error) {
+	db := c.client.Client.Database(dbName)
+	filter := bson.D{{"id", id}}
+	lookup := []struct {
+		coll   string
+		status RecordStatus
+	}{
+		{signedCollection, RecordSigned},
+		{unsignedCollection, RecordPending},
+		{deadLetters, RecordDeadLetter},
+	}
+	for _, l := range lookup {
+		var result bson.D
+		err := db.Collection(l.coll).FindOne(ctx, filter).Decode(&result)
+		if err == mongo.ErrNoDocuments {
 			continue
 		}
-		i := uint64(binary.LittleEndian.Uint64(idBytes[:8]))
-		// check if this records belongs to batchId shard
-		mod := i % uint64(batchCount)
-		if mod == uint64(batchId) {
-			records = append(records, nr)
+		if err != nil {
+			return nil, RecordUnknown, err
+		}
+		record := decodeRecord(result)
+		return &record, l.status, nil
+	}
+	return nil, RecordUnknown, nil
+}
+
+// ScanSignedRecords calls fn for every signed record
+func (c *mongoStore) ScanSignedRecords(ctx context.Context, fn func(record Record) error) error {
+	db := c.client.Client.Database(dbName)
+	coll := db.Collection(signedCollection)
+	cursor, err := coll.Find(ctx, bson.D{})
+	if err != nil {
+		return err
+	}
+	defer cursor.Close(ctx)
+	for cursor.Next(ctx) {
+		var result bson.D
+		if err := cursor.Decode(&result); err != nil {
+			return err
+		}
+		if err := fn(decodeRecord(result)); err != nil {
+			return err
+		}
+	}
+	return cursor.Err()
+}
+
+// decodeRecord converts mongo document to a record
+func decodeRecord(doc bson.D) Record {
+	nr := Record{}
+	hasNonce := false
+	for _, r := range doc {
+		switch {
+		case r.Key == "id":
+			nr.Id = fmt.Sprintf("%s", r.Value)
+		case r.Key == "msg":
+			nr.Msg = fmt.Sprintf("%s", r.Value)
+		case r.Key == "sign":
+			nr.Signature = fmt.Sprintf("%s", r.Value)
+		case r.Key == "salt":
+			nr.Salt = fmt.Sprintf("%s", r.Value)
+		case r.Key == "key":
+			nr.KeyId = fmt.Sprintf("%s", r.Value)
+		case r.Key == "type":
+			nr.Type = RecordType(fmt.Sprintf("%s", r.Value))
+		case r.Key == "scheme":
+			nr.Scheme = fmt.Sprintf("%s", r.Value)
+		case r.Key == "algorithm":
+			nr.Algorithm = fmt.Sprintf("%s", r.Value)
+		case r.Key == "raw_tx":
+			nr.RawTx = fmt.Sprintf("%s", r.Value)
+		case r.Key == "tx_hash":
+			nr.TxHash = fmt.Sprintf("%s", r.Value)
+		case r.Key == "nonce":
+			nr.Nonce, hasNonce = r.Value.(int64)
+		case r.Key == "tx_nonce":
+			nr.TxNonce = toInt64(r.Value)
+		case r.Key == "tx_status":
+			nr.TxStatus = TxStatus(fmt.Sprintf("%s", r.Value))
+		case r.Key == "batch_id":
+			nr.BatchId = fmt.Sprintf("%s", r.Value)
+		case r.Key == "attempts":
+			nr.Attempts = int(toInt64(r.Value))
+		case r.Key == "last_error":
+			nr.LastError = fmt.Sprintf("%s", r.Value)
+		case r.Key == "proof":
+			if steps, ok := r.Value.(bson.A); ok {
+				for _, step := range steps {
+					nr.Proof = append(nr.Proof, fmt.Sprintf("%s", step))
+				}
+			}
 		}
 	}
-	return records, nil
+	// records signed before nonce was stored use their nonce as salt
+	if !hasNonce && nr.Salt != "" {
+		nr.Nonce, _ = strconv.ParseInt(nr.Salt, 10, 64)
+	}
+	return nr
+}
+
+// toInt64 converts mongo integer of any size
+func toInt64(v interface{}) int64 {
+	switch n := v.(type) {
+	case int32:
+		return int64(n)
+	case int64:
+		return n
+	}
+	return 0
 }
 
 // WriteRecord writes a single record
@@ -174,6 +380,15 @@ func (c *mongoStore) WriteRecord(ctx context.Context, record Record) error {
 		{"key", record.KeyId},
 		{"sign", record.Signature},
 		{"salt", record.Salt},
+		{"type", string(record.Type)},
+		{"scheme", record.Scheme},
+		{"algorithm", record.Algorithm},
+		{"raw_tx", record.RawTx},
+		{"tx_hash", record.TxHash},
+		{"nonce", record.Nonce},
+		{"tx_nonce", record.TxNonce},
+		{"batch_id", record.BatchId},
+		{"proof", record.Proof},
 	}}}
 	opts := options.UpdateOptions{}
 	opts.SetUpsert(true)
@@ -208,6 +423,18 @@ func (c *mongoStore) WriteBatch(ctx context.Context, records []Record) error {
 			{"key", record.KeyId},
 			{"sign", record.Signature},
 			{"salt", record.Salt},
+			{"type", string(record.Type)},
+			{"scheme", record.Scheme},
+			{"algorithm", record.Algorithm},
+			{"raw_tx", record.RawTx},
+			{"tx_hash", record.TxHash},
+			{"nonce", record.Nonce},
+		}
+		if record.Type == RecordTx {
+			doc = append(doc, bson.E{"tx_nonce", record.TxNonce})
+		}
+		if record.BatchId != "" {
+			doc = append(doc, bson.E{"batch_id", record.BatchId}, bson.E{"proof", record.Proof})
 		}
 		docs = append(docs, doc)
 		deleteIds = append(deleteIds, record.Id)
@@ -240,25 +467,238 @@ func (c *mongoStore) WriteBatch(ctx context.Context, records []Record) error {
 	return nil
 }
 
+// WriteSignFailure increments attempts of unsigned record
+func (c *mongoStore) WriteSignFailure(ctx context.Context, id string, reason string) (int, error) {
+	db := c.client.Client.Database(dbName)
+	coll := db.Collection(unsignedCollection)
+	update := bson.D{
+		{"$inc", bson.D{{"attempts", int64(1)}}},
+		{"$set", bson.D{{"last_error", reason}}},
+	}
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+	var result bson.D
+	err := coll.FindOneAndUpdate(ctx, bson.D{{"id", id}}, update, opts).Decode(&result)
+	if err == mongo.ErrNoDocuments {
+		return 0, ErrNotFound
+	}
+	if err != nil {
+		return 0, err
+	}
+	return decodeRecord(result).Attempts, nil
+}
+
+// WriteDeadLetter moves unsigned record to dead letters
+func (c *mongoStore) WriteDeadLetter(ctx context.Context, record Record) error {
+	db := c.client.Client.Database(dbName)
+	coll := db.Collection(unsignedCollection)
+	collDead := db.Collection(deadLetters)
+
+	filter := bson.D{{"id", record.Id}}
+	update := bson.D{{"$set", bson.D{
+		{"msg", record.Msg},
+		{"type", string(record.Type)},
+		{"scheme", record.Scheme},
+		{"algorithm", record.Algorithm},
+		{"attempts", int64(record.Attempts)},
+		{"last_error", record.LastError},
+		{"dead_at", time.Now().UTC()},
+	}}}
+	opts := options.Update().SetUpsert(true)
+	_, err := collDead.UpdateOne(ctx, filter, update, opts)
+	if err != nil {
+		return err
+	}
+	_, err = coll.DeleteOne(ctx, filter)
+	return err
+}
+
+// ListDeadLetters reads up to limit dead letters sorted by id
+func (c *mongoStore) ListDeadLetters(ctx context.Context, limit int) ([]Record, error) {
+	db := c.client.Client.Database(dbName)
+	coll := db.Collection(deadLetters)
+	opts := options.Find().SetSort(bson.D{{"id", 1}})
+	if limit > 0 {
+		opts.SetLimit(int64(limit))
+	}
+	cursor, err := coll.Find(ctx, bson.D{}, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+	var records []Record
+	for cursor.Next(ctx) {
+		var result bson.D
+		if err := cursor.Decode(&result); err != nil {
+			return nil, err
+		}
+		records = append(records, decodeRecord(result))
+	}
+	return records, cursor.Err()
+}
+
+// RequeueDeadLetter moves dead letter back to unsigned records
+func (c *mongoStore) RequeueDeadLetter(ctx context.Context, id string) error {
+	db := c.client.Client.Database(dbName)
+	coll := db.Collection(unsignedCollection)
+	collDead := db.Collection(deadLetters)
+
+	filter := bson.D{{"id", id}}
+	var result bson.D
+	err := collDead.FindOne(ctx, filter).Decode(&result)
+	if err == mongo.ErrNoDocuments {
+		return ErrNotFound
+	}
+	if err != nil {
+		return err
+	}
+	record := decodeRecord(result)
+	shardKey, err := ShardKey(record.Id)
+	if err != nil {
+		return err
+	}
+	_, err = coll.InsertOne(ctx, bson.D{
+		{"id", record.Id},
+		{"msg", record.Msg},
+		{"type", string(record.Type)},
+		{"scheme", record.Scheme},
+		{"algorithm", record.Algorithm},
+		{shardKeyField, shardKey},
+	})
+	if err != nil {
+		return err
+	}
+	_, err = collDead.DeleteOne(ctx, filter)
+	return err
+}
+
+// SweepRecords sets shard key of unsigned records inserted without it
+// and moves records with invalid ids to quarantine. Quarantined document
+// keeps _id of the source record, so concurrent sweeps don't duplicate it
+func (c *mongoStore) SweepRecords(ctx context.Context, limit int) (int, error) {
+	db := c.client.Client.Database(dbName)
+	coll := db.Collection(unsignedCollection)
+	collQuarantine := db.Collection(quarantine)
+
+	filter := bson.D{{shardKeyField, bson.D{{"$exists", false}}}}
+	opts := options.Find()
+	if limit > 0 {
+		opts.SetLimit(int64(limit))
+	}
+	cursor, err := coll.Find(ctx, filter, opts)
+	if err != nil {
+		return 0, err
+	}
+	var docs []bson.D
+	if err := cursor.All(ctx, &docs); err != nil {
+		return 0, err
+	}
+
+	n := 0
+	for _, doc := range docs {
+		docId := doc.Map()["_id"]
+		record := decodeRecord(doc)
+		shardKey, err := ShardKey(record.Id)
+		if err == nil {
+			_, err = coll.UpdateOne(ctx, bson.D{{"_id", docId}},
+				bson.D{{"$set", bson.D{{shardKeyField, shardKey}}}})
+			if err != nil {
+				return n, err
+			}
+			continue
+		}
+		log.Printf("WARN: quarantine record: %v, error: %v", record.Id, err)
+		_, err = collQuarantine.UpdateOne(ctx, bson.D{{"_id", docId}},
+			bson.D{{"$set", bson.D{
+				{"id", record.Id},
+				{"msg", record.Msg},
+				{"reason", err.Error()},
+				{"quarantined_at", time.Now().UTC()},
+			}}}, options.Update().SetUpsert(true))
+		if err != nil {
+			return n, err
+		}
+		_, err = coll.DeleteOne(ctx, bson.D{{"_id", docId}})
+		if err != nil {
+			return n, err
+		}
+		n += 1
+	}
+	return n, nil
+}
+
+// ListQuarantine reads up to limit quarantined records sorted by id
+func (c *mongoStore) ListQuarantine(ctx context.Context, limit int) ([]QuarantinedRecord, error) {
+	db := c.client.Client.Database(dbName)
+	coll := db.Collection(quarantine)
+	opts := options.Find().SetSort(bson.D{{"id", 1}})
+	if limit > 0 {
+		opts.SetLimit(int64(limit))
+	}
+	cursor, err := coll.Find(ctx, bson.D{}, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+	var records []QuarantinedRecord
+	for cursor.Next(ctx) {
+		var result bson.D
+		if err := cursor.Decode(&result); err != nil {
+			return nil, err
+		}
+		record := QuarantinedRecord{}
+		for _, r := range result {
+			switch {
+			case r.Key == "id":
+				record.Id = fmt.Sprintf("%s", r.Value)
+			case r.Key == "msg":
+				record.Msg = fmt.Sprintf("%s", r.Value)
+			case r.Key == "reason":
+				record.Reason = fmt.Sprintf("%s", r.Value)
+			case r.Key == "quarantined_at":
+				record.QuarantinedAt = r.Value.(primitive.DateTime).Time()
+			}
+		}
+		records = append(records, record)
+	}
+	return records, cursor.Err()
+}
+
 // ReadKeyMetadata reads metadata of signing key
 func (c *mongoStore) ReadSigningKeyMetadata(ctx context.Context, keyId string) (*SigningKeyMetadata, error) {
 	db := c.client.Client.Database(dbName)
 	coll := db.Collection(signingKeys)
 	var result bson.D
 	err := coll.FindOne(ctx, bson.D{{"id", keyId}}).Decode(&result)
+	if err == mongo.ErrNoDocuments {
+		return nil, ErrNotFound
+	}
 	if err != nil {
 		return nil, err
 	}
-	metadata := &SigningKeyMetadata{}
-	for _, r := range result {
+	metadata := decodeSigningKeyMetadata(result)
+	return &metadata, nil
+}
+
+// decodeSigningKeyMetadata converts mongo document to key metadata
+func decodeSigningKeyMetadata(doc bson.D) SigningKeyMetadata {
+	metadata := SigningKeyMetadata{}
+	for _, r := range doc {
 		switch {
 		case r.Key == "id":
 			metadata.Id = fmt.Sprintf("%s", r.Value)
 		case r.Key == "nonce":
 			metadata.Nonce = r.Value.(int64)
+		case r.Key == "tx_nonce":
+			metadata.TxNonce = toInt64(r.Value)
+		case r.Key == "reserved_from":
+			metadata.ReservedFrom = toInt64(r.Value)
+		case r.Key == "reserved_to":
+			metadata.ReservedTo = toInt64(r.Value)
+		case r.Key == "reserved_tx_from":
+			metadata.ReservedTxFrom = toInt64(r.Value)
 		}
 	}
-	return metadata, nil
+	return metadata
 }
 
 // WriteSigningKeyMetadata upserts key metadata to mongo store
@@ -267,12 +707,507 @@ func (c *mongoStore) WriteSigningKeyMetadata(ctx context.Context, keyMetadata *S
 	coll := db.Collection(signingKeys)
 
 	filter := bson.D{{"id", keyMetadata.Id}}
-	update := bson.D{{"$set", bson.D{{"nonce", keyMetadata.Nonce}}}}
+	update := bson.D{{"$set", bson.D{{"nonce", keyMetadata.Nonce}, {"tx_nonce", keyMetadata.TxNonce}}}}
+	opts := options.Update().SetUpsert(true)
+	_, err := coll.UpdateOne(ctx, filter, update, opts)
+	return err
+}
+
+// ReserveNonceRange atomically advances key nonces and marks the range as reserved,
+// update is guarded by expected nonces, so concurrent writers never get the same range
+func (c *mongoStore) ReserveNonceRange(ctx context.Context, keyId string, nonce int64, count int64,
+	txNonce int64, txCount int64) error {
+	db := c.client.Client.Database(dbName)
+	coll := db.Collection(signingKeys)
+
+	// create metadata of a new key, so the guarded update doesn't need upsert
+	_, err := coll.UpdateOne(ctx, bson.D{{"id", keyId}},
+		bson.D{{"$setOnInsert", bson.D{{"nonce", int64(0)}, {"tx_nonce", int64(0)}}}},
+		options.Update().SetUpsert(true))
+	if err != nil {
+		return err
+	}
+	// keys which never signed a transaction may have no tx nonce
+	txFilter := bson.E{"tx_nonce", txNonce}
+	if txNonce == 0 {
+		txFilter = bson.E{"tx_nonce", bson.D{{"$in", bson.A{int64(0), nil}}}}
+	}
+	filter := bson.D{
+		{"id", keyId},
+		{"nonce", nonce},
+		txFilter,
+		{"reserved_to", bson.D{{"$exists", false}}},
+	}
+	update := bson.D{
+		{"$set", bson.D{
+			{"nonce", nonce + count},
+			{"tx_nonce", txNonce + txCount},
+			{"reserved_from", nonce},
+			{"reserved_to", nonce + count},
+			{"reserved_tx_from", txNonce},
+		}},
+	}
+	err = coll.FindOneAndUpdate(ctx, filter, update).Err()
+	if err == mongo.ErrNoDocuments {
+		return fmt.Errorf("%w: %v, expected nonce: %v, tx nonce: %v", ErrNonceConflict, keyId, nonce, txNonce)
+	}
+	return err
+}
+
+// CommitNonceRange clears reservation of key and sets key nonces
+func (c *mongoStore) CommitNonceRange(ctx context.Context, keyId string, from int64, to int64,
+	nonce int64, txNonce int64) error {
+	db := c.client.Client.Database(dbName)
+	coll := db.Collection(signingKeys)
+
+	filter := bson.D{{"id", keyId}, {"reserved_from", from}, {"reserved_to", to}}
+	update := bson.D{
+		{"$set", bson.D{{"nonce", nonce}, {"tx_nonce", txNonce}}},
+		{"$unset", bson.D{{"reserved_from", ""}, {"reserved_to", ""}, {"reserved_tx_from", ""}}},
+	}
+	res, err := coll.UpdateOne(ctx, filter, update)
+	if err != nil {
+		return err
+	}
+	if res.MatchedCount == 0 {
+		return fmt.Errorf("%w: %v, range [%v, %v) is not reserved", ErrNonceConflict, keyId, from, to)
+	}
+	return nil
+}
+
+// ListSigningKeyMetadata reads metadata of all signing keys
+func (c *mongoStore) ListSigningKeyMetadata(ctx context.Context) ([]SigningKeyMetadata, error) {
+	db := c.client.Client.Database(dbName)
+	coll := db.Collection(signingKeys)
+	cursor, err := coll.Find(ctx, bson.D{{"nonce", bson.D{{"$exists", true}}}})
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+	var keys []SigningKeyMetadata
+	for cursor.Next(ctx) {
+		var result bson.D
+		if err := cursor.Decode(&result); err != nil {
+			return nil, err
+		}
+		keys = append(keys, decodeSigningKeyMetadata(result))
+	}
+	return keys, cursor.Err()
+}
+
+// algorithmFilter matches records of algorithm,
+// records without algorithm match the default one
+func algorithmFilter(algorithm string) interface{} {
+	if algorithm == "" || algorithm == DefaultAlgorithm {
+		return bson.D{{"$in", bson.A{nil, "", DefaultAlgorithm}}}
+	}
+	return algorithm
+}
+
+// ClaimKey claims or renews key for shard until expiresAt
+func (c *mongoStore) ClaimKey(ctx context.Context, owner KeyOwner, now time.Time) error {
+	coll := c.client.Client.Database(dbName).Collection(keyOwners)
+	// match claim of the same shard or expired claim,
+	// if key is claimed by another live shard upsert fails
+	// with duplicate key error on unique key index
+	filter := bson.D{
+		{"key", owner.KeyId},
+		{"$or", bson.A{
+			bson.D{{"shard", int64(owner.Shard)}},
+			bson.D{{"expires_at", bson.D{{"$lte", now}}}},
+		}},
+	}
+	update := bson.D{{"$set", bson.D{
+		{"algorithm", owner.Algorithm},
+		{"shard", int64(owner.Shard)},
+		{"signer", owner.Signer},
+		{"expires_at", owner.ExpiresAt},
+	}}}
 	opts := options.Update().SetUpsert(true)
 	_, err := coll.UpdateOne(ctx, filter, update, opts)
+	if mongo.IsDuplicateKeyError(err) {
+		return fmt.Errorf("%w: %v", ErrKeyConflict, owner.KeyId)
+	}
 	return err
 }
 
+// ListKeyOwners reads claims of all keys
+func (c *mongoStore) ListKeyOwners(ctx context.Context) ([]KeyOwner, error) {
+	coll := c.client.Client.Database(dbName).Collection(keyOwners)
+	cursor, err := coll.Find(ctx, bson.D{})
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+	var owners []KeyOwner
+	for cursor.Next(ctx) {
+		var result bson.D
+		if err := cursor.Decode(&result); err != nil {
+			return nil, err
+		}
+		owner := KeyOwner{}
+		for _, r := range result {
+			switch {
+			case r.Key == "key":
+				owner.KeyId = fmt.Sprintf("%s", r.Value)
+			case r.Key == "algorithm":
+				owner.Algorithm = fmt.Sprintf("%s", r.Value)
+			case r.Key == "shard":
+				owner.Shard = int(toInt64(r.Value))
+			case r.Key == "signer":
+				owner.Signer = fmt.Sprintf("%s", r.Value)
+			case r.Key == "expires_at":
+				owner.ExpiresAt = r.Value.(primitive.DateTime).Time()
+			}
+		}
+		owners = append(owners, owner)
+	}
+	return owners, cursor.Err()
+}
+
+// ReadKeyIndex reads key rotation index of shard,
+// it is kept in signing keys state store along with key nonces
+func (c *mongoStore) ReadKeyIndex(ctx context.Context, shard int, algorithm string) (int, error) {
+	db := c.client.Client.Database(dbName)
+	coll := db.Collection(signingKeys)
+	var result bson.D
+	err := coll.FindOne(ctx, bson.D{{"id", keyIndexId(shard, algorithm)}}).Decode(&result)
+	if err == mongo.ErrNoDocuments {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	if v, ok := result.Map()["key_idx"].(int64); ok {
+		return int(v), nil
+	}
+	return 0, nil
+}
+
+// WriteKeyIndex upserts key rotation index of shard
+func (c *mongoStore) WriteKeyIndex(ctx context.Context, shard int, algorithm string, keyIdx int) error {
+	db := c.client.Client.Database(dbName)
+	coll := db.Collection(signingKeys)
+
+	filter := bson.D{{"id", keyIndexId(shard, algorithm)}}
+	update := bson.D{{"$set", bson.D{{"key_idx", int64(keyIdx)}}}}
+	opts := options.Update().SetUpsert(true)
+	_, err := coll.UpdateOne(ctx, filter, update, opts)
+	return err
+}
+
+// ReadTxRecords reads signed transaction records of key sorted by tx nonce
+func (c *mongoStore) ReadTxRecords(ctx context.Context, keyId string, fromNonce int64, limit int) ([]Record, error) {
+	db := c.client.Client.Database(dbName)
+	coll := db.Collection(signedCollection)
+	filter := bson.D{
+		{"key", keyId},
+		{"type", string(RecordTx)},
+		{"tx_nonce", bson.D{{"$gte", fromNonce}}},
+	}
+	opts := options.Find()
+	opts.SetSort(bson.D{{"tx_nonce", 1}})
+	if limit > 0 {
+		opts.SetLimit(int64(limit))
+	}
+	cursor, err := coll.Find(ctx, filter, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+	var records []Record
+	for cursor.Next(ctx) {
+		var result bson.D
+		if err := cursor.Decode(&result); err != nil {
+			return nil, err
+		}
+		records = append(records, decodeRecord(result))
+	}
+	return records, cursor.Err()
+}
+
+// ReadSignedRange reads signed records of key with nonce in range sorted by nonce
+func (c *mongoStore) ReadSignedRange(ctx context.Context, keyId string, fromNonce int64, toNonce int64) ([]Record, error) {
+	db := c.client.Client.Database(dbName)
+	coll := db.Collection(signedCollection)
+	filter := bson.D{
+		{"key", keyId},
+		{"nonce", bson.D{{"$gte", fromNonce}, {"$lt", toNonce}}},
+	}
+	opts := options.Find().SetSort(bson.D{{"nonce", 1}})
+	cursor, err := coll.Find(ctx, filter, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+	var records []Record
+	for cursor.Next(ctx) {
+		var result bson.D
+		if err := cursor.Decode(&result); err != nil {
+			return nil, err
+		}
+		records = append(records, decodeRecord(result))
+	}
+	return records, cursor.Err()
+}
+
+// DeleteUnsigned removes unsigned copies of signed records
+func (c *mongoStore) DeleteUnsigned(ctx context.Context, ids []string) error {
+	db := c.client.Client.Database(dbName)
+	coll := db.Collection(unsignedCollection)
+	_, err := coll.DeleteMany(ctx, bson.M{"id": bson.M{"$in": ids}})
+	return err
+}
+
+// UnsignRecord moves signed record back to unsigned records,
+// unsigned record is upserted first, so the move can be repeated after a failure
+func (c *mongoStore) UnsignRecord(ctx context.Context, id string) error {
+	db := c.client.Client.Database(dbName)
+	coll := db.Collection(unsignedCollection)
+	collSign := db.Collection(signedCollection)
+
+	filter := bson.D{{"id", id}}
+	var result bson.D
+	err := collSign.FindOne(ctx, filter).Decode(&result)
+	if err == mongo.ErrNoDocuments {
+		return ErrNotFound
+	}
+	if err != nil {
+		return err
+	}
+	record := unsignedCopy(decodeRecord(result))
+	shardKey, err := ShardKey(record.Id)
+	if err != nil {
+		return err
+	}
+	update := bson.D{
+		{"$set", bson.D{
+			{"msg", record.Msg},
+			{"type", string(record.Type)},
+			{"scheme", record.Scheme},
+			{"algorithm", record.Algorithm},
+			{shardKeyField, shardKey},
+		}},
+		{"$unset", bson.D{{"attempts", ""}, {"last_error", ""}}},
+	}
+	_, err = coll.UpdateOne(ctx, filter, update, options.Update().SetUpsert(true))
+	if err != nil {
+		return err
+	}
+	_, err = collSign.DeleteMany(ctx, filter)
+	return err
+}
+
+// WriteTxStatus updates broadcast status of signed transaction record
+func (c *mongoStore) WriteTxStatus(ctx context.Context, id string, status TxStatus) error {
+	db := c.client.Client.Database(dbName)
+	coll := db.Collection(signedCollection)
+	res, err := coll.UpdateOne(ctx, bson.D{{"id", id}},
+		bson.D{{"$set", bson.D{{"tx_status", string(status)}}}})
+	if err != nil {
+		return err
+	}
+	if res.MatchedCount == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// WriteMerkleBatch writes signed merkle batch root
+func (c *mongoStore) WriteMerkleBatch(ctx context.Context, batch *MerkleBatch) error {
+	db := c.client.Client.Database(dbName)
+	coll := db.Collection(merkleBatches)
+	_, err := coll.InsertOne(ctx, bson.D{
+		{"id", batch.Id},
+		{"key", batch.KeyId},
+		{"algorithm", batch.Algorithm},
+		{"sign", batch.Signature},
+		{"shard", int64(batch.Shard)},
+		{"size", int64(batch.Size)},
+		{"created_at", batch.CreatedAt},
+	})
+	return err
+}
+
+// ReadMerkleBatch reads merkle batch by id
+func (c *mongoStore) ReadMerkleBatch(ctx context.Context, id string) (*MerkleBatch, error) {
+	db := c.client.Client.Database(dbName)
+	coll := db.Collection(merkleBatches)
+	var result bson.D
+	err := coll.FindOne(ctx, bson.D{{"id", id}}).Decode(&result)
+	if err == mongo.ErrNoDocuments {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	batch := &MerkleBatch{}
+	for _, r := range result {
+		switch {
+		case r.Key == "id":
+			batch.Id = fmt.Sprintf("%s", r.Value)
+		case r.Key == "key":
+			batch.KeyId = fmt.Sprintf("%s", r.Value)
+		case r.Key == "algorithm":
+			batch.Algorithm = fmt.Sprintf("%s", r.Value)
+		case r.Key == "sign":
+			batch.Signature = fmt.Sprintf("%s", r.Value)
+		case r.Key == "shard":
+			batch.Shard = int(r.Value.(int64))
+		case r.Key == "size":
+			batch.Size = int(r.Value.(int64))
+		case r.Key == "created_at":
+			batch.CreatedAt = r.Value.(primitive.DateTime).Time()
+		}
+	}
+	return batch, nil
+}
+
+// ReadAuditHead reads the last audit log entry
+func (c *mongoStore) ReadAuditHead(ctx context.Context) (*AuditEntry, error) {
+	db := c.client.Client.Database(dbName)
+	coll := db.Collection(auditLog)
+	opts := options.FindOne().SetSort(bson.D{{"seq", -1}})
+	var result bson.D
+	err := coll.FindOne(ctx, bson.D{}, opts).Decode(&result)
+	if err == mongo.ErrNoDocuments {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	entry := decodeAuditEntry(result)
+	return &entry, nil
+}
+
+// WriteAuditEntry appends entry to audit log, unique index on seq
+// rejects concurrent entries with the same sequence number
+func (c *mongoStore) WriteAuditEntry(ctx context.Context, entry *AuditEntry) error {
+	db := c.client.Client.Database(dbName)
+	coll := db.Collection(auditLog)
+	_, err := coll.InsertOne(ctx, bson.D{
+		{"seq", entry.Seq},
+		{"time", entry.Time},
+		{"batch_id", entry.BatchId},
+		{"shard", int64(entry.Shard)},
+		{"key", entry.KeyId},
+		{"nonce_from", entry.NonceFrom},
+		{"nonce_to", entry.NonceTo},
+		{"record_ids", entry.RecordIds},
+		{"prev_hash", entry.PrevHash},
+		{"hash", entry.Hash},
+	})
+	if mongo.IsDuplicateKeyError(err) {
+		return fmt.Errorf("%w: seq %v", ErrAuditConflict, entry.Seq)
+	}
+	return err
+}
+
+// ScanAuditLog calls fn for every audit log entry in sequence order
+func (c *mongoStore) ScanAuditLog(ctx context.Context, fn func(entry AuditEntry) error) error {
+	db := c.client.Client.Database(dbName)
+	coll := db.Collection(auditLog)
+	opts := options.Find().SetSort(bson.D{{"seq", 1}})
+	cursor, err := coll.Find(ctx, bson.D{}, opts)
+	if err != nil {
+		return err
+	}
+	defer cursor.Close(ctx)
+	for cursor.Next(ctx) {
+		var result bson.D
+		if err := cursor.Decode(&result); err != nil {
+			return err
+		}
+		if err := fn(decodeAuditEntry(result)); err != nil {
+			return err
+		}
+	}
+	return cursor.Err()
+}
+
+// decodeAuditEntry converts mongo document to audit log entry
+func decodeAuditEntry(doc bson.D) AuditEntry {
+	entry := AuditEntry{}
+	for _, r := range doc {
+		switch {
+		case r.Key == "seq":
+			entry.Seq, _ = r.Value.(int64)
+		case r.Key == "time":
+			if t, ok := r.Value.(primitive.DateTime); ok {
+				entry.Time = t.Time()
+			}
+		case r.Key == "batch_id":
+			entry.BatchId = fmt.Sprintf("%s", r.Value)
+		case r.Key == "shard":
+			if shard, ok := r.Value.(int64); ok {
+				entry.Shard = int(shard)
+			}
+		case r.Key == "key":
+			entry.KeyId = fmt.Sprintf("%s", r.Value)
+		case r.Key == "nonce_from":
+			entry.NonceFrom, _ = r.Value.(int64)
+		case r.Key == "nonce_to":
+			entry.NonceTo, _ = r.Value.(int64)
+		case r.Key == "record_ids":
+			if ids, ok := r.Value.(bson.A); ok {
+				for _, id := range ids {
+					entry.RecordIds = append(entry.RecordIds, fmt.Sprintf("%s", id))
+				}
+			}
+		case r.Key == "prev_hash":
+			entry.PrevHash = fmt.Sprintf("%s", r.Value)
+		case r.Key == "hash":
+			entry.Hash = fmt.Sprintf("%s", r.Value)
+		}
+	}
+	return entry
+}
+
+// WatchInserts watches inserts into unsigned collection using change stream,
+// change streams are available on replica sets only
+func (c *mongoStore) WatchInserts(ctx context.Context) (<-chan int64, error) {
+	db := c.client.Client.Database(dbName)
+	coll := db.Collection(unsignedCollection)
+	pipeline := mongo.Pipeline{
+		bson.D{{"$match", bson.D{{"operationType", "insert"}}}},
+		bson.D{{"$project", bson.D{{"fullDocument." + shardKeyField, 1}}}},
+	}
+	stream, err := coll.Watch(ctx, pipeline)
+	if err != nil {
+		return nil, err
+	}
+	events := make(chan int64, 1024)
+	go func() {
+		defer close(events)
+		defer stream.Close(context.Background())
+		for stream.Next(ctx) {
+			var event struct {
+				FullDocument struct {
+					ShardKey int64 `bson:"shard_key"`
+				} `bson:"fullDocument"`
+			}
+			if err := stream.Decode(&event); err != nil {
+				log.Printf("ERROR: failed to decode change event, error: %v", err)
+				continue
+			}
+			select {
+			case events <- event.FullDocument.ShardKey:
+			default:
+				// signer is busy, it will pick up the record anyway
+			}
+		}
+		if err := stream.Err(); err != nil && ctx.Err() == nil {
+			log.Printf("ERROR: change stream failed, error: %v", err)
+		}
+	}()
+	return events, nil
+}
+
+// NewXact starts a new mongo transaction
+func (c *mongoStore) NewXact(ctx context.Context) (Xact, error) {
+	return NewMongoXact(c.client.Client)
+}
+
 func connect(ctx context.Context, uri string) (*mongo.Client, context.Context,
 	context.CancelFunc, error) {
 
@@ -298,7 +1233,7 @@ func connect(ctx context.Context, uri string) (*mongo.Client, context.Context,
 
 // This is a user defined method to close resources.
 // This method closes mongoDB connection and cancel context.
-func close(client *mongo.Client, ctx context.Context,
+func closeClient(client *mongo.Client, ctx context.Context,
 	cancel context.CancelFunc) {
 
 	// CancelFunc to cancel to context
@@ -311,7 +1246,7 @@ func close(client *mongo.Client, ctx context.Context,
 		// client.Disconnect method also has deadline.
 		// returns error if any,
 		if err := client.Disconnect(ctx); err != nil {
-			log.Printf("ERROR: failed to disconnect, error: %v, err")
+			log.Printf("ERROR: failed to disconnect, error: %v", err)
 		}
 	}()
 }
@@ -2,6 +2,7 @@ package store
 
 import (
 	"context"
+	"github.com/rovechkin1/message-sign/service/metrics"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
 	"go.mongodb.org/mongo-driver/mongo/readconcern"
@@ -29,13 +30,23 @@ func NewMongoXact(c *mongo.Client) (*MongoXact, error) {
 	return xact, nil
 }
 
-func (c *MongoXact) WithTransaction(ctx context.Context, callback func(sessionContext mongo.SessionContext) (interface{}, error)) (interface{}, error) {
-	r, err := c.session.WithTransaction(ctx, callback, c.txnOpts)
+func (c *MongoXact) WithTransaction(ctx context.Context, callback func(ctx context.Context) error) error {
+	attempts := 0
+	xactCallback := func(sessionContext mongo.SessionContext) (interface{}, error) {
+		// mongo driver retries callback on transient transaction errors
+		attempts += 1
+		if attempts > 1 {
+			metrics.XactRetries.Inc()
+		}
+		return nil, callback(sessionContext)
+	}
+	_, err := c.session.WithTransaction(ctx, xactCallback, c.txnOpts)
 	if err != nil {
+		metrics.XactAborts.Inc()
 		log.Printf("ERROR: WriteBatch: Failed WithTransaction, error: %v", err)
-		return nil, err
+		return err
 	}
-	return r, nil
+	return nil
 }
 
 func (c *MongoXact) Close(ctx context.Context) {
@@ -1,6 +1,32 @@
 package store
 
-import "context"
+import (
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"time"
+
+	"github.com/rovechkin1/message-sign/service/config"
+)
+
+var (
+	// ErrInvalidRecordId is returned when record id cannot be used for sharding
+	ErrInvalidRecordId = errors.New("invalid record id")
+	// ErrDuplicateRecord is returned when record with the same id already exists
+	ErrDuplicateRecord = errors.New("duplicate record")
+	// ErrNotFound is returned when requested document doesn't exist
+	ErrNotFound = errors.New("not found")
+	// ErrKeyConflict is returned when signing key is claimed by another live shard
+	ErrKeyConflict = errors.New("key is claimed by another shard")
+	// ErrNonceConflict is returned when key nonce was advanced by another writer
+	// or the key has a pending nonce reservation
+	ErrNonceConflict = errors.New("key nonce conflict")
+	// ErrAuditConflict is returned when audit entry with the same sequence number exists
+	ErrAuditConflict = errors.New("audit entry conflict")
+)
 
 // Record describing message to sign
 type Record struct {
@@ -14,11 +40,252 @@ type Record struct {
 	Salt string
 	// Public key id
 	KeyId string
+	// record type, empty type is a message
+	Type RecordType
+	// signature algorithm, empty algorithm is DefaultAlgorithm
+	Algorithm string
+	// sign scheme of message, empty scheme of unsigned record
+	// means the default scheme of deployment
+	Scheme string
+	// RLP encoded signed transaction, set for transaction records
+	RawTx string
+	// hash of signed transaction, set for transaction records
+	TxHash string
+	// nonce of signing key used for the record
+	Nonce int64
+	// account nonce of signed transaction, transactions of key have
+	// their own nonce sequence, so messages leave no gaps on chain
+	TxNonce int64
+	// broadcast status of transaction records
+	TxStatus TxStatus
+	// merkle batch of the record, set if record is signed as a part of batch root
+	BatchId string
+	// merkle inclusion proof of the record in the batch
+	Proof []string
+	// number of failed attempts to sign the record
+	Attempts int
+	// error of the last failed attempt
+	LastError string
+}
+
+// AuditEntry is an entry of hash-chained audit log of signed batches,
+// Hash covers all fields and the hash of the previous entry
+type AuditEntry struct {
+	// sequence number of entry starting from 1
+	Seq       int64
+	Time      time.Time
+	BatchId   string
+	Shard     int
+	KeyId     string
+	NonceFrom int64
+	NonceTo   int64
+	RecordIds []string
+	PrevHash  string
+	Hash      string
+}
+
+// QuarantinedRecord is an unsigned record which was inserted
+// bypassing validation and can't be signed because of invalid id
+type QuarantinedRecord struct {
+	Id            string
+	Msg           string
+	Reason        string
+	QuarantinedAt time.Time
+}
+
+// KeyOwner is a claim of a shard on a signing key, only the owner
+// shard signs with the key, so key nonce is never advanced concurrently
+type KeyOwner struct {
+	KeyId     string
+	Algorithm string
+	Shard     int
+	// signer which holds the shard
+	Signer    string
+	ExpiresAt time.Time
+}
+
+// MerkleBatch is a signed root of merkle tree over records of a batch
+type MerkleBatch struct {
+	// hex encoded merkle root
+	Id        string
+	KeyId     string
+	Algorithm string
+	// signature of the root
+	Signature string
+	Shard     int
+	Size      int
+	CreatedAt time.Time
+}
+
+// DefaultAlgorithm is a signature algorithm of records without algorithm
+const DefaultAlgorithm = "ecdsa-secp256k1"
+
+// isAlgorithm checks if record algorithm matches algorithm
+func isAlgorithm(recordAlgorithm string, algorithm string) bool {
+	if recordAlgorithm == "" {
+		recordAlgorithm = DefaultAlgorithm
+	}
+	return recordAlgorithm == algorithm
 }
 
+// keyIndexId is id of key rotation index of shard and algorithm,
+// index of default algorithm keeps its original id
+func keyIndexId(shard int, algorithm string) string {
+	if algorithm == "" || algorithm == DefaultAlgorithm {
+		return fmt.Sprintf("shard-%d", shard)
+	}
+	return fmt.Sprintf("shard-%d-%s", shard, algorithm)
+}
+
+// RecordType defines how record payload is signed
+type RecordType string
+
+const (
+	// RecordMsg payload is a message, salt+msg is signed
+	RecordMsg RecordType = "msg"
+	// RecordTx payload is a json transaction template,
+	// signer fills in key nonce and signs the transaction
+	RecordTx RecordType = "tx"
+)
+
+const (
+	// ShardHashLe64 shard key is first 8 bytes of hex record id
+	ShardHashLe64 = "le64"
+	// ShardHashFnv shard key is FNV-1a hash of record id, any string id can be used
+	ShardHashFnv = "fnv"
+)
+
+// maxRecordIdLen limits length of string record ids
+const maxRecordIdLen = 512
+
+// CheckShardHash checks that shard hash is supported
+func CheckShardHash(shardHash string) error {
+	switch shardHash {
+	case ShardHashLe64, ShardHashFnv:
+		return nil
+	}
+	return fmt.Errorf("unknown shard hash: %v", shardHash)
+}
+
+// ValidateRecordId checks that record id can be used for shard selection,
+// for le64 shard hash it must be a hex string of at least 8 bytes
+func ValidateRecordId(id string) error {
+	_, err := ShardKey(id)
+	return err
+}
+
+// ShardKey converts record id to a number used for shard selection
+// with shard hash of deployment. Shard key is computed once when
+// record is inserted and stored along with the record.
+// The key is an unsigned 64 bit number stored in int64 bits, so it fits
+// into mongo int64, use ShardOf to get its shard
+func ShardKey(id string) (int64, error) {
+	if config.GetShardHash() == ShardHashFnv {
+		return fnvShardKey(id)
+	}
+	return le64ShardKey(id)
+}
+
+// le64ShardKey converts first 8 bytes of hex record id to a number
+func le64ShardKey(id string) (int64, error) {
+	idBytes, err := hex.DecodeString(id)
+	if err != nil {
+		return 0, fmt.Errorf("%w: %v is not a hex string", ErrInvalidRecordId, id)
+	}
+	if len(idBytes) < 8 {
+		return 0, fmt.Errorf("%w: %v is less than 8 bytes", ErrInvalidRecordId, id)
+	}
+	return int64(binary.LittleEndian.Uint64(idBytes[:8])), nil
+}
+
+// fnvShardKey hashes raw record id with FNV-1a
+func fnvShardKey(id string) (int64, error) {
+	if id == "" {
+		return 0, fmt.Errorf("%w: id is empty", ErrInvalidRecordId)
+	}
+	if len(id) > maxRecordIdLen {
+		return 0, fmt.Errorf("%w: id is longer than %v bytes", ErrInvalidRecordId, maxRecordIdLen)
+	}
+	h := fnv.New64a()
+	h.Write([]byte(id))
+	return int64(h.Sum64()), nil
+}
+
+// ShardOf returns shard of shard key out of batchCount, shard key is
+// taken as unsigned number, the same way shards were always selected
+func ShardOf(shardKey int64, batchCount int) int {
+	return int(uint64(shardKey) % uint64(batchCount))
+}
+
+// RecordStatus is a signing status of a record
+type RecordStatus string
+
+const (
+	// RecordPending record is waiting to be signed
+	RecordPending RecordStatus = "pending"
+	// RecordSigned record is signed
+	RecordSigned RecordStatus = "signed"
+	// RecordDeadLetter record failed to sign too many times
+	RecordDeadLetter RecordStatus = "deadletter"
+	// RecordUnknown record is not found
+	RecordUnknown RecordStatus = "unknown"
+)
+
+// isInShard checks if record belongs to shard batchId out of batchCount
+func isInShard(id string, batchId int, batchCount int) (bool, error) {
+	i, err := ShardKey(id)
+	if err != nil {
+		return false, err
+	}
+	return ShardOf(i, batchCount) == batchId, nil
+}
+
+// TxStatus is a broadcast status of a signed transaction
+type TxStatus string
+
+const (
+	// TxNotSent transaction is signed but not broadcast yet
+	TxNotSent TxStatus = ""
+	// TxPending transaction is accepted by the node
+	TxPending TxStatus = "pending"
+	// TxMined transaction is included into a block
+	TxMined TxStatus = "mined"
+	// TxDropped transaction nonce was consumed by another transaction
+	TxDropped TxStatus = "dropped"
+)
+
 type SigningKeyMetadata struct {
 	Id    string
 	Nonce int64
+	// next account nonce of transactions signed with the key
+	TxNonce int64
+	// ReservedFrom and ReservedTo is a nonce range reserved by a batch
+	// which is not committed yet, ReservedTo is 0 if nothing is reserved
+	ReservedFrom int64
+	ReservedTo   int64
+	// tx nonce of key when the range was reserved
+	ReservedTxFrom int64
+}
+
+// unsignedCopy returns fields of signed record which are set on insert,
+// record signed as a part of merkle batch gets default scheme back
+func unsignedCopy(r Record) Record {
+	scheme := r.Scheme
+	if r.BatchId != "" {
+		scheme = ""
+	}
+	return Record{
+		Id:        r.Id,
+		Msg:       r.Msg,
+		Type:      r.Type,
+		Scheme:    scheme,
+		Algorithm: r.Algorithm,
+	}
+}
+
+// Reserved returns true if key has a pending nonce reservation
+func (c *SigningKeyMetadata) Reserved() bool {
+	return c.ReservedTo > 0
 }
 
 func NewSigningKeyMetadata(keyId string) *SigningKeyMetadata {
@@ -27,13 +294,36 @@ func NewSigningKeyMetadata(keyId string) *SigningKeyMetadata {
 	}
 }
 
+// Xact runs store operations as a single transaction
+type Xact interface {
+	// WithTransaction runs callback within a transaction, store operations
+	// must use ctx passed to callback to participate in the transaction.
+	// If callback returns an error the transaction is rolled back
+	WithTransaction(ctx context.Context, callback func(ctx context.Context) error) error
+
+	// Close releases transaction resources
+	Close(ctx context.Context)
+}
+
 // MessageStore is an interface to read/write messages
 type MessageStore interface {
 	// GetRecordCount records in store which are signed
 	GetRecordCount(ctx context.Context, signed bool) (int, error)
 
-	// ReadBatch reads messages in batch
-	ReadBatch(ctx context.Context, batchId int, batchCount int) ([]Record, error)
+	// ReadBatch reads up to limit messages in batch which are signed with algorithm
+	ReadBatch(ctx context.Context, batchId int, batchCount int, algorithm string, limit int) ([]Record, error)
+
+	// InsertRecords inserts new unsigned records,
+	// fails if any record id is invalid or already exists
+	InsertRecords(ctx context.Context, records []Record) error
+
+	// GetRecord returns record by id and its signing status,
+	// record is nil if status is RecordUnknown
+	GetRecord(ctx context.Context, id string) (*Record, RecordStatus, error)
+
+	// ScanSignedRecords calls fn for every signed record,
+	// scanning stops on the first error returned by fn
+	ScanSignedRecords(ctx context.Context, fn func(record Record) error) error
 
 	// WriteRecord writes a single record
 	WriteRecord(ctx context.Context, record Record) error
@@ -41,9 +331,108 @@ type MessageStore interface {
 	// WriteBatch writes records as a batch
 	WriteBatch(ctx context.Context, records []Record) error
 
-	// ReadSigningKeyMetadata reads metadata of signing key
+	// WriteSignFailure increments attempts of unsigned record and
+	// saves the error, returns number of attempts
+	WriteSignFailure(ctx context.Context, id string, reason string) (int, error)
+
+	// WriteDeadLetter moves unsigned record to dead letters
+	WriteDeadLetter(ctx context.Context, record Record) error
+
+	// ListDeadLetters reads up to limit dead letters sorted by id
+	ListDeadLetters(ctx context.Context, limit int) ([]Record, error)
+
+	// RequeueDeadLetter moves dead letter back to unsigned records
+	// with attempts reset, returns ErrNotFound if dead letter doesn't exist
+	RequeueDeadLetter(ctx context.Context, id string) error
+
+	// SweepRecords checks up to limit unsigned records without shard key,
+	// sets shard key of valid records and moves records with invalid ids
+	// to quarantine, returns number of quarantined records
+	SweepRecords(ctx context.Context, limit int) (int, error)
+
+	// ListQuarantine reads up to limit quarantined records
+	ListQuarantine(ctx context.Context, limit int) ([]QuarantinedRecord, error)
+
+	// ReadSigningKeyMetadata reads metadata of signing key,
+	// returns ErrNotFound if key has no metadata yet
 	ReadSigningKeyMetadata(ctx context.Context, keyId string) (*SigningKeyMetadata, error)
 
 	// WriteSigningKeyMetadata writes metadata of signing key
 	WriteSigningKeyMetadata(ctx context.Context, keyMetadata *SigningKeyMetadata) error
+
+	// ListSigningKeyMetadata reads metadata of all signing keys
+	ListSigningKeyMetadata(ctx context.Context) ([]SigningKeyMetadata, error)
+
+	// ReserveNonceRange atomically advances key nonce from nonce to nonce+count
+	// and tx nonce from txNonce to txNonce+txCount and marks the range as reserved.
+	// Returns ErrNonceConflict if key nonce is not nonce, tx nonce is not txNonce
+	// or another reservation of the key is pending
+	ReserveNonceRange(ctx context.Context, keyId string, nonce int64, count int64,
+		txNonce int64, txCount int64) error
+
+	// CommitNonceRange clears reservation [from, to) of key and sets key nonce
+	// and tx nonce, nonces are less than reserved if not all records were written.
+	// Returns ErrNonceConflict if the range is not reserved
+	CommitNonceRange(ctx context.Context, keyId string, from int64, to int64,
+		nonce int64, txNonce int64) error
+
+	// ReadSignedRange reads signed records of key with
+	// nonce in [fromNonce, toNonce) sorted by nonce
+	ReadSignedRange(ctx context.Context, keyId string, fromNonce int64, toNonce int64) ([]Record, error)
+
+	// DeleteUnsigned removes unsigned copies of records which are already signed
+	DeleteUnsigned(ctx context.Context, ids []string) error
+
+	// UnsignRecord moves signed record back to unsigned records, so it is
+	// signed again with a new nonce, all signed copies of the record are removed.
+	// Returns ErrNotFound if signed record doesn't exist
+	UnsignRecord(ctx context.Context, id string) error
+
+	// ClaimKey claims or renews key for shard until expiresAt. It succeeds
+	// if key is not claimed, claimed by the same shard or the claim expired at now,
+	// otherwise returns ErrKeyConflict
+	ClaimKey(ctx context.Context, owner KeyOwner, now time.Time) error
+
+	// ListKeyOwners reads claims of all keys
+	ListKeyOwners(ctx context.Context) ([]KeyOwner, error)
+
+	// ReadKeyIndex reads key rotation index of shard and algorithm,
+	// returns 0 if the index is not saved yet
+	ReadKeyIndex(ctx context.Context, shard int, algorithm string) (int, error)
+
+	// WriteKeyIndex writes key rotation index of shard and algorithm
+	WriteKeyIndex(ctx context.Context, shard int, algorithm string, keyIdx int) error
+
+	// ReadTxRecords reads up to limit signed transaction records
+	// of key with tx nonce >= fromNonce sorted by tx nonce
+	ReadTxRecords(ctx context.Context, keyId string, fromNonce int64, limit int) ([]Record, error)
+
+	// WriteTxStatus updates broadcast status of signed transaction record
+	WriteTxStatus(ctx context.Context, id string, status TxStatus) error
+
+	// WriteMerkleBatch writes signed merkle batch root
+	WriteMerkleBatch(ctx context.Context, batch *MerkleBatch) error
+
+	// ReadMerkleBatch reads merkle batch by id,
+	// returns ErrNotFound if batch doesn't exist
+	ReadMerkleBatch(ctx context.Context, id string) (*MerkleBatch, error)
+
+	// ReadAuditHead reads the last audit log entry,
+	// returns ErrNotFound if audit log is empty
+	ReadAuditHead(ctx context.Context) (*AuditEntry, error)
+
+	// WriteAuditEntry appends entry to audit log, returns
+	// ErrAuditConflict if entry with the same sequence number exists
+	WriteAuditEntry(ctx context.Context, entry *AuditEntry) error
+
+	// ScanAuditLog calls fn for every audit log entry in sequence order
+	ScanAuditLog(ctx context.Context, fn func(entry AuditEntry) error) error
+
+	// WatchInserts returns channel which delivers shard keys of inserted
+	// unsigned records. The channel is closed when ctx is done or
+	// the watch fails. Returns error if watching is not supported
+	WatchInserts(ctx context.Context) (<-chan int64, error)
+
+	// NewXact starts a new transaction
+	NewXact(ctx context.Context) (Xact, error)
 }
@@ -0,0 +1,51 @@
+package store
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// matchShardFilter evaluates shardFilter on shard key the way mongo does,
+// $mod remainder has the sign of the shard key
+func matchShardFilter(filter bson.A, shardKey int64) bool {
+	for _, f := range filter {
+		cond := f.(bson.D)[0].Value.(bson.D)
+		mod := cond[1].Value.(bson.A)
+		n := int64(mod[0].(int))
+		rem, ok := mod[1].(int64)
+		if !ok {
+			rem = int64(mod[1].(int))
+		}
+		if (cond[0].Key == "$gte") == (shardKey >= 0) && shardKey%n == rem {
+			return true
+		}
+	}
+	return false
+}
+
+func TestShardKeyKeepsMapping(t *testing.T) {
+	ids := []string{"0000000000000000", "ffffffffffffffff", "0123456789abcdef00", "00000000000000807f", "1f2e3d4c5b6a7988"}
+	for _, id := range ids {
+		shardKey, err := ShardKey(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		idBytes, _ := hex.DecodeString(id)
+		for _, batchCount := range []int{1, 2, 3, 5, 7, 8} {
+			// shard of the original mapping
+			want := int(binary.LittleEndian.Uint64(idBytes[:8]) % uint64(batchCount))
+			if got := ShardOf(shardKey, batchCount); got != want {
+				t.Errorf("id %v, batchCount %v: got shard %v, want %v", id, batchCount, got, want)
+			}
+			for batchId := 0; batchId < batchCount; batchId++ {
+				if matchShardFilter(shardFilter(batchId, batchCount), shardKey) != (batchId == want) {
+					t.Errorf("id %v, batchCount %v: filter of shard %v doesn't match shard %v",
+						id, batchCount, batchId, want)
+				}
+			}
+		}
+	}
+}